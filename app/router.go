@@ -2,6 +2,7 @@ package app
 
 import (
 	"miner-proxy/app/handles"
+	"miner-proxy/proxy/backend"
 	"miner-proxy/proxy/server"
 
 	"github.com/gin-gonic/gin"
@@ -13,6 +14,18 @@ func NewRouter(app *gin.Engine) {
 		c.JSON(200, gin.H{"data": server.ClientInfo(), "code": 200})
 	})
 
+	app.GET("/api/pools/", func(c *gin.Context) {
+		c.JSON(200, gin.H{"data": backend.PoolStatuses(), "code": 200})
+	})
+
+	app.GET("/api/tunnels/", func(c *gin.Context) {
+		c.JSON(200, gin.H{"data": server.TunnelStatuses(), "code": 200})
+	})
+
+	app.GET("/api/alerts/", func(c *gin.Context) {
+		c.JSON(200, gin.H{"data": server.Alerts(), "code": 200})
+	})
+
 	app.GET("/api/server/version/", func(c *gin.Context) {
 		c.JSON(200, gin.H{"data": c.GetString("tag"), "code": 200})
 	})
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	_ "embed"
 	"fmt"
 	app2 "miner-proxy/app"
 	"miner-proxy/pkg"
 	"miner-proxy/pkg/middleware"
+	"miner-proxy/proxy/backend"
 	"miner-proxy/proxy/client"
 	"miner-proxy/proxy/server"
+	"miner-proxy/proxy/state"
 	"miner-proxy/proxy/wxPusher"
 	"net/http"
 	"os"
@@ -208,7 +211,32 @@ func (p *proxyService) run() {
 
 func (p *proxyService) runClient() error {
 	id, _ := machineid.ID()
+	dialer, err := pkg.NewDialer(p.args.String("server_proxy"))
+	if err != nil {
+		return errors.Wrap(err, "server_proxy参数错误")
+	}
+	client.SetDialer(dialer)
+	client.SetHeartbeatMisses(p.args.Int("heartbeat_misses"))
+	if err := client.SetTunnelStrategy(p.args.String("tunnel_strategy")); err != nil {
+		return errors.Wrap(err, "tunnel_strategy参数错误")
+	}
+	if err := client.SetServerStrategy(p.args.String("server_strategy")); err != nil {
+		return errors.Wrap(err, "server_strategy参数错误")
+	}
+	if err := client.CheckServerAddresses(p.args.String("r")); err != nil {
+		return errors.Wrap(err, "-r参数错误")
+	}
+	if err := client.SetSessionResume(p.args.String("session_file"), time.Duration(p.args.Int("resume_window"))*time.Second); err != nil {
+		return errors.Wrap(err, "session_file参数错误")
+	}
 	pools := strings.Split(p.args.String("u"), ",")
+	tlsAddresses := strings.Split(strings.ReplaceAll(p.args.String("tls_l"), " ", ""), ",")
+	var tlsConfig *tls.Config
+	if p.args.String("tls_l") != "" {
+		if tlsConfig, err = p.loadTLSConfig(); err != nil {
+			return err
+		}
+	}
 	for index, port := range strings.Split(p.args.String("l"), ",") {
 		port = strings.ReplaceAll(port, " ", "")
 		if port == "" {
@@ -218,11 +246,16 @@ func (p *proxyService) runClient() error {
 			return errors.Errorf("-l参数: %s, --pool参数:%s; 必须一一对应", p.args.String("l"), p.args.String("u"))
 		}
 		pools[index] = strings.ReplaceAll(pools[index], " ", "")
+		if pools[index] != "" && !backend.IsGroupAddress(pools[index]) {
+			if _, err := backend.ParsePoolAddress(pools[index]); err != nil {
+				return errors.Wrap(err, "-u参数错误")
+			}
+		}
 		clientId := pkg.Crc32IEEEStr(fmt.Sprintf("%s-%s-%s-%s-%s", id,
 			p.args.String("k"), p.args.String("r"), port, pools[index]))
 
 		if err := pkg.Try(func() bool {
-			if err := client.InitServerManage(p.args.Int("n"), p.args.String("k"), p.args.String("r"), clientId, pools[index]); err != nil {
+			if err := client.InitServerManage(p.args.Int("min_n"), p.args.Int("n"), p.args.String("k"), p.args.String("r"), clientId, pools[index]); err != nil {
 				pkg.Error("连接到 %s 失败, 请检查到服务端的防火墙是否开放该端口, 或者检查服务端是否启动! 错误信息: %s", p.args.String("r"), err)
 				time.Sleep(time.Second)
 				return false
@@ -238,12 +271,129 @@ func (p *proxyService) runClient() error {
 				pkg.Panic("初始化%s客户端失败: %s", clientId, err)
 			}
 		}(pools[index], clientId, port)
+
+		if index < len(tlsAddresses) && tlsAddresses[index] != "" {
+			fmt.Printf("监听tls端口 '%s', 矿池地址: '%s'\n", tlsAddresses[index], pools[index])
+			go func(pool, clientId, address string) {
+				if err := client.RunTLSClient(address, p.args.String("k"), p.args.String("r"), pool, clientId, tlsConfig); err != nil {
+					pkg.Panic("初始化%s tls客户端失败: %s", clientId, err)
+				}
+			}(pools[index], clientId, tlsAddresses[index])
+		}
 	}
 	return nil
 }
 
 func (p *proxyService) runServer() error {
-	return server.NewServer(p.args.String("l"), p.args.String("k"), p.args.String("r"))
+	policy, err := server.LoadPoolPolicy(p.args.String("pool_policy"))
+	if err != nil {
+		return err
+	}
+	dialer, err := pkg.NewDialer(p.args.String("pool_proxy"))
+	if err != nil {
+		return errors.Wrap(err, "pool_proxy参数错误")
+	}
+	backend.SetDialer(dialer)
+	sourceIps := pkg.String2Array(strings.ReplaceAll(p.args.String("source_ip"), " ", ""), ",")
+	if err := backend.SetSourceAddresses(sourceIps, p.args.String("source_strategy")); err != nil {
+		return errors.Wrap(err, "source_ip参数错误")
+	}
+	policy.Allow = append(policy.Allow, pkg.String2Array(strings.ReplaceAll(p.args.String("allow_pools"), " ", ""), ",")...)
+	backups := pkg.String2Array(strings.ReplaceAll(p.args.String("backup_pool"), " ", ""), ",")
+	groups, err := backend.ParsePoolGroups(p.args.String("pool_group"), time.Duration(p.args.Int("pool_group_interval"))*time.Second)
+	if err != nil {
+		return errors.Wrap(err, "pool_group参数错误")
+	}
+	for _, v := range append([]string{p.args.String("r")}, backups...) {
+		if backend.IsGroupAddress(v) {
+			if _, ok := groups[backend.GroupName(v)]; !ok {
+				return errors.Errorf("矿池组 %s 不存在", v)
+			}
+			continue
+		}
+		if _, err := backend.ParsePoolAddress(v); err != nil {
+			return errors.Wrap(err, "矿池地址错误")
+		}
+	}
+	policy.AllowAny = policy.AllowAny || p.args.Bool("allow_any_pool")
+	switch {
+	case policy.IsOpen():
+		pkg.Warn("没有设置矿池白名单(allow_pools/pool_policy)并且开启了allow_any_pool, 任何知道密钥的客户端都可以通过服务端连接任意地址")
+	case policy.IsEmpty():
+		pkg.Info("没有设置矿池白名单(allow_pools/pool_policy), 客户端只能使用默认矿池与备用矿池")
+	}
+	config := server.Config{
+		PoolAddress:     p.args.String("r"),
+		BackupPools:     backups,
+		Aggregate:       p.args.Int("aggregate"),
+		EthTranslate:    p.args.Bool("eth_translate"),
+		PoolGroups:      groups,
+		Policy:          policy,
+		HeartbeatMisses: p.args.Int("heartbeat_misses"),
+		TunnelStrategy:  p.args.String("tunnel_strategy"),
+		ResumeWindow:    time.Duration(p.args.Int("resume_window")) * time.Second,
+	}
+	if config.State, err = state.Open(p.args.String("state_redis")); err != nil {
+		return errors.Wrap(err, "state_redis参数错误")
+	}
+	if config.Relay, err = p.relayConfig(); err != nil {
+		return err
+	}
+	config.StratumAddresses = pkg.String2Array(strings.ReplaceAll(p.args.String("stratum_l"), " ", ""), ",")
+	config.StratumTLSAddresses = pkg.String2Array(strings.ReplaceAll(p.args.String("tls_l"), " ", ""), ",")
+	if len(config.StratumTLSAddresses) != 0 {
+		tlsConfig, err := p.loadTLSConfig()
+		if err != nil {
+			return err
+		}
+		config.TLSConfig = tlsConfig
+	}
+	return server.NewServer(p.args.String("l"), p.args.String("k"), config)
+}
+
+// relayConfig --relay 不为空时使用中继模式, 连接上游服务端的参数与客户端一致
+func (p *proxyService) relayConfig() (*server.RelayConfig, error) {
+	if p.args.String("relay") == "" {
+		return nil, nil
+	}
+	if err := client.CheckServerAddresses(p.args.String("relay")); err != nil {
+		return nil, errors.Wrap(err, "relay参数错误")
+	}
+	dialer, err := pkg.NewDialer(p.args.String("server_proxy"))
+	if err != nil {
+		return nil, errors.Wrap(err, "server_proxy参数错误")
+	}
+	client.SetDialer(dialer)
+	client.SetHeartbeatMisses(p.args.Int("heartbeat_misses"))
+	if err := client.SetTunnelStrategy(p.args.String("tunnel_strategy")); err != nil {
+		return nil, errors.Wrap(err, "tunnel_strategy参数错误")
+	}
+	if err := client.SetServerStrategy(p.args.String("server_strategy")); err != nil {
+		return nil, errors.Wrap(err, "server_strategy参数错误")
+	}
+	config := &server.RelayConfig{
+		Address:   p.args.String("relay"),
+		SecretKey: p.args.String("relay_k"),
+		MinConn:   p.args.Int("min_n"),
+		MaxConn:   p.args.Int("n"),
+	}
+	if config.SecretKey == "" {
+		config.SecretKey = p.args.String("k")
+	}
+	return config, nil
+}
+
+// loadTLSConfig 加载 --tls_cert/--tls_key 指定的证书, 没有指定时使用自签名证书
+func (p *proxyService) loadTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := pkg.DefaultCertFiles()
+	if p.args.String("tls_cert") != "" {
+		certFile, keyFile = p.args.String("tls_cert"), p.args.String("tls_key")
+	}
+	cert, err := pkg.LoadOrCreateCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
 }
 
 func (p *proxyService) Stop(_ service.Service) error {
@@ -388,6 +538,9 @@ var (
 		"\t 服务端增加掉线通知: ./miner-proxy install -d -l :9998 -r 默认矿池域名:默认矿池端口 -k 密钥 --w appToken",
 		"\t linux查看以服务的方式安装的日志: journalctl -f -u miner-proxy",
 		"\t 客户端监听多个端口并且每个端口转发不同的矿池: ./miner-proxy -l :监听端口1,:监听端口2,:监听端口3 -r 服务端ip:服务端端口 -u 矿池链接1,矿池链接2,矿池链接3 -k 密钥 -d",
+		"\t 服务端允许矿机不经过客户端直接连接: ./miner-proxy -l :9998 -r 默认矿池域名:默认矿池端口 -k 密钥 --stratum_l :3333 --tls_l :3443",
+		"\t 服务端使用矿池组中延迟最低的端点: ./miner-proxy -l :9998 -r group://f2pool -k 密钥 --pool_group f2pool=eth.f2pool.com:6688,eth-backup.f2pool.com:6688",
+		"\t 客户端同时开启tls监听, 矿机使用 stratum+ssl://客户端ip:9443 连接: ./miner-proxy -c -l :9999 --tls_l :9443 -r 服务端ip:服务端端口 -k 密钥",
 	}
 )
 
@@ -408,7 +561,7 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:  "r",
-			Usage: "远程矿池地址或者远程本程序的监听地址 (default \"localhost:80\")",
+			Usage: "远程矿池地址或者远程本程序的监听地址, 客户端可以使用,分割多个服务端, 格式为 host:port[#权重], 矿池支持 stratum+tcp://, stratum+ssl://host:port?insecure=true&fingerprint=证书sha256, stratum v2 矿池使用 stratum2+tcp://用户@host:port/矿池公布的authority公钥, 没有公钥时必须加上 ?insecure=true, 矿池只能看到地址中的用户, 看不到矿机的矿工名 (default \"localhost:80\")",
 			Value: "127.0.0.1:80",
 		},
 		cli.StringFlag{
@@ -444,10 +597,117 @@ func main() {
 			Name:  "g",
 			Usage: "服务端参数, 使用指定的网址加速github下载, 示例: -g https://gh.api.99988866.xyz/  将会使用 https://gh.api.99988866.xyz/https://github.com/PerrorOne/miner-proxy/releases/download/{tag}/miner-proxy下载",
 		},
+		cli.StringFlag{
+			Name:  "backup_pool",
+			Usage: "服务端参数, 默认矿池(-r)的备用矿池, 多个使用,分割. 矿池断开并且重连失败之后依次尝试备用矿池, 矿机不会断开连接",
+		},
+		cli.IntFlag{
+			Name:  "aggregate",
+			Usage: "服务端参数, 开启矿池连接聚合, 使用同一个矿池账户的矿机共享上游矿池连接并且切分extranonce2, 值为每个矿池连接最多承载的矿机数量, 仅支持stratum v1协议, 0为不开启",
+		},
+		cli.BoolFlag{
+			Name:  "eth_translate",
+			Usage: "服务端参数, 矿机使用EthProxy(eth_submitLogin)而矿池只支持EthereumStratum/1.0.0时自动转换协议, 矿池支持EthProxy时直接透传",
+		},
+		cli.StringFlag{
+			Name:  "tls_l",
+			Usage: "客户端参数: 与 -l 一一对应的tls监听地址, 多个使用,分割, 不需要tls的端口留空, 例如: -l :9999,:8888 --tls_l :9443, 矿机使用 stratum+ssl://客户端ip:9443 连接; 服务端参数: 矿机直接连接服务端的tls监听地址, 转发到默认矿池(-r)",
+		},
+		cli.StringFlag{
+			Name:  "stratum_l",
+			Usage: "服务端参数, 矿机不通过客户端直接连接服务端时监听的地址, 多个使用,分割, 转发到默认矿池(-r), 例如: --stratum_l :3333",
+		},
+		cli.StringFlag{
+			Name:  "tls_cert",
+			Usage: "tls监听使用的证书文件, 没有设置时第一次启动会在程序目录下生成自签名证书 miner-proxy.crt",
+		},
+		cli.StringFlag{
+			Name:  "tls_key",
+			Usage: "tls监听使用的私钥文件, 与 --tls_cert 一起使用",
+		},
+		cli.StringFlag{
+			Name:  "pool_group",
+			Usage: "服务端参数, 矿池组, 同一个矿池的多个地区端点, 格式为 组名=矿池1,矿池2;组名=矿池3,矿池4, 使用 -r group://组名 或者客户端 -u group://组名, 服务端定时测量延迟, 新的矿机连接延迟最低的端点",
+		},
+		cli.IntFlag{
+			Name:  "pool_group_interval",
+			Usage: "服务端参数, 矿池组测量延迟的间隔秒数",
+			Value: 60,
+		},
+		cli.StringFlag{
+			Name:  "pool_proxy",
+			Usage: "服务端参数, 通过代理连接矿池, 支持 socks5://用户:密码@host:port 与 http://用户:密码@host:port(HTTP CONNECT), 不需要认证时省略用户与密码",
+		},
+		cli.StringFlag{
+			Name:  "source_ip",
+			Usage: "服务端参数, 连接矿池使用的本机ip, 多个使用,分割, 用于绕过矿池对单个ip的连接数限制",
+		},
+		cli.StringFlag{
+			Name:  "source_strategy",
+			Usage: "服务端参数, 多个 --source_ip 时的选择策略: round_robin(轮询), least_conn(到该矿池连接数最少), sticky(同一个客户端使用同一个ip)",
+			Value: "round_robin",
+		},
+		cli.StringFlag{
+			Name:  "server_proxy",
+			Usage: "客户端参数, 通过代理连接服务端, 格式与 --pool_proxy 一致",
+		},
+		cli.StringFlag{
+			Name:  "allow_pools",
+			Usage: "服务端参数, 客户端可以使用的矿池白名单, 多个使用,分割, 格式为 host:port, 支持通配符, 例如: *.f2pool.com:6688,eth.sparkpool.com:*",
+		},
+		cli.BoolFlag{
+			Name:  "allow_any_pool",
+			Usage: "服务端参数, 没有设置矿池白名单时允许客户端连接任意地址, 开启之后服务端是一个开放的中继, 不建议在公网上开启",
+		},
+		cli.StringFlag{
+			Name:  "pool_policy",
+			Usage: "服务端参数, 矿池策略json文件, 支持白名单(allow), 每个客户端的白名单(clients), 矿池地址替换规则(rewrite), 按照cron时间窗口切换矿池的时间表(schedule), 时间表切换时矿机不会断开连接, 按照客户端与矿工名称建议难度的规则(difficulty), 以及矿工名改写规则(workers)",
+		},
 		cli.IntFlag{
 			Name:  "n",
 			Value: 10,
-			Usage: "客户端参数, 指定客户端启动时对于每一个转发端口通过多少tcp隧道连接服务端, 如果不清楚请保持默认, 不要设置小于2",
+			Usage: "客户端参数, 对于每一个转发端口最多通过多少tcp隧道连接服务端, 隧道数量在 --min_n 与 -n 之间根据矿机数量与等待确认的数据自动调整, 如果不清楚请保持默认, 不要设置小于2",
+		},
+		cli.IntFlag{
+			Name:  "min_n",
+			Value: 2,
+			Usage: "客户端参数, 对于每一个转发端口最少保持多少tcp隧道连接服务端, 大于 -n 时使用 -n",
+		},
+		cli.IntFlag{
+			Name:  "heartbeat_misses",
+			Value: 3,
+			Usage: "服务端与客户端参数, 服务端每20秒向每一个隧道连接发送心跳, 连续多少次没有响应时服务端不再通过该连接发送数据, 客户端超过该次数没有收到心跳时重新建立连接",
+		},
+		cli.StringFlag{
+			Name:  "tunnel_strategy",
+			Value: "round_robin",
+			Usage: "服务端与客户端参数, 多个隧道连接的选择策略: round_robin(轮询), least_inflight(等待确认的数据最少), lowest_rtt(延迟最低), sticky(同一个矿机使用同一个连接, 连接失效时切换)",
+		},
+		cli.StringFlag{
+			Name:  "state_redis",
+			Usage: "服务端参数, 多个服务端共享会话状态使用的redis, 格式为 redis://:密码@host:port/db, 多个服务端放在同一个tcp负载均衡之后时必须设置, 客户端的隧道连接可以连接任意一个服务端, 数据会转发到矿池连接所在的服务端",
+		},
+		cli.StringFlag{
+			Name:  "relay",
+			Usage: "服务端参数, 中继模式的上游服务端地址, 格式与客户端的 -r 参数一致, 设置之后不连接矿池, 客户端的数据原样转发给上游服务端, 上游服务端显示原始的客户端, 隧道数量使用 -n 与 --min_n, 通过代理连接使用 --server_proxy",
+		},
+		cli.StringFlag{
+			Name:  "relay_k",
+			Usage: "服务端参数, 连接中继模式的上游服务端使用的密钥, 为空时使用 -k",
+		},
+		cli.StringFlag{
+			Name:  "server_strategy",
+			Value: "priority",
+			Usage: "客户端参数, -r 指定多个服务端时新的矿机选择服务端的策略: priority(按照顺序使用第一个可用的服务端), weighted(按照权重随机选择), 服务端失效时矿机会切换到可用的服务端并且恢复与矿池的会话",
+		},
+		cli.StringFlag{
+			Name:  "session_file",
+			Usage: "客户端参数, 保存矿机会话的文件, 为空时保存在程序所在目录的 miner-proxy.sessions",
+		},
+		cli.IntFlag{
+			Name:  "resume_window",
+			Value: 120,
+			Usage: "服务端与客户端参数, 客户端重启或者隧道连接全部断开之后多少秒之内重新连接的矿机恢复服务端上的会话, 继续使用原来的矿池连接, 服务端在这段时间内保留矿机的会话, 为 0 时不恢复",
 		},
 	}
 
@@ -0,0 +1,23 @@
+package pkg
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "miner-proxy.crt"), filepath.Join(dir, "miner-proxy.key")
+	created, err := LoadOrCreateCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadOrCreateCertificate() error = %v", err)
+	}
+	loaded, err := LoadOrCreateCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadOrCreateCertificate() error = %v", err)
+	}
+	if !bytes.Equal(created.Certificate[0], loaded.Certificate[0]) {
+		t.Error("LoadOrCreateCertificate() generated a new certificate, want the persisted one")
+	}
+}
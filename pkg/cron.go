@@ -0,0 +1,100 @@
+package pkg
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cronBounds 分 时 日 月 周 每一个字段的取值范围
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// Cron 5个字段的 cron 表达式(分 时 日 月 周), 用来描述时间窗口而不是触发时间
+// 支持 *, */n, a-b, a-b/n 以及使用,分割的列表, 周日为0(7也表示周日)
+type Cron struct {
+	fields [5]uint64
+	// 日与周都不是*时, 与 cron 一致, 满足其中一个即可
+	domStar, dowStar bool
+}
+
+// ParseCron 解析 cron 表达式
+func ParseCron(expr string) (*Cron, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return nil, errors.Errorf("cron %s must have 5 fields", expr)
+	}
+	c := &Cron{domStar: parts[2] == "*", dowStar: parts[4] == "*"}
+	for i, v := range parts {
+		bits, err := parseCronField(v, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid cron %s", expr)
+		}
+		c.fields[i] = bits
+	}
+	if c.fields[4]&(1<<7) != 0 {
+		c.fields[4] |= 1
+	}
+	return c, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if index := strings.Index(item, "/"); index >= 0 {
+			n, err := strconv.Atoi(item[index+1:])
+			if err != nil || n <= 0 {
+				return 0, errors.Errorf("invalid step %s", item)
+			}
+			step, item = n, item[:index]
+		}
+		start, end := min, max
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			index := strings.Index(item, "-")
+			var err1, err2 error
+			start, err1 = strconv.Atoi(item[:index])
+			end, err2 = strconv.Atoi(item[index+1:])
+			if err1 != nil || err2 != nil {
+				return 0, errors.Errorf("invalid range %s", item)
+			}
+		default:
+			n, err := strconv.Atoi(item)
+			if err != nil {
+				return 0, errors.Errorf("invalid value %s", item)
+			}
+			start, end = n, n
+			if step != 1 { // a/n 表示从 a 开始到最大值
+				end = max
+			}
+		}
+		if max == 6 && end == 7 { // 周字段允许使用7表示周日
+			max = 7
+		}
+		if start < min || end > max || start > end {
+			return 0, errors.Errorf("value %s out of range [%d, %d]", item, min, max)
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// Match 时间是否在表达式描述的窗口中, 精确到分钟
+func (c *Cron) Match(t time.Time) bool {
+	if c.fields[0]&(1<<uint(t.Minute())) == 0 ||
+		c.fields[1]&(1<<uint(t.Hour())) == 0 ||
+		c.fields[3]&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.fields[2]&(1<<uint(t.Day())) != 0
+	dow := c.fields[4]&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
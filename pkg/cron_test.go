@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron_Match(t *testing.T) {
+	// 2022-03-07 是周一
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2022, 3, 7, hour, minute, 0, 0, time.Local)
+	}
+	tests := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", monday(0, 0), true},
+		{"* 22-23,0-7 * * *", monday(23, 59), true},
+		{"* 22-23,0-7 * * *", monday(6, 30), true},
+		{"* 22-23,0-7 * * *", monday(8, 0), false},
+		{"*/15 * * * *", monday(10, 30), true},
+		{"*/15 * * * *", monday(10, 31), false},
+		{"* * * * 1-5", monday(12, 0), true},
+		{"* * * * 0,6", monday(12, 0), false},
+		{"* * * * 7", time.Date(2022, 3, 6, 12, 0, 0, 0, time.Local), true},
+		{"* * 1 * 1", monday(12, 0), true}, // 日与周满足一个即可
+		{"* * 1 * 2", monday(12, 0), false},
+		{"0 9 * 3 *", monday(9, 0), true},
+		{"0 9 * 4 *", monday(9, 0), false},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%s) error: %s", tt.expr, err)
+		}
+		if got := c.Match(tt.t); got != tt.want {
+			t.Errorf("%s Match(%s) = %v, want %v", tt.expr, tt.t, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* 5-1 * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%s) should fail", expr)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Dialer 建立 tcp 连接, 可以直接连接或者通过代理连接
+type Dialer interface {
+	Dial(address string, timeout time.Duration) (net.Conn, error)
+}
+
+// DirectDialer 直接连接, LocalIP 不为空时使用该地址作为源地址
+type DirectDialer struct {
+	LocalIP net.IP
+}
+
+func (d DirectDialer) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	if d.LocalIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: d.LocalIP}
+	}
+	return dialer.Dial("tcp", address)
+}
+
+// BindSource 返回使用指定源地址的 Dialer, 通过代理连接时绑定的是连接代理的源地址
+func BindSource(d Dialer, ip net.IP) Dialer {
+	switch v := d.(type) {
+	case DirectDialer:
+		v.LocalIP = ip
+		return v
+	case *socks5Dialer:
+		c := *v
+		c.local.LocalIP = ip
+		return &c
+	case *httpConnectDialer:
+		c := *v
+		c.local.LocalIP = ip
+		return &c
+	}
+	return d
+}
+
+// NewDialer 根据代理地址创建 Dialer, 地址为空时直接连接
+// 支持 socks5://[用户:密码@]host:port 与 http://[用户:密码@]host:port(HTTP CONNECT)
+func NewDialer(proxy string) (Dialer, error) {
+	if proxy == "" {
+		return DirectDialer{}, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid proxy %s", proxy)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, errors.Wrapf(err, "invalid proxy %s", proxy)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "socks5", "socks5h":
+		return &socks5Dialer{address: u.Host, user: u.User}, nil
+	case "http":
+		return &httpConnectDialer{address: u.Host, user: u.User}, nil
+	}
+	return nil, errors.Errorf("unsupported proxy scheme %s", u.Scheme)
+}
+
+// dialProxy 连接代理服务器, 握手期间使用 timeout 作为超时时间
+func dialProxy(local DirectDialer, proxy, address string, timeout time.Duration, handshake func(conn net.Conn) error) (net.Conn, error) {
+	conn, err := local.Dial(proxy, timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial proxy %s error", proxy)
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if err := handshake(conn); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "proxy %s connect %s error", proxy, address)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Dialer 通过 socks5 代理连接, 目标地址由代理解析(RFC 1928, 用户名密码认证 RFC 1929)
+type socks5Dialer struct {
+	address string
+	user    *url.Userinfo
+	local   DirectDialer
+}
+
+func (d *socks5Dialer) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	return dialProxy(d.local, d.address, address, timeout, func(conn net.Conn) error {
+		return d.handshake(conn, address)
+	})
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return errors.Errorf("invalid port %s", portStr)
+	}
+	methods := []byte{0x00}
+	if d.user != nil {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return errors.Errorf("unexpected socks version %d", reply[0])
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if d.user == nil {
+			return errors.New("socks5 proxy require authentication")
+		}
+		password, _ := d.user.Password()
+		req := []byte{0x01, byte(len(d.user.Username()))}
+		req = append(req, d.user.Username()...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks5 authentication failed")
+		}
+	default:
+		return errors.New("socks5 proxy has no acceptable authentication method")
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(append(req, 0x01), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 0x04), ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return errors.Errorf("host %s too long", host)
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return errors.Errorf("socks5 connect failed, code %d", header[1])
+	}
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		skip = int(size[0])
+	default:
+		return errors.Errorf("unknown socks5 address type %d", header[3])
+	}
+	// 绑定地址与2字节的端口, 不需要使用
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// httpConnectDialer 通过 HTTP CONNECT 代理连接
+type httpConnectDialer struct {
+	address string
+	user    *url.Userinfo
+	local   DirectDialer
+}
+
+func (d *httpConnectDialer) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	var reader *bufio.Reader
+	conn, err := dialProxy(d.local, d.address, address, timeout, func(conn net.Conn) error {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: address},
+			Host:   address,
+			Header: make(http.Header),
+		}
+		if d.user != nil {
+			password, _ := d.user.Password()
+			auth := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+		reader = bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("http proxy response %s", resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reader.Buffered() != 0 { // 代理在响应之后紧接着发送的数据
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// echoServer 返回一个回显服务的地址
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// proxyServer 启动一个代理服务, handshake 返回客户端请求的目标地址
+func proxyServer(t *testing.T, handshake func(conn net.Conn, reader *bufio.Reader) (string, error)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				target, err := handshake(conn, reader)
+				if err != nil {
+					return
+				}
+				remote, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer remote.Close()
+				go func() { _, _ = io.Copy(remote, reader) }()
+				_, _ = io.Copy(conn, remote)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func socks5Handshake(conn net.Conn, reader *bufio.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	if methods[0] != 0x02 {
+		_, _ = conn.Write([]byte{0x05, 0xff})
+		return "", io.EOF
+	}
+	_, _ = conn.Write([]byte{0x05, 0x02})
+	read := func() string {
+		size, _ := reader.ReadByte()
+		data := make([]byte, size)
+		_, _ = io.ReadFull(reader, data)
+		return string(data)
+	}
+	_, _ = reader.ReadByte()
+	if read() != "user" || read() != "pass" {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return "", io.EOF
+	}
+	_, _ = conn.Write([]byte{0x01, 0x00})
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(reader, req); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		_, _ = io.ReadFull(reader, ip)
+		host = net.IP(ip).String()
+	case 0x03:
+		host = read()
+	}
+	port := make([]byte, 2)
+	_, _ = io.ReadFull(reader, port)
+	_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+func httpHandshake(conn net.Conn, reader *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+		_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return "", io.EOF
+	}
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return req.Host, nil
+}
+
+func TestNewDialer(t *testing.T) {
+	target := echoServer(t)
+	socks5 := proxyServer(t, socks5Handshake)
+	httpProxy := proxyServer(t, httpHandshake)
+	tests := []struct {
+		proxy   string
+		wantErr bool
+	}{
+		{proxy: ""},
+		{proxy: "socks5://user:pass@" + socks5},
+		{proxy: "socks5://user:wrong@" + socks5, wantErr: true},
+		{proxy: "socks5://" + socks5, wantErr: true},
+		{proxy: "http://user:pass@" + httpProxy},
+		{proxy: "http://" + httpProxy, wantErr: true},
+	}
+	for _, tt := range tests {
+		d, err := NewDialer(tt.proxy)
+		if err != nil {
+			t.Fatalf("NewDialer(%s) error: %s", tt.proxy, err)
+		}
+		conn, err := d.Dial(target, time.Second)
+		if tt.wantErr {
+			if err == nil {
+				_ = conn.Close()
+				t.Errorf("Dial via %s should fail", tt.proxy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Dial via %s error: %s", tt.proxy, err)
+		}
+		_, _ = conn.Write([]byte("ping"))
+		data := make([]byte, 4)
+		if _, err := io.ReadFull(conn, data); err != nil || string(data) != "ping" {
+			t.Errorf("echo via %s = %s, %v", tt.proxy, data, err)
+		}
+		_ = conn.Close()
+	}
+
+	if _, err := NewDialer("ftp://127.0.0.1:21"); err == nil {
+		t.Error("unsupported scheme should fail")
+	}
+}
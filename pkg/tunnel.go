@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+)
+
+const (
+	// TunnelRoundRobin 依次使用每一个隧道连接
+	TunnelRoundRobin = "round_robin"
+	// TunnelLeastInflight 使用等待确认的数据帧最少的隧道连接
+	TunnelLeastInflight = "least_inflight"
+	// TunnelLowestRTT 使用往返延迟最低的隧道连接, 没有测量结果时轮询
+	TunnelLowestRTT = "lowest_rtt"
+	// TunnelSticky 同一个矿机总是使用同一个隧道连接, 连接失效时使用下一个
+	TunnelSticky = "sticky"
+)
+
+// Tunnel 可以被选择的隧道连接
+type Tunnel interface {
+	// Healthy 失效的连接不会被选择
+	Healthy() bool
+	// Inflight 已经发送还没有收到确认的数据帧数量
+	Inflight() int64
+	// RTT 往返延迟, 没有测量结果时返回 false
+	RTT() (time.Duration, bool)
+}
+
+// TunnelSelector 按照策略从多个隧道连接中选择一个
+type TunnelSelector struct {
+	strategy string
+	next     *atomic.Uint64
+}
+
+// NewTunnelSelector 创建隧道选择器, strategy 为空时使用轮询
+func NewTunnelSelector(strategy string) (*TunnelSelector, error) {
+	switch strategy {
+	case "":
+		strategy = TunnelRoundRobin
+	case TunnelRoundRobin, TunnelLeastInflight, TunnelLowestRTT, TunnelSticky:
+	default:
+		return nil, errors.Errorf("unsupported tunnel strategy %s", strategy)
+	}
+	return &TunnelSelector{strategy: strategy, next: atomic.NewUint64(0)}, nil
+}
+
+func (s *TunnelSelector) Strategy() string {
+	return s.strategy
+}
+
+// Select 返回选择的隧道下标, key 为 sticky 策略使用的矿机id, 没有健康的隧道时返回 -1
+func (s *TunnelSelector) Select(tunnels []Tunnel, key string) int {
+	if len(tunnels) == 0 {
+		return -1
+	}
+	size := uint64(len(tunnels))
+	start := s.next.Inc()
+	if s.strategy == TunnelSticky && key != "" {
+		start = uint64(Crc32IEEE([]byte(key)))
+	}
+	best := -1
+	var bestInflight int64
+	var bestRTT time.Duration
+	var bestKnown bool
+	for i := uint64(0); i < size; i++ {
+		index := int((start + i) % size)
+		t := tunnels[index]
+		if !t.Healthy() {
+			continue
+		}
+		switch s.strategy {
+		case TunnelRoundRobin, TunnelSticky:
+			return index
+		case TunnelLeastInflight:
+			if inflight := t.Inflight(); best == -1 || inflight < bestInflight {
+				best, bestInflight = index, inflight
+			}
+		case TunnelLowestRTT:
+			rtt, known := t.RTT()
+			if best == -1 || (known && (!bestKnown || rtt < bestRTT)) {
+				best, bestRTT, bestKnown = index, rtt, known
+			}
+		}
+	}
+	return best
+}
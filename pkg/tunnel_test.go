@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeTunnel struct {
+	healthy  bool
+	inflight int64
+	rtt      time.Duration
+}
+
+func (t fakeTunnel) Healthy() bool   { return t.healthy }
+func (t fakeTunnel) Inflight() int64 { return t.inflight }
+func (t fakeTunnel) RTT() (time.Duration, bool) {
+	return t.rtt, t.rtt != 0
+}
+
+func TestTunnelSelector_Select(t *testing.T) {
+	tunnels := []Tunnel{
+		fakeTunnel{healthy: true, inflight: 3, rtt: 40 * time.Millisecond},
+		fakeTunnel{healthy: false, inflight: 0, rtt: 5 * time.Millisecond},
+		fakeTunnel{healthy: true, inflight: 1},
+		fakeTunnel{healthy: true, inflight: 2, rtt: 20 * time.Millisecond},
+	}
+	tests := []struct {
+		strategy string
+		want     int
+	}{
+		{TunnelLeastInflight, 2},
+		{TunnelLowestRTT, 3},
+	}
+	for _, tt := range tests {
+		s, err := NewTunnelSelector(tt.strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(tunnels); i++ {
+			if got := s.Select(tunnels, ""); got != tt.want {
+				t.Errorf("%s Select() = %d, want %d", tt.strategy, got, tt.want)
+			}
+		}
+	}
+
+	s, _ := NewTunnelSelector(TunnelRoundRobin)
+	seen := map[int]bool{}
+	for i := 0; i < len(tunnels)*2; i++ {
+		seen[s.Select(tunnels, "")] = true
+	}
+	if len(seen) != 3 || seen[1] {
+		t.Errorf("round robin selected %v", seen)
+	}
+
+	s, _ = NewTunnelSelector(TunnelSticky)
+	first := s.Select(tunnels, "miner1")
+	for i := 0; i < 4; i++ {
+		if got := s.Select(tunnels, "miner1"); got != first {
+			t.Errorf("sticky Select() = %d, want %d", got, first)
+		}
+	}
+	// 固定的连接失效之后使用下一个健康的连接
+	failover := append([]Tunnel(nil), tunnels...)
+	failover[first] = fakeTunnel{}
+	if got := s.Select(failover, "miner1"); got == first || got == 1 || got < 0 {
+		t.Errorf("sticky failover Select() = %d", got)
+	}
+
+	if got := s.Select([]Tunnel{fakeTunnel{}}, "miner1"); got != -1 {
+		t.Errorf("Select() without healthy tunnel = %d, want -1", got)
+	}
+	if _, err := NewTunnelSelector("random"); err == nil {
+		t.Errorf("NewTunnelSelector(random) should fail")
+	}
+}
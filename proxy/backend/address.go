@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"miner-proxy/pkg"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+)
+
+const (
+	SchemeTCP = "stratum+tcp"
+	SchemeSSL = "stratum+ssl"
+	SchemeTLS = "stratum+tls"
+	// dialTimeout 连接矿池的超时时间
+	dialTimeout = time.Second * 10
+)
+
+var (
+	// poolDialer 连接矿池使用的 Dialer, 可以配置为通过代理连接
+	poolDialer pkg.Dialer = pkg.DirectDialer{}
+)
+
+// SetDialer 设置连接矿池使用的 Dialer
+func SetDialer(d pkg.Dialer) {
+	poolDialer = d
+}
+
+// PoolAddress 解析之后的矿池地址
+// 格式为 [scheme://]host:port[?insecure=true&fingerprint=sha256], 没有 scheme 时为 stratum+tcp
+// insecure 不校验矿池证书, fingerprint 为证书 DER 的 sha256, 设置之后只校验指纹
+type PoolAddress struct {
+	Raw         string
+	Scheme      string
+	Host        string
+	Insecure    bool
+	Fingerprint []byte
+}
+
+// ParsePoolAddress 解析矿池地址
+func ParsePoolAddress(addr string) (PoolAddress, error) {
+	addr = strings.TrimSpace(addr)
+	result := PoolAddress{Raw: addr, Scheme: SchemeTCP, Host: addr}
+	if !strings.Contains(addr, "://") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return result, errors.Wrapf(err, "invalid pool address %s", addr)
+		}
+		return result, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return result, errors.Wrapf(err, "invalid pool address %s", addr)
+	}
+	result.Scheme, result.Host = strings.ToLower(u.Scheme), u.Host
+	switch result.Scheme {
+	case SchemeTCP, SchemeSSL, SchemeTLS:
+	case strings.TrimSuffix(SV2Scheme, "://"):
+		if _, _, _, err := parseSV2Address(addr); err != nil {
+			return result, err
+		}
+		return result, nil
+	default:
+		return result, errors.Errorf("unsupported pool scheme %s", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return result, errors.Wrapf(err, "invalid pool address %s", addr)
+	}
+	query := u.Query()
+	result.Insecure = cast.ToBool(query.Get("insecure"))
+	if v := query.Get("fingerprint"); v != "" {
+		result.Fingerprint, err = hex.DecodeString(strings.ReplaceAll(v, ":", ""))
+		if err != nil || len(result.Fingerprint) != sha256.Size {
+			return result, errors.Errorf("invalid pool certificate fingerprint %s", v)
+		}
+	}
+	return result, nil
+}
+
+// IsTLS 是否使用 tls 连接矿池
+func (a PoolAddress) IsTLS() bool {
+	return a.Scheme == SchemeSSL || a.Scheme == SchemeTLS
+}
+
+func (a PoolAddress) tlsConfig() *tls.Config {
+	host, _, _ := net.SplitHostPort(a.Host)
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: a.Insecure}
+	if len(a.Fingerprint) != 0 {
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("pool not send certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if subtle.ConstantTimeCompare(sum[:], a.Fingerprint) != 1 {
+				return errors.Errorf("pool certificate fingerprint %x not match", sum)
+			}
+			return nil
+		}
+	}
+	return config
+}
+
+// Dial 连接矿池, 连接的结果与延迟会记录到矿池的健康状况中
+// key 为客户端id, 配置了源地址并且使用 sticky 策略时同一个客户端使用同一个源地址
+func (a PoolAddress) Dial(key string) (net.Conn, error) {
+	h := dialHealth(a.Raw)
+	defer h.dialing.Dec()
+	source := sources.pick(h, key)
+	start := time.Now()
+	conn, err := a.dial(source)
+	h.dialed(time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+	return newHealthConn(conn, h, source), nil
+}
+
+// dial 连接矿池, source 不为空时绑定源地址
+func (a PoolAddress) dial(source net.IP) (net.Conn, error) {
+	dialer := poolDialer
+	if source != nil {
+		dialer = pkg.BindSource(dialer, source)
+	}
+	conn, err := dialer.Dial(a.Host, dialTimeout)
+	if err != nil {
+		if source != nil {
+			return nil, errors.Wrapf(err, "dial mine pool %s from %s error", a.Host, source)
+		}
+		return nil, errors.Wrapf(err, "dial mine pool %s error", a.Host)
+	}
+	if !a.IsTLS() {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, a.tlsConfig())
+	_ = tlsConn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, errors.Wrapf(err, "tls handshake with mine pool %s error", a.Host)
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// dialPool 解析并且连接矿池地址
+func dialPool(addr, key string) (net.Conn, error) {
+	a, err := ParsePoolAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	return a.Dial(key)
+}
@@ -0,0 +1,79 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParsePoolAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		scheme  string
+		host    string
+		tls     bool
+		wantErr bool
+	}{
+		{addr: "eth.f2pool.com:6688", scheme: SchemeTCP, host: "eth.f2pool.com:6688"},
+		{addr: "stratum+tcp://eth.f2pool.com:6688", scheme: SchemeTCP, host: "eth.f2pool.com:6688"},
+		{addr: "stratum+ssl://eth.f2pool.com:6688", scheme: SchemeSSL, host: "eth.f2pool.com:6688", tls: true},
+		{addr: "STRATUM+TLS://eth.f2pool.com:6688?insecure=true", scheme: SchemeTLS, host: "eth.f2pool.com:6688", tls: true},
+		{addr: "stratum2+tcp://user@eth.f2pool.com:34254?insecure=true", scheme: "stratum2+tcp", host: "eth.f2pool.com:34254"},
+		{addr: "stratum2+tcp://user@eth.f2pool.com:34254/9bZBweHhn6px2Quf1hADVUTrWxX65vtRBweWHP66kfkKGFTQRHs", scheme: "stratum2+tcp", host: "eth.f2pool.com:34254"},
+		{addr: "stratum2+tcp://user@eth.f2pool.com:34254", wantErr: true},
+		{addr: "stratum2+tcp://user@eth.f2pool.com:34254/9bZBweHhn6px2Quf1hADVUTrWxX65vtRBweWHP66kfkKGFTQRHt", wantErr: true},
+		{addr: "eth.f2pool.com", wantErr: true},
+		{addr: "http://eth.f2pool.com:80", wantErr: true},
+		{addr: "stratum+ssl://eth.f2pool.com:6688?fingerprint=abcd", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := ParsePoolAddress(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePoolAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Scheme != tt.scheme || got.Host != tt.host || got.IsTLS() != tt.tls {
+				t.Errorf("ParsePoolAddress() = %+v", got)
+			}
+		})
+	}
+}
+
+func TestPoolAddress_Dial(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+	sum := sha256.Sum256(srv.Certificate().Raw)
+
+	tests := []struct {
+		name    string
+		addr    string
+		wantErr bool
+	}{
+		{name: "untrusted", addr: "stratum+ssl://" + host, wantErr: true},
+		{name: "insecure", addr: "stratum+ssl://" + host + "?insecure=true"},
+		{name: "fingerprint", addr: "stratum+ssl://" + host + "?fingerprint=" + hex.EncodeToString(sum[:])},
+		{name: "wrong fingerprint", addr: "stratum+ssl://" + host + "?fingerprint=" + strings.Repeat("00", 32), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := dialPool(tt.addr, "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dialPool() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, recorded := LastPoolError(tt.addr)
+			if recorded != tt.wantErr {
+				t.Errorf("LastPoolError() = %v, want %v", recorded, tt.wantErr)
+			}
+			if conn != nil {
+				_ = conn.Close()
+			}
+		})
+	}
+}
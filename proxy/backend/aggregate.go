@@ -0,0 +1,742 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"miner-proxy/pkg"
+	"miner-proxy/pkg/cache"
+	"miner-proxy/proxy/stratum"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+	"go.uber.org/atomic"
+)
+
+const (
+	methodSubmit         = "mining.submit"
+	methodNotify         = "mining.notify"
+	methodSetDifficulty  = "mining.set_difficulty"
+	methodSetVersionMask = "mining.set_version_mask"
+	// sessionQueueSize 每个矿机待发送消息的队列长度, 队列满了之后丢弃消息, 避免一个矿机阻塞整个上游连接
+	sessionQueueSize = 128
+)
+
+var (
+	aggregators = &aggregator{upstreams: make(map[string][]*upstream), dialing: make(map[string]chan struct{})}
+	// accountTTL 记住矿机授权使用的账户的时间, 矿机订阅之后等待响应时先加入该账户的上游连接
+	accountTTL = time.Hour * 24
+	// authorizeWait 矿机订阅之后等待授权的时间, 超时之后按照记住的账户回复订阅
+	authorizeWait = time.Second * 2
+)
+
+// aggregator 按照 矿池地址+账户 管理共享的上游矿池连接
+type aggregator struct {
+	m         sync.Mutex
+	upstreams map[string][]*upstream
+	// dialing 正在建立的上游连接, 同一个 key 同时只建立一个, 其他会话等待之后加入
+	dialing map[string]chan struct{}
+}
+
+// acquire 找到一个还有空位的上游连接, 没有的话新建一个, 连接矿池时不持有锁
+func (a *aggregator) acquire(s *AggregatedConn) (*upstream, string, error) {
+	key := s.addr + "|" + s.account
+	for {
+		a.m.Lock()
+		for _, up := range a.upstreams[key] {
+			if prefix, ok := up.join(s); ok {
+				a.m.Unlock()
+				return up, prefix, nil
+			}
+		}
+		if wait, ok := a.dialing[key]; ok {
+			a.m.Unlock()
+			<-wait
+			continue
+		}
+		done := make(chan struct{})
+		a.dialing[key] = done
+		a.m.Unlock()
+
+		up, err := newUpstream(s.addr, key, s.maxSession)
+		a.m.Lock()
+		delete(a.dialing, key)
+		close(done)
+		if err != nil {
+			a.m.Unlock()
+			return nil, "", err
+		}
+		prefix, ok := up.join(s)
+		if ok {
+			a.upstreams[key] = append(a.upstreams[key], up)
+		}
+		a.m.Unlock()
+		if !ok {
+			up.close()
+			return nil, "", errors.Errorf("mine pool %s extranonce space is full", s.addr)
+		}
+		return up, prefix, nil
+	}
+}
+
+func (a *aggregator) remove(up *upstream) {
+	a.m.Lock()
+	defer a.m.Unlock()
+	var result []*upstream
+	for _, v := range a.upstreams[up.key] {
+		if v != up {
+			result = append(result, v)
+		}
+	}
+	if len(result) == 0 {
+		delete(a.upstreams, up.key)
+		return
+	}
+	a.upstreams[up.key] = result
+}
+
+// worker 在上游连接上授权过的矿工
+type worker struct {
+	params json.RawMessage
+	result json.RawMessage
+}
+
+type route struct {
+	session *AggregatedConn
+	id      json.RawMessage
+	method  string
+	worker  string
+	params  json.RawMessage
+}
+
+// upstream 多个矿机共享的一个矿池连接, 矿池分配的 extranonce2 按照前缀切分给每一个矿机
+type upstream struct {
+	m               sync.Mutex
+	writeM          sync.Mutex
+	key, addr       string
+	conn            net.Conn
+	reader          *bufio.Reader
+	maxSession      int
+	extranonce1     string
+	extranonce2Size int
+	// prefixSize 分配给每个矿机的 extranonce2 前缀字节数
+	prefixSize int
+	sessions   map[string]*AggregatedConn
+	routes     map[string]route
+	workers    map[string]*worker
+	// 最后一次收到的难度/任务, 新加入的矿机授权之后立即下发
+	difficulty, notify, versionMask []byte
+	id                              *atomic.Int64
+	closed                          *atomic.Bool
+}
+
+func newUpstream(addr, key string, maxSession int) (*upstream, error) {
+	up := &upstream{
+		key:        key,
+		addr:       addr,
+		maxSession: maxSession,
+		prefixSize: 1,
+		sessions:   make(map[string]*AggregatedConn),
+		routes:     make(map[string]route),
+		workers:    make(map[string]*worker),
+		id:         atomic.NewInt64(0),
+		closed:     atomic.NewBool(false),
+	}
+	if maxSession > 256 {
+		up.prefixSize = 2
+	}
+	if err := up.connect(); err != nil {
+		return nil, err
+	}
+	go up.readLoop()
+	return up, nil
+}
+
+// connect 连接矿池并且订阅, 订阅成功之后重新授权已经授权过的矿工
+func (up *upstream) connect() error {
+	conn, err := dialPool(up.addr, up.key)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	subscribe := stratum.NewNotify(methodSubscribe, "miner-proxy")
+	subscribe.Id = json.RawMessage(fmt.Sprintf("%d", up.id.Inc()))
+	if _, err := conn.Write(subscribe.Encode()); err != nil {
+		_ = conn.Close()
+		return errors.Wrapf(err, "subscribe mine pool %s error", up.addr)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(replayTimeout))
+	var extranonce1 string
+	var extranonce2Size int
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			_ = conn.Close()
+			return errors.Wrapf(err, "read subscribe response from %s error", up.addr)
+		}
+		msg, err := stratum.Decode(line)
+		if err != nil || !msg.IsResponse() || msg.IdKey() != subscribe.IdKey() {
+			continue
+		}
+		if msg.HasError() {
+			_ = conn.Close()
+			return errors.Errorf("mine pool %s refused subscribe: %s", up.addr, msg.Error)
+		}
+		if extranonce1, extranonce2Size, err = parseExtranonce(msg.Result, 1); err != nil {
+			_ = conn.Close()
+			return errors.Wrapf(err, "parse subscribe response from %s error", up.addr)
+		}
+		break
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if extranonce2Size-up.prefixSize < 2 {
+		_ = conn.Close()
+		return errors.Errorf("mine pool %s extranonce2 size %d is too small to split", up.addr, extranonce2Size)
+	}
+
+	up.m.Lock()
+	changed := up.extranonce1 != "" && (up.extranonce1 != extranonce1 || up.extranonce2Size != extranonce2Size)
+	up.conn, up.reader = conn, reader
+	up.extranonce1, up.extranonce2Size = extranonce1, extranonce2Size
+	routes := up.routes
+	up.routes = make(map[string]route)
+	var workers = make(map[string]json.RawMessage)
+	for name, w := range up.workers {
+		workers[name] = w.params
+		w.result = nil
+	}
+	up.m.Unlock()
+
+	// 断开之前还没有响应的请求不会再有响应, 回复矿机错误
+	for _, r := range routes {
+		if r.session != nil {
+			r.session.reply(r.id, nil, json.RawMessage(`[20,"mine pool reconnected",null]`))
+		}
+	}
+
+	for name, params := range workers {
+		up.write(route{method: methodAuthorize, worker: name, params: params}, stratum.Message{Method: methodAuthorize, Params: params})
+	}
+	if changed {
+		up.extranonceChanged()
+	}
+	return nil
+}
+
+// join 为矿机分配 extranonce2 前缀
+func (up *upstream) join(s *AggregatedConn) (string, bool) {
+	up.m.Lock()
+	defer up.m.Unlock()
+	if up.closed.Load() {
+		return "", false
+	}
+	max := 1 << (8 * uint(up.prefixSize))
+	if up.maxSession < max {
+		max = up.maxSession
+	}
+	for i := 0; i < max; i++ {
+		prefix := fmt.Sprintf("%0*x", up.prefixSize*2, i)
+		if _, ok := up.sessions[prefix]; ok {
+			continue
+		}
+		up.sessions[prefix] = s
+		return prefix, true
+	}
+	return "", false
+}
+
+// leave 矿机断开, 没有矿机之后关闭上游连接
+func (up *upstream) leave(prefix string) {
+	up.m.Lock()
+	delete(up.sessions, prefix)
+	empty := len(up.sessions) == 0
+	up.m.Unlock()
+	if empty {
+		up.close()
+	}
+}
+
+func (up *upstream) close() {
+	if up.closed.Swap(true) {
+		return
+	}
+	aggregators.remove(up)
+	up.m.Lock()
+	defer up.m.Unlock()
+	if up.conn != nil {
+		_ = up.conn.Close()
+	}
+	for _, s := range up.sessions {
+		go s.Close()
+	}
+}
+
+// extranonce 返回分配给矿机的 extranonce1 与 extranonce2 的长度
+func (up *upstream) extranonce(prefix string) (string, int) {
+	up.m.Lock()
+	defer up.m.Unlock()
+	return up.extranonce1 + prefix, up.extranonce2Size - up.prefixSize
+}
+
+// write 改写 id 之后发送到矿池, 响应通过 route 返回给对应的矿机
+func (up *upstream) write(r route, msg stratum.Message) {
+	id := fmt.Sprintf("%d", up.id.Inc())
+	msg.Id = json.RawMessage(id)
+	up.m.Lock()
+	up.routes[id] = r
+	conn := up.conn
+	up.m.Unlock()
+
+	up.writeM.Lock()
+	defer up.writeM.Unlock()
+	if _, err := conn.Write(msg.Encode()); err != nil {
+		pkg.Debug("write data to miner pool %s error: %s", up.addr, err)
+		_ = conn.Close() // 让读取协程发现连接断开并且重连
+	}
+}
+
+func (up *upstream) authorize(s *AggregatedConn, msg stratum.Message) {
+	var params []json.RawMessage
+	var name string
+	if err := json.Unmarshal(msg.Params, &params); err == nil && len(params) != 0 {
+		_ = json.Unmarshal(params[0], &name)
+	}
+	if name == "" {
+		s.reply(msg.Id, nil, json.RawMessage(`[20,"invalid params",null]`))
+		return
+	}
+	up.m.Lock()
+	w, ok := up.workers[name]
+	var result json.RawMessage
+	if ok {
+		result = w.result
+	}
+	up.m.Unlock()
+	if result != nil {
+		s.reply(msg.Id, result, nil)
+		s.prime()
+		return
+	}
+	up.write(route{session: s, id: msg.Id, method: methodAuthorize, worker: name, params: msg.Params}, msg)
+}
+
+// submit 将矿机的 extranonce2 加上前缀之后提交到矿池
+func (up *upstream) submit(s *AggregatedConn, msg stratum.Message) {
+	var params []json.RawMessage
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) < 3 {
+		s.reply(msg.Id, nil, json.RawMessage(`[20,"invalid params",null]`))
+		return
+	}
+	var extranonce2 string
+	_ = json.Unmarshal(params[2], &extranonce2)
+	params[2], _ = json.Marshal(s.prefix + extranonce2)
+	msg.Params, _ = json.Marshal(params)
+	up.write(route{session: s, id: msg.Id, method: methodSubmit}, msg)
+}
+
+func (up *upstream) broadcast(line []byte) {
+	up.m.Lock()
+	defer up.m.Unlock()
+	for _, s := range up.sessions {
+		s.send(line)
+	}
+}
+
+// extranonceChanged 矿池的 extranonce 发生了变化, 支持 extranonce 订阅的矿机直接下发, 其他的矿机要求重新连接
+func (up *upstream) extranonceChanged() {
+	up.m.Lock()
+	defer up.m.Unlock()
+	for prefix, s := range up.sessions {
+		if s.extranonceSubscribed.Load() {
+			s.send(stratum.NewNotify(methodSetExtranonce, up.extranonce1+prefix, up.extranonce2Size-up.prefixSize).Encode())
+			continue
+		}
+		s.send(stratum.NewNotify(methodClientReconnect).Encode())
+	}
+}
+
+func (up *upstream) handle(line []byte) {
+	msg, err := stratum.Decode(line)
+	if err != nil {
+		return
+	}
+	if msg.IsResponse() {
+		up.m.Lock()
+		r, ok := up.routes[msg.IdKey()]
+		delete(up.routes, msg.IdKey())
+		if ok && r.method == methodAuthorize {
+			if msg.HasError() {
+				delete(up.workers, r.worker)
+			} else {
+				up.workers[r.worker] = &worker{params: r.params, result: msg.Result}
+			}
+		}
+		up.m.Unlock()
+		if ok && r.method == methodSubmit {
+			healthOf(up.addr).share(!isRejected(msg.Result, msg.Error))
+		}
+		if ok && msg.HasError() {
+			category, _ := classifyError(msg.Error)
+			healthOf(up.addr).poolError(category)
+		}
+		if !ok || r.session == nil {
+			return
+		}
+		r.session.reply(r.id, msg.Result, msg.Error)
+		if r.method == methodAuthorize && !msg.HasError() {
+			r.session.prime()
+		}
+		return
+	}
+
+	switch msg.Method {
+	case methodNotify:
+		up.m.Lock()
+		up.notify = line
+		up.m.Unlock()
+	case methodSetDifficulty:
+		up.m.Lock()
+		up.difficulty = line
+		up.m.Unlock()
+	case methodSetVersionMask:
+		up.m.Lock()
+		up.versionMask = line
+		up.m.Unlock()
+	case methodSetExtranonce:
+		extranonce1, extranonce2Size, err := parseExtranonce(msg.Params, 0)
+		if err != nil {
+			return
+		}
+		up.m.Lock()
+		up.extranonce1, up.extranonce2Size = extranonce1, extranonce2Size
+		up.m.Unlock()
+		up.extranonceChanged()
+		return
+	}
+	up.broadcast(line)
+}
+
+func (up *upstream) readLoop() {
+	defer up.close()
+	for !up.closed.Load() {
+		up.m.Lock()
+		conn, reader := up.conn, up.reader
+		up.m.Unlock()
+		line, err := reader.ReadBytes('\n')
+		if err == nil {
+			up.handle(line)
+			continue
+		}
+		if up.closed.Load() {
+			return
+		}
+		healthOf(up.addr).disconnected(err)
+		pkg.Warn("read data from aggregated miner pool %s error %s, reconnecting", up.addr, err)
+		_ = conn.Close()
+		if err := pkg.Try(func() bool {
+			if up.closed.Load() {
+				return true
+			}
+			if err := up.connect(); err != nil {
+				pkg.Warn("reconnect aggregated mine pool error: %s", err)
+				time.Sleep(time.Second)
+				return false
+			}
+			return true
+		}, reconnectTimes); err != nil {
+			return
+		}
+	}
+}
+
+// AggregatedConn 聚合模式下一个矿机的会话, 与其他矿机共享上游的矿池连接
+type AggregatedConn struct {
+	stop               sync.Once
+	m                  sync.Mutex
+	addr, clientId, ip string
+	// account 加入的上游连接所属的账户, 授权之前为空
+	account              string
+	maxSession           int
+	up                   *upstream
+	prefix               string
+	input                <-chan []byte
+	output               chan<- []byte
+	queue                chan []byte
+	closed               *atomic.Bool
+	primed               *atomic.Bool
+	extranonceSubscribed *atomic.Bool
+	splitter             stratum.Splitter
+	// pending 加入上游连接之前矿机发送的请求, wait 等待授权超时, subscribed 已经回复过订阅
+	pending    []stratum.Message
+	wait       <-chan time.Time
+	subscribed bool
+}
+
+// NewAggregatedConn 聚合模式下连接矿池, 使用同一个矿池账户的矿机共享上游连接
+// 矿机授权之后按照矿工名中的账户加入上游连接, 授权之前不向矿池发送矿机的任何请求;
+// 矿机订阅之后等待响应而没有授权时, 先按照上一次授权的账户回复订阅, 授权的账户不同时再切换
+// 每一个上游连接最多承载 maxSession 个矿机
+func NewAggregatedConn(addr, clientId, minerIp string, maxSession int, input <-chan []byte, output chan<- []byte) (*AggregatedConn, error) {
+	if input == nil || output == nil {
+		return nil, errors.New("input or output not make")
+	}
+	if maxSession <= 0 {
+		return nil, errors.New("max session must be greater than 0")
+	}
+	return &AggregatedConn{
+		addr:                 addr,
+		clientId:             clientId,
+		ip:                   minerIp,
+		maxSession:           maxSession,
+		input:                input,
+		output:               output,
+		queue:                make(chan []byte, sessionQueueSize),
+		closed:               atomic.NewBool(false),
+		primed:               atomic.NewBool(false),
+		extranonceSubscribed: atomic.NewBool(false),
+	}, nil
+}
+
+func (s *AggregatedConn) accountKey() string {
+	return "aggregate-account:" + s.clientId + "|" + s.ip
+}
+
+// authorizeAccount 返回矿工名中的账户, 矿工名为 账户.矿工 的格式
+func authorizeAccount(msg stratum.Message) string {
+	var params []interface{}
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) == 0 {
+		return ""
+	}
+	return strings.SplitN(cast.ToString(params[0]), ".", 2)[0]
+}
+
+// provisionalAccount 矿机没有授权就需要订阅的响应时使用的账户, 没有记住的账户时使用客户端id
+func (s *AggregatedConn) provisionalAccount() string {
+	if v, ok := cache.Client.Get(s.accountKey()); ok {
+		return v.(string)
+	}
+	return s.clientId
+}
+
+// bind 加入账户的上游连接, 已经按照其他账户回复过订阅时,
+// 支持 extranonce 订阅的矿机下发新的 extranonce, 其他的矿机要求重新连接; 返回 false 时会话已经关闭
+func (s *AggregatedConn) bind(account string) bool {
+	if s.up != nil && s.account == account {
+		return true
+	}
+	old, oldPrefix := s.up, s.prefix
+	s.account = account
+	up, prefix, err := aggregators.acquire(s)
+	if err != nil {
+		pkg.Warn("aggregated session join mine pool %s error: %s", s.addr, err)
+		s.Close()
+		return false
+	}
+	s.m.Lock()
+	closed := s.closed.Load()
+	if !closed {
+		s.up, s.prefix = up, prefix
+	}
+	s.m.Unlock()
+	if closed {
+		up.leave(prefix)
+		return false
+	}
+	if old == nil {
+		return true
+	}
+	old.leave(oldPrefix)
+	s.primed.Store(false)
+	if !s.subscribed {
+		return true
+	}
+	if s.extranonceSubscribed.Load() {
+		extranonce1, extranonce2Size := up.extranonce(prefix)
+		s.send(stratum.NewNotify(methodSetExtranonce, extranonce1, extranonce2Size).Encode())
+		return true
+	}
+	s.send(stratum.NewNotify(methodClientReconnect).Encode())
+	s.Close()
+	return false
+}
+
+// flush 加入上游连接之后处理之前暂存的请求
+func (s *AggregatedConn) flush() {
+	pending := s.pending
+	s.pending, s.wait = nil, nil
+	for _, msg := range pending {
+		s.dispatch(msg)
+	}
+}
+
+func (s *AggregatedConn) Address() string {
+	return s.addr
+}
+
+// Dialects 聚合模式只支持 stratum v1
+func (s *AggregatedConn) Dialects() (stratum.Dialect, stratum.Dialect) {
+	return stratum.DialectStratum, stratum.DialectStratum
+}
+
+// Difficulty 聚合模式下同一个上游连接的矿机使用同一个难度
+func (s *AggregatedConn) Difficulty() float64 {
+	s.m.Lock()
+	up := s.up
+	s.m.Unlock()
+	if up == nil {
+		return 0
+	}
+	up.m.Lock()
+	line := up.difficulty
+	up.m.Unlock()
+	msg, err := stratum.Decode(line)
+	if err != nil {
+		return 0
+	}
+	d, _ := parseDifficulty(msg.Params)
+	return d
+}
+
+func (s *AggregatedConn) IsClosed() bool {
+	return s.closed.Load()
+}
+
+func (s *AggregatedConn) Close() {
+	s.stop.Do(func() {
+		s.m.Lock()
+		s.closed.Store(true)
+		close(s.queue)
+		up, prefix := s.up, s.prefix
+		s.m.Unlock()
+		if up != nil {
+			up.leave(prefix)
+		}
+	})
+}
+
+// send 将数据放入发送队列, 不会阻塞上游连接
+func (s *AggregatedConn) send(line []byte) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed.Load() {
+		return
+	}
+	select {
+	case s.queue <- line:
+	default:
+		pkg.Warn("aggregated session %s queue is full, drop message", s.prefix)
+	}
+}
+
+func (s *AggregatedConn) reply(id, result, e json.RawMessage) {
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	if len(e) == 0 {
+		e = json.RawMessage("null")
+	}
+	s.send(stratum.Message{Id: id, Result: result, Error: e}.Encode())
+}
+
+// prime 矿机第一次授权成功之后下发最新的难度与任务
+func (s *AggregatedConn) prime() {
+	if s.primed.Swap(true) {
+		return
+	}
+	s.m.Lock()
+	up := s.up
+	s.m.Unlock()
+	up.m.Lock()
+	lines := [][]byte{up.versionMask, up.difficulty, up.notify}
+	up.m.Unlock()
+	for _, line := range lines {
+		if len(line) != 0 {
+			s.send(line)
+		}
+	}
+}
+
+func (s *AggregatedConn) handle(line []byte) {
+	msg, err := stratum.Decode(line)
+	if err != nil {
+		pkg.Debug("aggregated session receive invalid data: %s", strings.TrimSpace(string(line)))
+		return
+	}
+	switch msg.Method {
+	case methodExtranonceSubscribe:
+		s.extranonceSubscribed.Store(true)
+		s.reply(msg.Id, json.RawMessage("true"), nil)
+		return
+	case "": // 矿机对矿池请求的响应, 上游连接是共享的, 无法转发
+		return
+	case methodAuthorize:
+		account := authorizeAccount(msg)
+		if account == "" {
+			s.reply(msg.Id, nil, json.RawMessage(`[20,"invalid params",null]`))
+			return
+		}
+		cache.Client.Set(s.accountKey(), account, accountTTL)
+		if !s.bind(account) {
+			return
+		}
+		s.flush()
+		s.up.authorize(s, msg)
+		return
+	}
+	if s.up == nil { // 授权之前不知道矿机的账户, 暂存请求
+		s.pending = append(s.pending, msg)
+		if s.wait == nil {
+			s.wait = time.After(authorizeWait)
+		}
+		return
+	}
+	s.dispatch(msg)
+}
+
+// dispatch 处理已经加入上游连接的矿机的请求
+func (s *AggregatedConn) dispatch(msg stratum.Message) {
+	switch msg.Method {
+	case methodSubscribe:
+		extranonce1, extranonce2Size := s.up.extranonce(s.prefix)
+		result, _ := json.Marshal([]interface{}{
+			[][]string{{methodSetDifficulty, s.prefix}, {methodNotify, s.prefix}},
+			extranonce1, extranonce2Size,
+		})
+		s.subscribed = true
+		s.reply(msg.Id, result, nil)
+	case methodSubmit:
+		s.up.submit(s, msg)
+	default:
+		s.up.write(route{session: s, id: msg.Id, method: msg.Method}, msg)
+	}
+}
+
+func (s *AggregatedConn) Start() {
+	defer s.Close()
+	go func() {
+		defer close(s.output)
+		for line := range s.queue {
+			s.output <- line
+		}
+	}()
+
+	for !s.IsClosed() {
+		select {
+		case data, isOpen := <-s.input:
+			if !isOpen {
+				return
+			}
+			for _, line := range s.splitter.Feed(data) {
+				s.handle(line)
+			}
+		case <-s.wait: // 矿机在等待订阅的响应, 先按照记住的账户加入上游连接
+			if s.bind(s.provisionalAccount()) {
+				s.flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"miner-proxy/pkg/cache"
+	"miner-proxy/proxy/stratum"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func readMessage(t *testing.T, output <-chan []byte) stratum.Message {
+	select {
+	case line := <-output:
+		msg, err := stratum.Decode(line)
+		if err != nil {
+			t.Fatalf("decode %s error: %v", line, err)
+		}
+		return msg
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait message timeout")
+	}
+	return stratum.Message{}
+}
+
+func TestAggregatedConn(t *testing.T) {
+	defer func(wait time.Duration) { authorizeWait = wait }(authorizeWait)
+	authorizeWait = time.Millisecond * 100
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	submits := make(chan []json.RawMessage, 2)
+	upstreams := atomic.NewInt64(0)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstreams.Inc()
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					msg, _ := stratum.Decode(line)
+					result := "true"
+					switch msg.Method {
+					case methodSubscribe:
+						result = `[[["mining.notify","1"]],"aabb",4]`
+					case methodSubmit:
+						var params []json.RawMessage
+						_ = json.Unmarshal(msg.Params, &params)
+						if string(params[0]) == `"drop.w"` { // 断开连接, 不响应这个份额
+							return
+						}
+						submits <- params
+					}
+					_, _ = conn.Write([]byte(`{"id":` + msg.IdKey() + `,"result":` + result + `,"error":null}` + "\n"))
+				}
+			}(conn)
+		}
+	}()
+	connect := func(ip string) (*AggregatedConn, chan []byte, chan []byte) {
+		input, output := make(chan []byte, 10), make(chan []byte, 10)
+		s, err := NewAggregatedConn(l.Addr().String(), "client", ip, 10, input, output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Start()
+		return s, input, output
+	}
+
+	// 同一个账户的矿机共享上游连接, 授权之前不连接矿池
+	var extranonces = make(map[string]struct{})
+	for i, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		s, input, output := connect(ip)
+		defer s.Close()
+
+		input <- []byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n")
+		time.Sleep(authorizeWait / 2)
+		if n := upstreams.Load(); n != int64(i) {
+			t.Fatalf("upstream connections before authorize = %d, want %d", n, i)
+		}
+		input <- []byte(`{"id":2,"method":"mining.authorize","params":["account.w` + strconv.Itoa(i) + `","x"]}` + "\n")
+		msg := readMessage(t, output)
+		extranonce1, size, err := parseExtranonce(msg.Result, 1)
+		if err != nil || size != 3 || len(extranonce1) != 6 {
+			t.Fatalf("subscribe result = %s, %v", msg.Result, err)
+		}
+		extranonces[extranonce1] = struct{}{}
+		if msg = readMessage(t, output); msg.IdKey() != "2" || msg.HasError() {
+			t.Fatalf("authorize response = %+v", msg)
+		}
+
+		input <- []byte(`{"id":3,"method":"mining.submit","params":["account.w` + strconv.Itoa(i) + `","job","000001","ntime","nonce"]}` + "\n")
+		if msg = readMessage(t, output); msg.IdKey() != "3" || string(msg.Result) != "true" {
+			t.Fatalf("submit response = %+v", msg)
+		}
+		params := <-submits
+		var extranonce2 string
+		_ = json.Unmarshal(params[2], &extranonce2)
+		if want := extranonce1[4:] + "000001"; extranonce2 != want {
+			t.Errorf("submit extranonce2 = %s, want %s", extranonce2, want)
+		}
+	}
+	if len(extranonces) != 2 {
+		t.Errorf("extranonce1 must be unique, got %v", extranonces)
+	}
+	if n := upstreams.Load(); n != 1 {
+		t.Errorf("upstream connections = %d, want 1", n)
+	}
+
+	// 同一个ip下使用其他账户的矿机使用自己的上游连接
+	s, input, output := connect("10.0.0.1")
+	input <- []byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n" +
+		`{"id":2,"method":"mining.authorize","params":["drop.w","x"]}` + "\n")
+	readMessage(t, output)
+	if msg := readMessage(t, output); msg.IdKey() != "2" || msg.HasError() {
+		t.Fatalf("authorize response = %+v", msg)
+	}
+	if n := upstreams.Load(); n != 2 {
+		t.Errorf("upstream connections = %d, want 2", n)
+	}
+	// 上游连接断开时还没有响应的份额回复错误
+	input <- []byte(`{"id":3,"method":"mining.submit","params":["drop.w","job","000001","ntime","nonce"]}` + "\n")
+	if msg := readMessage(t, output); msg.IdKey() != "3" || !msg.HasError() {
+		t.Fatalf("submit response after reconnect = %+v, want error", msg)
+	}
+	s.Close()
+
+	// 矿机等待订阅的响应时先按照记住的账户回复, 授权的账户不同时要求矿机重新连接
+	s, input, output = connect("10.0.0.1")
+	defer s.Close()
+	input <- []byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n")
+	if msg := readMessage(t, output); msg.IdKey() != "1" || s.account != "drop" {
+		t.Fatalf("subscribe response = %+v, account = %s", msg, s.account)
+	}
+	input <- []byte(`{"id":2,"method":"mining.authorize","params":["account.w3","x"]}` + "\n")
+	if msg := readMessage(t, output); msg.Method != methodClientReconnect {
+		t.Fatalf("message after authorize = %+v, want %s", msg, methodClientReconnect)
+	}
+	if v, _ := cache.Client.Get("aggregate-account:client|10.0.0.1"); v != "account" {
+		t.Errorf("remembered account = %v, want account", v)
+	}
+}
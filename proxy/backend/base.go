@@ -1 +1,21 @@
 package backend
+
+import "miner-proxy/proxy/stratum"
+
+// Pool 矿机到矿池的会话, input 为矿机发往矿池的数据, output 为矿池发往矿机的数据
+type Pool interface {
+	Start()
+	Close()
+	IsClosed() bool
+	Address() string
+	// Dialects 矿机与矿池使用的 stratum 方言
+	Dialects() (miner, pool stratum.Dialect)
+	// Difficulty 矿池最后一次下发给矿机的难度, 未知时为0
+	Difficulty() float64
+}
+
+// Switcher 可以在不断开矿机的情况下切换矿池的会话
+type Switcher interface {
+	// Switch 切换到新的矿池, 重连之后重放握手
+	Switch(addr string, backups []string)
+}
@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"encoding/json"
+	"miner-proxy/pkg/cache"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+const (
+	// ErrorAuth 授权失败, 例如矿工名或者钱包地址错误
+	ErrorAuth = "auth"
+	// ErrorBan 被矿池封禁
+	ErrorBan = "ban"
+	// ErrorStale 任务已经过期
+	ErrorStale = "stale"
+	// ErrorLowDifficulty 份额难度不足
+	ErrorLowDifficulty = "low_difficulty"
+	// ErrorDuplicate 重复的份额
+	ErrorDuplicate = "duplicate"
+	// ErrorOther 其他错误
+	ErrorOther = "other"
+
+	// authAlertThreshold 同一个客户端的矿工连续授权失败多少次之后告警, 矿机授权失败之后会重新连接, 按照多个会话统计
+	authAlertThreshold = 3
+)
+
+// authFailureTTL 超过该时间没有再次授权失败时重新计算
+var authFailureTTL = time.Hour
+
+// errorKeywords 按照顺序匹配矿池错误信息中的关键字
+var errorKeywords = []struct {
+	category string
+	keywords []string
+}{
+	{ErrorBan, []string{"banned", "ban ", "blocked", "blacklist"}},
+	{ErrorDuplicate, []string{"duplicate"}},
+	{ErrorStale, []string{"job not found", "stale", "expired", "unknown job"}},
+	{ErrorLowDifficulty, []string{"low difficulty", "low diff", "above target", "difficulty too low"}},
+	{ErrorAuth, []string{"unauthorized", "not authorized", "invalid address", "invalid wallet",
+		"invalid user", "invalid worker", "invalid login", "authorization", "not subscribed"}},
+}
+
+// errorCodes stratum v1 约定的错误码
+var errorCodes = map[int]string{
+	21: ErrorStale,
+	22: ErrorDuplicate,
+	23: ErrorLowDifficulty,
+	24: ErrorAuth,
+	25: ErrorAuth,
+}
+
+// Alert 矿机触发的告警, 连续授权失败或者被矿池封禁
+type Alert struct {
+	Pool     string
+	Category string
+	Message  string
+	Count    int
+}
+
+// PoolErrorReporter 统计矿池错误的矿池连接
+type PoolErrorReporter interface {
+	// PoolErrors 错误分类 -> 次数
+	PoolErrors() map[string]int64
+	// OnAlert 需要在 Start 之前调用
+	OnAlert(f func(a Alert))
+}
+
+// errorMessage 解析 [code, message, data], {"code": code, "message": message} 或者字符串形式的错误
+func errorMessage(e json.RawMessage) (int, string) {
+	var arr []interface{}
+	if err := json.Unmarshal(e, &arr); err == nil {
+		if len(arr) >= 2 {
+			return cast.ToInt(arr[0]), cast.ToString(arr[1])
+		}
+		return 0, string(e)
+	}
+	var obj struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(e, &obj); err == nil && obj.Message != "" {
+		return obj.Code, obj.Message
+	}
+	var text string
+	if err := json.Unmarshal(e, &text); err == nil {
+		return 0, text
+	}
+	return 0, string(e)
+}
+
+// classifyError 将矿池的错误归类, 优先使用错误信息, 其次使用错误码
+func classifyError(e json.RawMessage) (string, string) {
+	code, message := errorMessage(e)
+	lower := strings.ToLower(message)
+	for _, v := range errorKeywords {
+		for _, keyword := range v.keywords {
+			if strings.Contains(lower, keyword) {
+				return v.category, message
+			}
+		}
+	}
+	if category, ok := errorCodes[code]; ok {
+		return category, message
+	}
+	return ErrorOther, message
+}
+
+// errorStats 一个矿机会话的矿池错误统计, 连续授权失败按照 客户端+矿工 在多个会话之间统计
+type errorStats struct {
+	m        sync.Mutex
+	addr     func() string
+	clientId string
+	counts   map[string]int64
+	alerted  map[string]bool
+	onAlert  func(a Alert)
+}
+
+func newErrorStats(addr func() string, clientId string) *errorStats {
+	return &errorStats{addr: addr, clientId: clientId, counts: make(map[string]int64), alerted: make(map[string]bool)}
+}
+
+func (s *errorStats) authKey(worker string) string {
+	return "auth-failures:" + s.clientId + "|" + worker
+}
+
+// authFailed 返回矿工连续授权失败的次数
+func (s *errorStats) authFailed(worker string) int {
+	key := s.authKey(worker)
+	if err := cache.Client.Add(key, 1, authFailureTTL); err == nil {
+		return 1
+	}
+	n, err := cache.Client.IncrementInt(key, 1)
+	if err != nil { // 刚好过期
+		cache.Client.Set(key, 1, authFailureTTL)
+		return 1
+	}
+	return n
+}
+
+// record 记录一次矿池错误, 授权请求的错误总是归类为授权失败, 除非是被封禁, worker 为授权失败的矿工名
+func (s *errorStats) record(authorize bool, worker string, e json.RawMessage) {
+	category, message := ErrorAuth, "authorize rejected"
+	if len(e) != 0 && string(e) != "null" {
+		category, message = classifyError(e)
+		if authorize && category != ErrorBan {
+			category = ErrorAuth
+		}
+	}
+	addr := s.addr()
+	healthOf(addr).poolError(category)
+
+	s.m.Lock()
+	s.counts[category]++
+	var alert *Alert
+	switch category {
+	case ErrorAuth:
+		// 只在达到阈值时告警一次, 授权成功之后重新计算
+		if n := s.authFailed(worker); n == authAlertThreshold {
+			alert = &Alert{Pool: addr, Category: category, Message: message, Count: n}
+		}
+	case ErrorBan:
+		if !s.alerted[category] {
+			alert = &Alert{Pool: addr, Category: category, Message: message, Count: int(s.counts[category])}
+			s.alerted[category] = true
+		}
+	}
+	onAlert := s.onAlert
+	s.m.Unlock()
+	if alert != nil && onAlert != nil {
+		onAlert(*alert)
+	}
+}
+
+// authorized 授权成功之后重新计算矿工的连续授权失败
+func (s *errorStats) authorized(worker string) {
+	cache.Client.Delete(s.authKey(worker))
+}
+
+func (s *errorStats) snapshot() map[string]int64 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	result := make(map[string]int64, len(s.counts))
+	for k, v := range s.counts {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		e    string
+		want string
+	}{
+		{`[24,"Unauthorized worker",null]`, ErrorAuth},
+		{`[20,"Invalid address",null]`, ErrorAuth},
+		{`[20,"IP banned",null]`, ErrorBan},
+		{`[21,"Job not found",null]`, ErrorStale},
+		{`[22,"Duplicate share",null]`, ErrorDuplicate},
+		{`[23,"Low difficulty share",null]`, ErrorLowDifficulty},
+		{`[23,"",null]`, ErrorLowDifficulty},
+		{`{"code":-1,"message":"Stale share"}`, ErrorStale},
+		{`"worker is blocked"`, ErrorBan},
+		{`[20,"Other/Unknown",null]`, ErrorOther},
+	}
+	for _, tt := range tests {
+		if got, _ := classifyError(json.RawMessage(tt.e)); got != tt.want {
+			t.Errorf("classifyError(%s) = %s, want %s", tt.e, got, tt.want)
+		}
+	}
+}
+
+func TestErrorStats_alert(t *testing.T) {
+	var alerts []Alert
+	session := func() *errorStats {
+		s := newErrorStats(func() string { return "classify.pool.com:3333" }, "classify-client")
+		s.onAlert = func(a Alert) {
+			alerts = append(alerts, a)
+		}
+		return s
+	}
+	s := session()
+	unauthorized := json.RawMessage(`[24,"Unauthorized worker",null]`)
+	for i := 0; i < authAlertThreshold-1; i++ {
+		s.record(true, "w1", unauthorized)
+	}
+	s.authorized("w1")
+	// 矿机授权失败之后重新连接, 每个会话只失败一次
+	for i := 0; i < authAlertThreshold+2; i++ {
+		s = session()
+		s.record(true, "w1", unauthorized)
+		s.record(true, "w2", unauthorized)
+	}
+	if len(alerts) != 2 || alerts[0].Category != ErrorAuth || alerts[0].Count != authAlertThreshold {
+		t.Fatalf("auth alerts = %+v", alerts)
+	}
+
+	s.record(false, "w1", json.RawMessage(`[21,"Job not found",null]`))
+	s.record(false, "w1", json.RawMessage(`[20,"banned",null]`))
+	s.record(true, "w1", json.RawMessage(`[20,"banned",null]`))
+	if len(alerts) != 3 || alerts[2].Category != ErrorBan {
+		t.Fatalf("ban alerts = %+v", alerts)
+	}
+	counts := s.snapshot()
+	if counts[ErrorAuth] != 2 || counts[ErrorStale] != 1 || counts[ErrorBan] != 2 {
+		t.Fatalf("counts = %v", counts)
+	}
+	if got := healthOf("classify.pool.com:3333").status().Errors[ErrorBan]; got != 2 {
+		t.Fatalf("pool ban errors = %d, want 2", got)
+	}
+}
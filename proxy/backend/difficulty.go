@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"miner-proxy/proxy/stratum"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+const (
+	methodSuggestDifficulty = "mining.suggest_difficulty"
+	// DifficultySuggest 矿机授权之后发送 mining.suggest_difficulty
+	DifficultySuggest = "suggest"
+	// DifficultyPassword 在授权的密码中加入 d=难度, 用于不支持 suggest_difficulty 的矿池
+	DifficultyPassword = "password"
+)
+
+// DifficultyOverride 矿机授权时向矿池建议的难度
+type DifficultyOverride struct {
+	Difficulty float64
+	Mode       string
+}
+
+// DifficultyFunc 根据矿工名称返回需要建议的难度, 返回 false 时不做修改
+type DifficultyFunc func(worker string) (DifficultyOverride, bool)
+
+// DifficultyOverrider 支持建议难度的矿池连接
+type DifficultyOverrider interface {
+	// OverrideDifficulty 需要在 Start 之前调用
+	OverrideDifficulty(f DifficultyFunc)
+}
+
+// parseDifficulty 解析 mining.set_difficulty 的参数
+func parseDifficulty(params json.RawMessage) (float64, bool) {
+	var arr []interface{}
+	if err := json.Unmarshal(params, &arr); err != nil || len(arr) == 0 {
+		return 0, false
+	}
+	d, err := cast.ToFloat64E(arr[0])
+	return d, err == nil && d > 0
+}
+
+// passwordWithDifficulty 在密码中加入 d=难度, 密码为空或者x时直接替换
+func passwordWithDifficulty(password string, difficulty float64) string {
+	d := fmt.Sprintf("d=%v", difficulty)
+	var parts []string
+	for _, v := range strings.Split(password, ",") {
+		if v == "" || v == "x" || strings.HasPrefix(v, "d=") {
+			continue
+		}
+		parts = append(parts, v)
+	}
+	return strings.Join(append(parts, d), ",")
+}
+
+// overrideDifficulty 改写矿机的 mining.authorize, 返回改写之后发送给矿池的数据以及建议难度的消息
+func overrideDifficulty(f DifficultyFunc, line []byte) ([]byte, []byte) {
+	msg, err := stratum.Decode(line)
+	if err != nil || msg.Method != methodAuthorize {
+		return line, nil
+	}
+	var params []interface{}
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) == 0 {
+		return line, nil
+	}
+	override, ok := f(cast.ToString(params[0]))
+	if !ok || override.Difficulty <= 0 {
+		return line, nil
+	}
+	if override.Mode == DifficultyPassword {
+		if len(params) < 2 {
+			params = append(params, "")
+		}
+		params[1] = passwordWithDifficulty(cast.ToString(params[1]), override.Difficulty)
+		msg.Params, _ = json.Marshal(params)
+		return msg.Encode(), nil
+	}
+	return line, stratum.NewNotify(methodSuggestDifficulty, override.Difficulty).Encode()
+}
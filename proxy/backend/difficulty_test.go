@@ -0,0 +1,64 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOverrideDifficulty(t *testing.T) {
+	f := func(worker string) (DifficultyOverride, bool) {
+		switch {
+		case strings.HasSuffix(worker, ".small"):
+			return DifficultyOverride{Difficulty: 1024, Mode: DifficultySuggest}, true
+		case strings.HasSuffix(worker, ".pwd"):
+			return DifficultyOverride{Difficulty: 2048, Mode: DifficultyPassword}, true
+		}
+		return DifficultyOverride{}, false
+	}
+	tests := []struct {
+		name, line, wantLine, wantSuggest string
+	}{
+		{
+			name:        "suggest",
+			line:        `{"id":2,"method":"mining.authorize","params":["user.small","x"]}` + "\n",
+			wantLine:    `{"id":2,"method":"mining.authorize","params":["user.small","x"]}` + "\n",
+			wantSuggest: `{"id":null,"method":"mining.suggest_difficulty","params":[1024]}` + "\n",
+		},
+		{
+			name:     "password",
+			line:     `{"id":2,"method":"mining.authorize","params":["user.pwd","x"]}` + "\n",
+			wantLine: `{"id":2,"method":"mining.authorize","params":["user.pwd","d=2048"]}` + "\n",
+		},
+		{
+			name:     "password keep options",
+			line:     `{"id":2,"method":"mining.authorize","params":["user.pwd","c=BTC,d=8"]}` + "\n",
+			wantLine: `{"id":2,"method":"mining.authorize","params":["user.pwd","c=BTC,d=2048"]}` + "\n",
+		},
+		{
+			name:     "no rule",
+			line:     `{"id":2,"method":"mining.authorize","params":["user.big","x"]}` + "\n",
+			wantLine: `{"id":2,"method":"mining.authorize","params":["user.big","x"]}` + "\n",
+		},
+		{
+			name:     "not authorize",
+			line:     `{"id":1,"method":"mining.subscribe","params":[]}` + "\n",
+			wantLine: `{"id":1,"method":"mining.subscribe","params":[]}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line, suggest := overrideDifficulty(f, []byte(tt.line))
+			if string(line) != tt.wantLine || string(suggest) != tt.wantSuggest {
+				t.Errorf("overrideDifficulty() = %s, %s, want %s, %s", line, suggest, tt.wantLine, tt.wantSuggest)
+			}
+		})
+	}
+}
+
+func TestHandshake_difficulty(t *testing.T) {
+	h := newHandshake()
+	h.onRead([]byte(`{"id":null,"method":"mining.set_difficulty","params":[512]}` + "\n"))
+	if got := h.currentDifficulty(); got != 512 {
+		t.Errorf("currentDifficulty() = %v, want 512", got)
+	}
+}
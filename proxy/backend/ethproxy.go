@@ -0,0 +1,409 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/stratum"
+	"strings"
+	"sync"
+
+	"go.uber.org/atomic"
+)
+
+const (
+	methodEthGetWork        = "eth_getWork"
+	methodEthSubmitWork     = "eth_submitWork"
+	methodEthSubmitHashrate = "eth_submitHashrate"
+)
+
+const (
+	// translateDetect 等待判断矿机与矿池的方言
+	translateDetect int32 = iota
+	// translatePassthrough 不需要转换, 直接透传
+	translatePassthrough
+	// translateEthProxy EthProxy 矿机 <-> EthereumStratum/1.0.0 矿池
+	translateEthProxy
+)
+
+var (
+	// ethereumStratumBaseTarget EthereumStratum/1.0.0 难度为1时的target
+	ethereumStratumBaseTarget, _ = new(big.Int).SetString("00000000ffff0000000000000000000000000000000000000000000000000000", 16)
+)
+
+// EthTranslateConn 矿机使用 EthProxy 而矿池只支持 EthereumStratum/1.0.0 时转换两边的协议
+// 矿机登录时先用 EthereumStratum/1.0.0 订阅矿池, 矿池拒绝订阅或者矿机不是 EthProxy 时直接透传
+// EthProxy 矿机无法感知 extranonce, 自己选择完整的 nonce, 所以只能转换不分配 extranonce 的矿池,
+// 矿池分配了 extranonce 时拒绝矿机的登录并且关闭连接
+type EthTranslateConn struct {
+	*PoolConn
+	// state 保护转换状态, done 关闭之后不再等待矿机读取数据
+	state      sync.Mutex
+	stopOnce   sync.Once
+	done       chan struct{}
+	poolClosed bool
+	input      <-chan []byte
+	output     chan<- []byte
+	poolInput  chan []byte
+	poolOutput chan []byte
+	closed     *atomic.Bool
+	mode       *atomic.Int32
+	id         *atomic.Int64
+
+	fromMiner, fromPool stratum.Splitter
+	// waiting 等待矿池响应订阅时矿机发送的消息
+	waiting [][]byte
+	login   stratum.Message
+	// routes 转换之后的请求 id -> 矿机请求
+	routes      map[string]stratum.Message
+	subscribeId string
+	extranonce  string
+	target      string
+	work        []string
+	// jobs headerHash -> jobId
+	jobs map[string]string
+}
+
+func NewEthTranslateConn(addr, key string, backups []string, input <-chan []byte, output chan<- []byte) (*EthTranslateConn, error) {
+	c := &EthTranslateConn{
+		input:      input,
+		output:     output,
+		poolInput:  make(chan []byte, 32),
+		poolOutput: make(chan []byte),
+		closed:     atomic.NewBool(false),
+		done:       make(chan struct{}),
+		mode:       atomic.NewInt32(translateDetect),
+		id:         atomic.NewInt64(0),
+		routes:     make(map[string]stratum.Message),
+		jobs:       make(map[string]string),
+	}
+	p, err := NewPoolConn(addr, key, backups, c.poolInput, c.poolOutput)
+	if err != nil {
+		return nil, err
+	}
+	c.PoolConn = p
+	return c, nil
+}
+
+// Dialects 矿机的方言以转换之前的为准
+func (c *EthTranslateConn) Dialects() (stratum.Dialect, stratum.Dialect) {
+	miner, pool := c.PoolConn.Dialects()
+	if c.mode.Load() == translateEthProxy {
+		miner = stratum.DialectEthProxy
+	}
+	return miner, pool
+}
+
+func (c *EthTranslateConn) nextId() string {
+	return fmt.Sprintf("%d", c.id.Inc())
+}
+
+// sendMiner 发送数据给矿机, 不持有锁等待, 连接关闭之后直接丢弃
+func (c *EthTranslateConn) sendMiner(data []byte) {
+	defer func() {
+		_ = recover() // 矿机连接已经关闭
+	}()
+	if c.closed.Load() {
+		return
+	}
+	select {
+	case c.output <- data:
+	case <-c.done:
+	}
+}
+
+func (c *EthTranslateConn) replyMiner(id json.RawMessage, result interface{}, e interface{}) {
+	msg := stratum.Message{Id: id, Jsonrpc: "2.0"}
+	msg.Result, _ = json.Marshal(result)
+	if e != nil {
+		msg.Error, _ = json.Marshal(e)
+	}
+	c.sendMiner(msg.Encode())
+}
+
+// handle 持有 state 锁执行 f
+func (c *EthTranslateConn) handle(f func()) {
+	c.state.Lock()
+	defer c.state.Unlock()
+	f()
+}
+
+// writePool 发送数据给矿池, 调用者需要持有 state 锁
+func (c *EthTranslateConn) writePool(data []byte) {
+	if c.poolClosed {
+		return
+	}
+	select {
+	case c.poolInput <- data:
+	case <-c.done:
+	}
+}
+
+// sendPool 改写 id 之后发送给矿池, origin 为对应的矿机请求
+func (c *EthTranslateConn) sendPool(msg stratum.Message, origin stratum.Message) {
+	id := c.nextId()
+	msg.Id = json.RawMessage(id)
+	c.routes[id] = origin
+	c.writePool(msg.Encode())
+}
+
+// passthrough 矿池不需要转换, 把暂存的数据发送给矿池
+func (c *EthTranslateConn) passthrough() {
+	c.mode.Store(translatePassthrough)
+	for _, v := range c.waiting {
+		c.writePool(v)
+	}
+	c.waiting = nil
+}
+
+func (c *EthTranslateConn) handleMiner(line []byte) {
+	if c.mode.Load() == translatePassthrough {
+		c.writePool(line)
+		return
+	}
+	msg, err := stratum.Decode(line)
+	if c.mode.Load() == translateDetect {
+		c.waiting = append(c.waiting, line)
+		if c.subscribeId != "" { // 正在等待矿池响应订阅
+			return
+		}
+		if err != nil || msg.Method != methodEthSubmitLogin {
+			c.passthrough()
+			return
+		}
+		c.login = msg
+		c.subscribeId = c.nextId()
+		subscribe := stratum.NewNotify(methodSubscribe, "miner-proxy", stratum.EthereumStratumVersion)
+		subscribe.Id = json.RawMessage(c.subscribeId)
+		c.writePool(subscribe.Encode())
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	switch msg.Method {
+	case methodEthSubmitLogin:
+		c.replyMiner(msg.Id, true, nil)
+	case methodEthGetWork:
+		if len(c.work) == 0 {
+			c.replyMiner(msg.Id, nil, "work not ready")
+			return
+		}
+		c.replyMiner(msg.Id, c.work, nil)
+	case methodEthSubmitHashrate:
+		c.replyMiner(msg.Id, true, nil)
+	case methodEthSubmitWork:
+		var params []string
+		if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) < 2 {
+			c.replyMiner(msg.Id, false, "invalid params")
+			return
+		}
+		nonce := strings.TrimPrefix(strings.ToLower(params[0]), "0x")
+		header := strings.TrimPrefix(strings.ToLower(params[1]), "0x")
+		jobId, ok := c.jobs[header]
+		if !ok {
+			c.replyMiner(msg.Id, false, "job not found")
+			return
+		}
+		submit := stratum.NewNotify(methodSubmit, c.worker(), jobId, nonce)
+		c.sendPool(submit, msg)
+	default:
+		c.replyMiner(msg.Id, nil, "unsupported method")
+	}
+}
+
+// worker 返回登录时使用的矿工名称
+func (c *EthTranslateConn) worker() string {
+	var params []string
+	_ = json.Unmarshal(c.login.Params, &params)
+	var name string
+	if len(params) != 0 {
+		name = params[0]
+	}
+	if c.login.Worker != "" && !strings.Contains(name, ".") {
+		name = name + "." + c.login.Worker
+	}
+	return name
+}
+
+func (c *EthTranslateConn) handlePool(line []byte) {
+	if c.mode.Load() == translatePassthrough {
+		c.sendMiner(line)
+		return
+	}
+	msg, err := stratum.Decode(line)
+	if c.mode.Load() == translateDetect {
+		if err != nil || !msg.IsResponse() || msg.IdKey() != c.subscribeId {
+			c.sendMiner(line)
+			return
+		}
+		if msg.HasError() || stratum.DetectPoolDialect(msg) != stratum.DialectEthereumStratum {
+			pkg.Debug("mine pool not support %s, passthrough", stratum.EthereumStratumVersion)
+			c.passthrough()
+			return
+		}
+		var result []json.RawMessage
+		_ = json.Unmarshal(msg.Result, &result)
+		if len(result) >= 2 {
+			_ = json.Unmarshal(result[1], &c.extranonce)
+		}
+		if c.extranonce != "" {
+			c.refuse(c.login.Id)
+			return
+		}
+		c.mode.Store(translateEthProxy)
+		var params []json.RawMessage
+		_ = json.Unmarshal(c.login.Params, &params)
+		if len(params) != 0 {
+			params[0], _ = json.Marshal(c.worker())
+		}
+		authorize := stratum.Message{Method: methodAuthorize}
+		authorize.Params, _ = json.Marshal(params)
+		c.sendPool(authorize, c.login)
+		for _, v := range c.waiting[1:] {
+			c.handleMiner(v)
+		}
+		c.waiting = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	if msg.IsResponse() {
+		origin, ok := c.routes[msg.IdKey()]
+		if !ok {
+			return
+		}
+		delete(c.routes, msg.IdKey())
+		if msg.HasError() {
+			c.replyMiner(origin.Id, false, msg.Error)
+			return
+		}
+		c.replyMiner(origin.Id, msg.Result, nil)
+		return
+	}
+
+	switch msg.Method {
+	case methodSetDifficulty:
+		var params []float64
+		if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) == 0 || params[0] <= 0 {
+			return
+		}
+		c.target = difficulty2Target(params[0])
+	case methodSetExtranonce:
+		var params []string
+		if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) == 0 {
+			return
+		}
+		c.extranonce = params[0]
+		if c.extranonce != "" {
+			c.refuse(nil)
+		}
+	case methodNotify:
+		var params []json.RawMessage
+		if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) < 3 {
+			return
+		}
+		var jobId, seed, header string
+		_ = json.Unmarshal(params[0], &jobId)
+		_ = json.Unmarshal(params[1], &seed)
+		_ = json.Unmarshal(params[2], &header)
+		if len(c.jobs) > 64 { // 只保留最近的任务
+			c.jobs = make(map[string]string)
+		}
+		c.jobs[strings.ToLower(header)] = jobId
+		c.work = []string{"0x" + header, "0x" + seed, c.target}
+		work := stratum.Message{Id: json.RawMessage("0"), Jsonrpc: "2.0"}
+		work.Result, _ = json.Marshal(c.work)
+		c.sendMiner(work.Encode())
+	}
+}
+
+// refuse 矿池分配了 extranonce, EthProxy 矿机提交的 nonce 无法被矿池接受, 回复矿机错误之后关闭连接
+// id 不为空时作为登录请求的响应, 调用者需要持有 state 锁
+func (c *EthTranslateConn) refuse(id json.RawMessage) {
+	pkg.Warn("mine pool %s assigns extranonce %s, EthProxy miner can not use it, close connection", c.Address(), c.extranonce)
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	c.replyMiner(id, false, "mine pool assigns extranonce "+c.extranonce+", EthProxy miner is not supported")
+	c.Close()
+}
+
+// difficulty2Target 将 EthereumStratum/1.0.0 的难度转换为 EthProxy 的 target
+func difficulty2Target(difficulty float64) string {
+	target := new(big.Float).SetInt(ethereumStratumBaseTarget)
+	target.Quo(target, big.NewFloat(difficulty))
+	result, _ := target.Int(nil)
+	return fmt.Sprintf("0x%064x", result)
+}
+
+func (c *EthTranslateConn) Close() {
+	c.stopOnce.Do(func() {
+		c.closed.Store(true)
+		close(c.done)
+	})
+	c.PoolConn.Close()
+}
+
+func (c *EthTranslateConn) Start() {
+	defer c.Close()
+	go c.PoolConn.Start()
+	go func() {
+		defer close(c.output)
+		defer c.Close()
+		for data := range c.poolOutput {
+			c.handle(func() {
+				if c.mode.Load() != translatePassthrough {
+					for _, line := range c.fromPool.Feed(data) {
+						c.handlePool(line)
+					}
+					if c.mode.Load() != translatePassthrough {
+						return
+					}
+					data = nil
+				}
+				// 透传模式下先发送之前没有组成完整行的数据
+				if pending := c.fromPool.Pending(); len(pending) != 0 {
+					c.sendMiner(pending)
+					c.fromPool.Reset()
+				}
+				if len(data) != 0 {
+					c.sendMiner(data)
+				}
+			})
+		}
+	}()
+
+	defer c.handle(func() {
+		c.poolClosed = true
+		close(c.poolInput)
+	})
+	for !c.IsClosed() {
+		data, isOpen := <-c.input
+		if !isOpen {
+			return
+		}
+		c.handle(func() {
+			if c.mode.Load() != translatePassthrough {
+				for _, line := range c.fromMiner.Feed(data) {
+					c.handleMiner(line)
+				}
+				if c.mode.Load() != translatePassthrough {
+					return
+				}
+				data = nil
+			}
+			if pending := c.fromMiner.Pending(); len(pending) != 0 {
+				c.writePool(pending)
+				c.fromMiner.Reset()
+			}
+			if len(data) != 0 {
+				c.writePool(data)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"miner-proxy/proxy/stratum"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// ethStratumPool 模拟分配 extranonce 的 EthereumStratum/1.0.0 矿池, 返回矿池收到的份额
+func ethStratumPool(t *testing.T, extranonce string) (net.Listener, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	submits := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				return
+			}
+			msg, _ := stratum.Decode(line)
+			switch msg.Method {
+			case methodSubscribe:
+				_, _ = conn.Write([]byte(`{"id":` + msg.IdKey() + `,"result":[["mining.notify","ae","EthereumStratum/1.0.0"],"` + extranonce + `"],"error":null}` + "\n"))
+			case methodAuthorize:
+				_, _ = conn.Write([]byte(`{"id":` + msg.IdKey() + `,"result":true,"error":null}` + "\n"))
+				_, _ = conn.Write([]byte(`{"id":null,"method":"mining.set_difficulty","params":[2]}` + "\n"))
+				_, _ = conn.Write([]byte(`{"id":null,"method":"mining.notify","params":["job1","5eed","4ead",true]}` + "\n"))
+			case methodSubmit:
+				var params []string
+				_ = json.Unmarshal(msg.Params, &params)
+				submits <- params
+				_, _ = conn.Write([]byte(`{"id":` + msg.IdKey() + `,"result":true,"error":null}` + "\n"))
+			}
+		}
+	}()
+	return l, submits
+}
+
+func TestEthTranslateConn(t *testing.T) {
+	l, submits := ethStratumPool(t, "")
+	defer l.Close()
+
+	input, output := make(chan []byte, 10), make(chan []byte, 10)
+	c, err := NewEthTranslateConn(l.Addr().String(), "client", nil, input, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.Start()
+
+	input <- []byte(`{"id":1,"jsonrpc":"2.0","method":"eth_submitLogin","params":["0xwallet","x"],"worker":"rig1"}` + "\n")
+	if msg := readMessage(t, output); msg.IdKey() != "1" || string(msg.Result) != "true" {
+		t.Fatalf("login response = %+v", msg)
+	}
+	msg := readMessage(t, output)
+	var work []string
+	_ = json.Unmarshal(msg.Result, &work)
+	if len(work) != 3 || work[0] != "0x4ead" || work[1] != "0x5eed" || work[2] != "0x000000007fff8000000000000000000000000000000000000000000000000000" {
+		t.Fatalf("work = %v", work)
+	}
+
+	// 矿机不知道 extranonce, 自己选择完整的 nonce
+	input <- []byte(`{"id":2,"jsonrpc":"2.0","method":"eth_submitWork","params":["0x9f3c27d1e8a40b56","0x4ead","0x00"]}` + "\n")
+	if msg := readMessage(t, output); msg.IdKey() != "2" || string(msg.Result) != "true" {
+		t.Fatalf("submit response = %+v", msg)
+	}
+	params := <-submits
+	if len(params) != 3 || params[0] != "0xwallet.rig1" || params[1] != "job1" || params[2] != "9f3c27d1e8a40b56" {
+		t.Errorf("submit params = %v", params)
+	}
+	if miner, pool := c.Dialects(); miner != stratum.DialectEthProxy || pool != stratum.DialectEthereumStratum {
+		t.Errorf("Dialects() = %s, %s", miner, pool)
+	}
+}
+
+func TestEthTranslateConn_extranonce(t *testing.T) {
+	l, _ := ethStratumPool(t, "ab12")
+	defer l.Close()
+
+	input, output := make(chan []byte, 10), make(chan []byte, 10)
+	c, err := NewEthTranslateConn(l.Addr().String(), "client", nil, input, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.Start()
+
+	input <- []byte(`{"id":1,"jsonrpc":"2.0","method":"eth_submitLogin","params":["0xwallet","x"],"worker":"rig1"}` + "\n")
+	if msg := readMessage(t, output); msg.IdKey() != "1" || !msg.HasError() {
+		t.Fatalf("login response = %+v, want error", msg)
+	}
+	select {
+	case _, ok := <-output:
+		if ok {
+			t.Fatal("received data after refusing to translate")
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("connection not closed after the pool assigns extranonce")
+	}
+}
+
+func TestEthTranslateConn_CloseWhileSending(t *testing.T) {
+	c := &EthTranslateConn{
+		PoolConn: &PoolConn{closed: atomic.NewBool(false)},
+		output:   make(chan []byte),
+		closed:   atomic.NewBool(false),
+		done:     make(chan struct{}),
+	}
+	sent := make(chan struct{})
+	go func() {
+		c.handle(func() {
+			c.sendMiner([]byte("job\n")) // 没有协程读取矿机的数据
+		})
+		close(sent)
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	for _, ch := range []chan struct{}{closed, sent} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatal("Close() blocked by a pending send to the miner")
+		}
+	}
+}
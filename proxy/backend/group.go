@@ -0,0 +1,211 @@
+package backend
+
+import (
+	"bufio"
+	"encoding/json"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/stratum"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+)
+
+const (
+	// GroupScheme 矿池组地址的前缀, 例如 group://f2pool
+	GroupScheme = "group://"
+	// hysteresis 新的端点比当前端点快 20% 以上才切换, 避免矿机在延迟相近的端点之间来回切换
+	hysteresis = 0.2
+	// minSwitchGain 延迟至少降低 10ms 才切换
+	minSwitchGain = time.Millisecond * 10
+	// maxProbeFailures 连续探测失败的次数达到之后认为端点不可用
+	maxProbeFailures = 2
+)
+
+// IsGroupAddress 是否为矿池组地址
+func IsGroupAddress(addr string) bool {
+	return strings.HasPrefix(strings.ToLower(addr), GroupScheme)
+}
+
+// GroupName 返回矿池组地址中的组名
+func GroupName(addr string) string {
+	return addr[len(GroupScheme):]
+}
+
+// endpoint 矿池组中的一个候选端点
+type endpoint struct {
+	addr     string
+	latency  time.Duration
+	failures int
+	probed   bool
+}
+
+// healthy 至少探测成功过一次并且最近没有连续失败
+func (e *endpoint) healthy() bool {
+	return e.probed && e.latency != 0 && e.failures < maxProbeFailures
+}
+
+// PoolGroup 同一个矿池的多个地区端点, 定时测量每一个端点的 tcp 连接与 stratum 往返延迟, 新的矿机使用最快并且可用的端点
+type PoolGroup struct {
+	name      string
+	m         sync.Mutex
+	endpoints []*endpoint
+	current   *endpoint
+	interval  time.Duration
+	closed    *atomic.Bool
+}
+
+// NewPoolGroup 创建矿池组并且开始定时探测, interval 为探测间隔
+func NewPoolGroup(name string, candidates []string, interval time.Duration) (*PoolGroup, error) {
+	if len(candidates) == 0 {
+		return nil, errors.Errorf("pool group %s has no candidate", name)
+	}
+	g := &PoolGroup{name: name, interval: interval, closed: atomic.NewBool(false)}
+	for _, v := range candidates {
+		if _, err := ParsePoolAddress(v); err != nil {
+			return nil, errors.Wrapf(err, "pool group %s", name)
+		}
+		g.endpoints = append(g.endpoints, &endpoint{addr: v})
+	}
+	g.current = g.endpoints[0]
+	go g.run()
+	return g, nil
+}
+
+// ParsePoolGroups 解析矿池组参数, 格式为 组名=矿池1,矿池2;组名=矿池3,矿池4
+func ParsePoolGroups(s string, interval time.Duration) (map[string]*PoolGroup, error) {
+	result := make(map[string]*PoolGroup)
+	for _, v := range pkg.String2Array(strings.ReplaceAll(s, " ", ""), ";") {
+		index := strings.Index(v, "=")
+		if index <= 0 {
+			return nil, errors.Errorf("invalid pool group %s", v)
+		}
+		name := v[:index]
+		if _, ok := result[name]; ok {
+			return nil, errors.Errorf("duplicate pool group %s", name)
+		}
+		g, err := NewPoolGroup(name, pkg.String2Array(v[index+1:], ","), interval)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = g
+	}
+	return result, nil
+}
+
+func (g *PoolGroup) run() {
+	for !g.closed.Load() {
+		g.probeAll()
+		time.Sleep(g.interval)
+	}
+}
+
+// probeAll 并发探测所有端点, 然后重新选择当前端点
+func (g *PoolGroup) probeAll() {
+	latencies := make([]time.Duration, len(g.endpoints))
+	errs := make([]error, len(g.endpoints))
+	var wg sync.WaitGroup
+	for i, v := range g.endpoints {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			latencies[i], errs[i] = probe(addr)
+		}(i, v.addr)
+	}
+	wg.Wait()
+
+	g.m.Lock()
+	defer g.m.Unlock()
+	for i, e := range g.endpoints {
+		e.probed = true
+		if errs[i] != nil {
+			e.failures++
+			pkg.Debug("probe pool group %s endpoint %s error: %s", g.name, e.addr, errs[i])
+			continue
+		}
+		e.failures = 0
+		if e.latency == 0 {
+			e.latency = latencies[i]
+		} else {
+			e.latency = (e.latency*3 + latencies[i]) / 4
+		}
+	}
+	g.choose()
+}
+
+// choose 选择延迟最低的可用端点, 调用者需要持有 m 锁
+func (g *PoolGroup) choose() {
+	var best *endpoint
+	for _, e := range g.endpoints {
+		if e.healthy() && (best == nil || e.latency < best.latency) {
+			best = e
+		}
+	}
+	if best == nil || best == g.current {
+		return
+	}
+	if g.current.healthy() {
+		gain := g.current.latency - best.latency
+		if gain < minSwitchGain || float64(gain) < float64(g.current.latency)*hysteresis {
+			return
+		}
+	}
+	pkg.Info("矿池组 %s 切换端点 %s(%s) -> %s(%s)", g.name,
+		g.current.addr, g.current.latency, best.addr, best.latency)
+	g.current = best
+}
+
+// Select 返回新的矿机应该使用的端点, 以及按照延迟排序的其他可用端点作为备用矿池
+func (g *PoolGroup) Select() (string, []string) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	var others []*endpoint
+	for _, e := range g.endpoints {
+		if e != g.current && (e.healthy() || !e.probed) {
+			others = append(others, e)
+		}
+	}
+	sort.SliceStable(others, func(i, j int) bool {
+		return others[i].latency < others[j].latency
+	})
+	backups := make([]string, 0, len(others))
+	for _, e := range others {
+		backups = append(backups, e.addr)
+	}
+	return g.current.addr, backups
+}
+
+// Close 停止探测
+func (g *PoolGroup) Close() {
+	g.closed.Store(true)
+}
+
+// probe 测量 tcp(tls) 连接与一次 mining.subscribe 往返的总延迟, 探测连接不计入矿池的健康状况
+func probe(addr string) (time.Duration, error) {
+	a, err := ParsePoolAddress(addr)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	conn, err := a.dial(nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if IsSV2Address(addr) { // stratum v2 需要 noise 握手, 只测量连接延迟
+		return time.Since(start), nil
+	}
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	subscribe := stratum.NewNotify(methodSubscribe, "miner-proxy")
+	subscribe.Id = json.RawMessage("1")
+	if _, err := conn.Write(subscribe.Encode()); err != nil {
+		return 0, errors.Wrapf(err, "write subscribe to %s error", addr)
+	}
+	if _, err := bufio.NewReader(conn).ReadBytes('\n'); err != nil {
+		return 0, errors.Wrapf(err, "read subscribe response from %s error", addr)
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func TestPoolGroup_choose(t *testing.T) {
+	a := &endpoint{addr: "a:1", probed: true}
+	b := &endpoint{addr: "b:1", probed: true}
+	g := &PoolGroup{name: "test", endpoints: []*endpoint{a, b}, current: a, closed: atomic.NewBool(true)}
+	// 用例按照顺序执行, 当前端点会延续到下一个用例
+	tests := []struct {
+		name      string
+		a, b      time.Duration
+		bFailures int
+		want      string
+	}{
+		{name: "slightly faster", a: 100, b: 90, want: "a:1"},
+		{name: "gain below minimum", a: 30, b: 21, want: "a:1"},
+		{name: "much faster", a: 100, b: 50, want: "b:1"},
+		{name: "no bounce back", a: 45, b: 50, want: "b:1"},
+		{name: "unhealthy current", a: 100, b: 50, bFailures: maxProbeFailures, want: "a:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.latency, b.latency = tt.a*time.Millisecond, tt.b*time.Millisecond
+			b.failures = tt.bFailures
+			g.choose()
+			if got, _ := g.Select(); got != tt.want {
+				t.Errorf("Select() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolGroup_probe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := bufio.NewReader(conn).ReadBytes('\n'); err == nil {
+					_, _ = conn.Write([]byte(`{"id":1,"result":[[],"00",4],"error":null}` + "\n"))
+				}
+			}()
+		}
+	}()
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	_ = dead.Close()
+
+	g, err := NewPoolGroup("test", []string{deadAddr, l.Addr().String()}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.probeAll()
+	selected, backups := g.Select()
+	if selected != l.Addr().String() {
+		t.Fatalf("Select() = %s, want %s", selected, l.Addr())
+	}
+	if len(backups) != 0 {
+		t.Fatalf("unreachable endpoint should not be backup, got %v", backups)
+	}
+	if _, ok := healths.Load(l.Addr().String()); ok {
+		t.Fatal("probe should not be recorded as pool dial")
+	}
+}
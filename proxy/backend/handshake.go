@@ -0,0 +1,314 @@
+package backend
+
+import (
+	"encoding/json"
+	"miner-proxy/proxy/stratum"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+)
+
+const (
+	methodSubscribe           = "mining.subscribe"
+	methodAuthorize           = "mining.authorize"
+	methodExtranonceSubscribe = "mining.extranonce.subscribe"
+	methodSetExtranonce       = "mining.set_extranonce"
+	methodEthSubmitLogin      = "eth_submitLogin"
+	methodClientReconnect     = "client.reconnect"
+)
+
+// handshake 记录矿机发往矿池的握手消息, 矿池重连之后按顺序重放
+type handshake struct {
+	m        sync.Mutex
+	toPool   stratum.Splitter
+	fromPool stratum.Splitter
+	// requests 按照矿机发送的顺序保存的握手请求
+	requests []stratum.Message
+	// pending 已经发往矿池但是还没有收到响应的握手请求 key=id value=method
+	pending              map[string]string
+	extranonce1          string
+	extranonce2Size      int
+	extranonceSubscribed bool
+	// 根据最先收到的消息判断出的矿机与矿池的方言
+	minerDialect, poolDialect stratum.Dialect
+	// submits 等待矿池响应的份额请求 id
+	submits map[string]struct{}
+	// onShare 收到矿池对份额的响应时调用
+	onShare func(accepted bool)
+	// difficulty 矿池最后一次下发的难度, notify 矿池最后一次下发的任务
+	difficulty float64
+	notify     []byte
+	// onPoolError 矿池拒绝授权或者份额时调用, authorize 表示是授权请求的错误, worker 为请求使用的矿工名
+	onPoolError func(authorize bool, worker string, e json.RawMessage)
+	// onAuthorized 矿池授权成功时调用
+	onAuthorized func(worker string)
+}
+
+func newHandshake() *handshake {
+	return &handshake{pending: make(map[string]string), submits: make(map[string]struct{})}
+}
+
+func isSubmitMethod(method string) bool {
+	return method == methodSubmit || method == methodEthSubmitWork
+}
+
+func isHandshakeMethod(method string) bool {
+	switch method {
+	case methodSubscribe, methodAuthorize, methodExtranonceSubscribe, methodEthSubmitLogin:
+		return true
+	}
+	return false
+}
+
+// authorizedWorker 返回矿机授权使用的矿工名
+func (h *handshake) authorizedWorker() (string, bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.worker("")
+}
+
+// worker 返回 id 对应的授权请求的矿工名, id 为空时返回第一个授权请求的矿工名, 调用者需要持有 m 锁
+func (h *handshake) worker(id string) (string, bool) {
+	for _, v := range h.requests {
+		if v.Method != methodAuthorize && v.Method != methodEthSubmitLogin || (id != "" && v.IdKey() != id) {
+			continue
+		}
+		var params []interface{}
+		if err := json.Unmarshal(v.Params, &params); err != nil || len(params) == 0 {
+			return "", false
+		}
+		return cast.ToString(params[0]), true
+	}
+	return "", false
+}
+
+// onWrite 记录矿机 -> 矿池的数据
+func (h *handshake) onWrite(data []byte) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for _, line := range h.toPool.Feed(data) {
+		msg, err := stratum.Decode(line)
+		if err != nil {
+			continue
+		}
+		if h.minerDialect == stratum.DialectUnknown {
+			h.minerDialect = stratum.DetectMinerDialect(msg)
+		}
+		if isSubmitMethod(msg.Method) && len(h.submits) < 1024 {
+			h.submits[msg.IdKey()] = struct{}{}
+			continue
+		}
+		if !isHandshakeMethod(msg.Method) {
+			continue
+		}
+		switch msg.Method {
+		case methodSubscribe: // 重新订阅之前的握手全部作废
+			h.requests = nil
+		case methodExtranonceSubscribe:
+			h.extranonceSubscribed = true
+		}
+		h.requests = append(h.requests, msg)
+		h.pending[msg.IdKey()] = msg.Method
+	}
+}
+
+// onRead 记录矿池 -> 矿机的数据
+func (h *handshake) onRead(data []byte) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for _, line := range h.fromPool.Feed(data) {
+		msg, err := stratum.Decode(line)
+		if err != nil {
+			continue
+		}
+		if h.poolDialect == stratum.DialectUnknown {
+			h.poolDialect = stratum.DetectPoolDialect(msg)
+		}
+		if msg.Method == methodSetExtranonce {
+			h.extranonce1, h.extranonce2Size, _ = parseExtranonce(msg.Params, 0)
+			continue
+		}
+		if msg.Method == methodSetDifficulty {
+			if d, ok := parseDifficulty(msg.Params); ok {
+				h.difficulty = d
+			}
+			continue
+		}
+		if msg.Method == methodNotify {
+			h.notify = append(h.notify[:0], line...)
+			continue
+		}
+		if !msg.IsResponse() {
+			continue
+		}
+		if _, ok := h.submits[msg.IdKey()]; ok {
+			delete(h.submits, msg.IdKey())
+			if h.onShare != nil {
+				h.onShare(!isRejected(msg.Result, msg.Error))
+			}
+			if msg.HasError() && h.onPoolError != nil {
+				worker, _ := h.worker("")
+				h.onPoolError(false, worker, msg.Error)
+			}
+			continue
+		}
+		method, ok := h.pending[msg.IdKey()]
+		if !ok {
+			continue
+		}
+		delete(h.pending, msg.IdKey())
+		if method == methodAuthorize || method == methodEthSubmitLogin {
+			h.authorizeResult(msg)
+		}
+		if method == methodSubscribe && !msg.HasError() {
+			h.extranonce1, h.extranonce2Size, _ = parseExtranonce(msg.Result, 1)
+		}
+	}
+}
+
+// authorizeResult 处理授权请求的响应, 调用者需要持有 m 锁
+func (h *handshake) authorizeResult(msg stratum.Message) {
+	worker, _ := h.worker(msg.IdKey())
+	if msg.HasError() || string(msg.Result) == "false" {
+		if h.onPoolError != nil {
+			h.onPoolError(true, worker, msg.Error)
+		}
+		return
+	}
+	if h.onAuthorized != nil {
+		h.onAuthorized(worker)
+	}
+}
+
+func (h *handshake) currentDifficulty() float64 {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.difficulty
+}
+
+func (h *handshake) extranonce() (string, int) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.extranonce1, h.extranonce2Size
+}
+
+// lastJob 返回矿池最后一次下发的难度与任务, 矿机重新连接之后不需要等待矿池的下一个任务
+func (h *handshake) lastJob() [][]byte {
+	h.m.Lock()
+	defer h.m.Unlock()
+	var result [][]byte
+	if h.difficulty > 0 {
+		result = append(result, stratum.NewNotify(methodSetDifficulty, h.difficulty).Encode())
+	}
+	if len(h.notify) != 0 {
+		result = append(result, append([]byte(nil), h.notify...))
+	}
+	return result
+}
+
+func (h *handshake) dialects() (stratum.Dialect, stratum.Dialect) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.minerDialect, h.poolDialect
+}
+
+// parseExtranonce 从 subscribe 的响应或者 set_extranonce 的参数中解析 extranonce1 与 extranonce2 的长度
+// offset 为 extranonce1 在数组中的下标
+func parseExtranonce(data json.RawMessage, offset int) (string, int, error) {
+	var arr []json.RawMessage
+	if err := json.Unmarshal(data, &arr); err != nil {
+		return "", 0, err
+	}
+	if len(arr) < offset+2 {
+		return "", 0, errors.New("extranonce not found")
+	}
+	var extranonce1 string
+	var size int
+	if err := json.Unmarshal(arr[offset], &extranonce1); err != nil {
+		return "", 0, err
+	}
+	if err := json.Unmarshal(arr[offset+1], &size); err != nil {
+		return "", 0, err
+	}
+	return extranonce1, size, nil
+}
+
+// replay 在新的矿池连接上重放握手, 返回需要转发给矿机的数据
+// 握手请求的响应不会转发给矿机, 矿机已经收到过一次了
+func (h *handshake) replay(conn net.Conn, timeout time.Duration) ([][]byte, error) {
+	// 读写矿池时不持有锁, 避免阻塞写入协程的 onWrite
+	h.m.Lock()
+	h.fromPool.Reset()
+	requests := append([]stratum.Message(nil), h.requests...)
+	extranonce1, extranonce2Size := h.extranonce1, h.extranonce2Size
+	h.m.Unlock()
+	if len(requests) == 0 {
+		return nil, nil
+	}
+
+	var waiting = make(map[string]string)
+	for _, req := range requests {
+		if _, err := conn.Write(req.Encode()); err != nil {
+			return nil, errors.Wrap(err, "replay handshake error")
+		}
+		waiting[req.IdKey()] = req.Method
+	}
+
+	var (
+		forward  [][]byte
+		splitter stratum.Splitter
+		previous = extranonce1
+		size     = extranonce2Size
+	)
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for len(waiting) != 0 {
+		data := make([]byte, 1024)
+		n, err := conn.Read(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "read handshake response error")
+		}
+		for _, line := range splitter.Feed(data[:n]) {
+			msg, err := stratum.Decode(line)
+			if err != nil {
+				forward = append(forward, line)
+				continue
+			}
+			method, ok := waiting[msg.IdKey()]
+			if !msg.IsResponse() || !ok {
+				if msg.Method == methodSetExtranonce {
+					extranonce1, extranonce2Size, _ = parseExtranonce(msg.Params, 0)
+				}
+				forward = append(forward, line)
+				continue
+			}
+			delete(waiting, msg.IdKey())
+			if msg.HasError() {
+				return nil, errors.Errorf("pool refused %s: %s", method, msg.Error)
+			}
+			if method == methodSubscribe {
+				extranonce1, extranonce2Size, _ = parseExtranonce(msg.Result, 1)
+			}
+		}
+	}
+	if pending := splitter.Pending(); len(pending) != 0 {
+		forward = append(forward, pending)
+	}
+
+	if extranonce1 == previous && extranonce2Size == size {
+		return forward, nil
+	}
+	h.m.Lock()
+	h.extranonce1, h.extranonce2Size = extranonce1, extranonce2Size
+	subscribed := h.extranonceSubscribed
+	h.m.Unlock()
+	if subscribed { // 矿机支持 extranonce 订阅, 直接下发新的 extranonce
+		msg := stratum.NewNotify(methodSetExtranonce, extranonce1, extranonce2Size)
+		return append([][]byte{msg.Encode()}, forward...), nil
+	}
+	// 无法调和 extranonce, 只能让矿机重新连接
+	return append(forward, stratum.NewNotify(methodClientReconnect).Encode()), nil
+}
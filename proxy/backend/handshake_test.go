@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"bufio"
+	"miner-proxy/proxy/stratum"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePool 模拟矿池, 对 subscribe 返回指定的 extranonce1, 其他请求返回 true
+func fakePool(conn net.Conn, extranonce1 string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		msg, _ := stratum.Decode(line)
+		result := "true"
+		if msg.Method == methodSubscribe {
+			result = `[[["mining.notify","1"]],"` + extranonce1 + `",4]`
+		}
+		if msg.Method == methodAuthorize {
+			_, _ = conn.Write([]byte(`{"id":null,"method":"mining.set_difficulty","params":[8]}` + "\n"))
+		}
+		_, _ = conn.Write([]byte(`{"id":` + msg.IdKey() + `,"result":` + result + `,"error":null}` + "\n"))
+	}
+}
+
+func TestHandshake_replay(t *testing.T) {
+	tests := []struct {
+		name        string
+		extranonce1 string
+		subscribe   bool
+		want        string
+	}{
+		{"same extranonce", "aabb", false, "mining.set_difficulty"},
+		{"set extranonce", "ccdd", true, "mining.set_extranonce"},
+		{"reconnect", "ccdd", false, "client.reconnect"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandshake()
+			h.onWrite([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n"))
+			if tt.subscribe {
+				h.onWrite([]byte(`{"id":2,"method":"mining.extranonce.subscribe","params":[]}` + "\n"))
+			}
+			h.onWrite([]byte(`{"id":3,"method":"mining.authorize","params":["w","x"]}` + "\n"))
+			h.onRead([]byte(`{"id":1,"result":[[["mining.notify","1"]],"aabb",4],"error":null}` + "\n"))
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				fakePool(conn, tt.extranonce1)
+			}()
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			forward, err := h.replay(client, time.Second)
+			if err != nil {
+				t.Fatalf("replay() error = %v", err)
+			}
+			var methods []string
+			for _, v := range forward {
+				msg, _ := stratum.Decode(v)
+				methods = append(methods, msg.Method)
+			}
+			if !strings.Contains(strings.Join(methods, ","), tt.want) {
+				t.Errorf("replay() forward = %v, want contains %s", methods, tt.want)
+			}
+			if h.extranonce1 != tt.extranonce1 {
+				t.Errorf("extranonce1 = %s, want %s", h.extranonce1, tt.extranonce1)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+package backend
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+var (
+	// healths 矿池地址 -> *poolHealth, 矿池地址由客户端提供, 空闲的记录会被清理
+	healths     sync.Map
+	healthCount = atomic.NewInt64(0)
+	// healthM 保护记录的新建, 清理与连接标记, 读取已有的记录不需要加锁
+	healthM sync.Mutex
+	// healthIdleTTL 没有连接并且超过该时间没有使用的矿池记录会被清理, maxHealths 最多保存的矿池记录数量
+	healthIdleTTL = time.Hour * 24
+	maxHealths    = 1024
+	// evictSamples 每次清理时最多检查的记录数量
+	evictSamples = 16
+)
+
+// poolHealth 矿池的健康状况
+type poolHealth struct {
+	m           sync.Mutex
+	address     string
+	dials       int64
+	dialFailed  int64
+	dialLatency time.Duration
+	lastError   string
+	lastErrorAt time.Time
+	lastSuccess time.Time
+	// disconnects 断开原因 -> 次数
+	disconnects map[string]int64
+	accepted    int64
+	rejected    int64
+	connections *atomic.Int64
+	// sources 源地址 -> 当前连接数
+	sources map[string]int64
+	// errors 矿池错误分类 -> 次数
+	errors map[string]int64
+	// active 最后一次使用的时间(纳秒)
+	active *atomic.Int64
+	// dialing 正在连接的次数, 正在连接或者有连接的记录不会被清理
+	dialing *atomic.Int64
+}
+
+func healthOf(addr string) *poolHealth {
+	now := time.Now()
+	if v, ok := healths.Load(addr); ok {
+		v.(*poolHealth).active.Store(now.UnixNano())
+		return v.(*poolHealth)
+	}
+	healthM.Lock()
+	defer healthM.Unlock()
+	v, loaded := healths.LoadOrStore(addr, &poolHealth{
+		address:     addr,
+		disconnects: make(map[string]int64),
+		connections: atomic.NewInt64(0),
+		sources:     make(map[string]int64),
+		errors:      make(map[string]int64),
+		active:      atomic.NewInt64(now.UnixNano()),
+		dialing:     atomic.NewInt64(0),
+	})
+	if !loaded && healthCount.Inc() > int64(maxHealths) {
+		evictHealths(now, addr)
+	}
+	return v.(*poolHealth)
+}
+
+// dialHealth 返回矿池记录并且标记正在连接, 调用者连接结束之后需要减少 dialing
+func dialHealth(addr string) *poolHealth {
+	for {
+		h := healthOf(addr)
+		healthM.Lock()
+		if v, ok := healths.Load(addr); ok && v.(*poolHealth) == h {
+			h.dialing.Inc()
+			healthM.Unlock()
+			return h
+		}
+		healthM.Unlock()
+	}
+}
+
+// evictHealths 抽样检查最多 evictSamples 条没有连接的记录, 清理其中过期的记录,
+// 仍然超过 maxHealths 时从抽样中最久没有使用的开始清理, 调用者需要持有 healthM 锁
+func evictHealths(now time.Time, skip string) {
+	idle := make([]*poolHealth, 0, evictSamples)
+	healths.Range(func(key, value interface{}) bool {
+		h := value.(*poolHealth)
+		if h.address != skip && h.connections.Load() == 0 && h.dialing.Load() == 0 {
+			idle = append(idle, h)
+		}
+		return len(idle) < evictSamples
+	})
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].active.Load() < idle[j].active.Load()
+	})
+	for _, h := range idle {
+		expired := now.Sub(time.Unix(0, h.active.Load())) > healthIdleTTL
+		if !expired && healthCount.Load() <= int64(maxHealths) {
+			break
+		}
+		healths.Delete(h.address)
+		healthCount.Dec()
+	}
+}
+
+// dialed 记录一次连接矿池的结果, 延迟使用指数移动平均
+func (h *poolHealth) dialed(latency time.Duration, err error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.dials++
+	if err != nil {
+		h.fail(err)
+		return
+	}
+	h.lastSuccess = time.Now()
+	if h.dialLatency == 0 {
+		h.dialLatency = latency
+	} else {
+		h.dialLatency = (h.dialLatency*7 + latency) / 8
+	}
+}
+
+// fail 记录连接失败, 调用者需要持有 m 锁
+func (h *poolHealth) fail(err error) {
+	h.dialFailed++
+	h.lastError = err.Error()
+	h.lastErrorAt = time.Now()
+}
+
+// setupFailed 连接成功之后握手失败, 同样算作一次连接失败
+func (h *poolHealth) setupFailed(err error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.fail(err)
+}
+
+func (h *poolHealth) disconnected(err error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.disconnects[disconnectReason(err)]++
+}
+
+func (h *poolHealth) poolError(category string) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.errors[category]++
+}
+
+func (h *poolHealth) share(accepted bool) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if accepted {
+		h.accepted++
+	} else {
+		h.rejected++
+	}
+}
+
+// sourceConnections 每一个源地址到该矿池的连接数
+func (h *poolHealth) sourceConnections() map[string]int64 {
+	h.m.Lock()
+	defer h.m.Unlock()
+	result := make(map[string]int64, len(h.sources))
+	for k, v := range h.sources {
+		result[k] = v
+	}
+	return result
+}
+
+func (h *poolHealth) addSource(source string, delta int64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.sources[source] += delta
+	if h.sources[source] <= 0 {
+		delete(h.sources, source)
+	}
+}
+
+// disconnectReason 将连接错误归类
+func disconnectReason(err error) string {
+	if err == nil {
+		return "closed"
+	}
+	if err == io.EOF {
+		return "eof"
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return "timeout"
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "connection reset"):
+		return "reset"
+	case strings.Contains(msg, "broken pipe"):
+		return "broken_pipe"
+	case strings.Contains(msg, "use of closed network connection"):
+		return "closed"
+	case strings.Contains(msg, "tls"):
+		return "tls"
+	}
+	return "other"
+}
+
+// isRejected 矿池对份额的响应是否为拒绝
+func isRejected(result, e json.RawMessage) bool {
+	if len(e) != 0 && string(e) != "null" {
+		return true
+	}
+	return string(result) == "false"
+}
+
+// PoolError 矿池最近一次连接失败的原因
+type PoolError struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// LastPoolError 返回矿池最近一次连接失败的原因, 之后连接成功过则返回 false
+func LastPoolError(addr string) (PoolError, bool) {
+	v, ok := healths.Load(addr)
+	if !ok {
+		return PoolError{}, false
+	}
+	h := v.(*poolHealth)
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.lastError == "" || h.lastSuccess.After(h.lastErrorAt) {
+		return PoolError{}, false
+	}
+	return PoolError{Error: h.lastError, Time: h.lastErrorAt}, true
+}
+
+// PoolStatus 矿池的健康状况, 用于网页端展示
+type PoolStatus struct {
+	Address         string           `json:"address"`
+	Dials           int64            `json:"dials"`
+	DialSuccessRate float64          `json:"dial_success_rate"`
+	DialLatency     string           `json:"dial_latency"`
+	Connections     int64            `json:"connections"`
+	LastError       string           `json:"last_error"`
+	LastErrorTime   string           `json:"last_error_time"`
+	Disconnects     map[string]int64 `json:"disconnects"`
+	// Sources 源地址 -> 当前连接数, 没有配置源地址时为空
+	Sources map[string]int64 `json:"sources"`
+	// Errors 矿池错误分类 -> 次数
+	Errors     map[string]int64 `json:"errors"`
+	Accepted   int64            `json:"accepted"`
+	Rejected   int64            `json:"rejected"`
+	RejectRate float64          `json:"reject_rate"`
+}
+
+func (h *poolHealth) status() PoolStatus {
+	h.m.Lock()
+	defer h.m.Unlock()
+	s := PoolStatus{
+		Address:     h.address,
+		Dials:       h.dials,
+		DialLatency: h.dialLatency.String(),
+		Connections: h.connections.Load(),
+		LastError:   h.lastError,
+		Disconnects: make(map[string]int64, len(h.disconnects)),
+		Sources:     make(map[string]int64, len(h.sources)),
+		Errors:      make(map[string]int64, len(h.errors)),
+		Accepted:    h.accepted,
+		Rejected:    h.rejected,
+	}
+	if h.dials != 0 {
+		s.DialSuccessRate = float64(h.dials-h.dialFailed) / float64(h.dials)
+	}
+	if !h.lastErrorAt.IsZero() {
+		s.LastErrorTime = h.lastErrorAt.Format("2006-01-02 15:04:05")
+	}
+	for k, v := range h.disconnects {
+		s.Disconnects[k] = v
+	}
+	for k, v := range h.sources {
+		s.Sources[k] = v
+	}
+	for k, v := range h.errors {
+		s.Errors[k] = v
+	}
+	if total := h.accepted + h.rejected; total != 0 {
+		s.RejectRate = float64(h.rejected) / float64(total)
+	}
+	return s
+}
+
+// PoolStatuses 所有连接过的矿池的健康状况
+func PoolStatuses() []PoolStatus {
+	result := make([]PoolStatus, 0)
+	healths.Range(func(key, value interface{}) bool {
+		result = append(result, value.(*poolHealth).status())
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Address < result[j].Address
+	})
+	return result
+}
+
+// healthConn 关闭时减少矿池与源地址的连接数
+type healthConn struct {
+	net.Conn
+	once   sync.Once
+	health *poolHealth
+	source string
+}
+
+func newHealthConn(conn net.Conn, h *poolHealth, source net.IP) net.Conn {
+	h.connections.Inc()
+	c := &healthConn{Conn: conn, health: h}
+	if source != nil {
+		c.source = source.String()
+		h.addSource(c.source, 1)
+	}
+	return c
+}
+
+func (c *healthConn) Close() error {
+	c.once.Do(func() {
+		c.health.connections.Dec()
+		if c.source != "" {
+			c.health.addSource(c.source, -1)
+		}
+	})
+	return c.Conn.Close()
+}
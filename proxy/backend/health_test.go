@@ -0,0 +1,110 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDisconnectReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "closed"},
+		{io.EOF, "eof"},
+		{&net.OpError{Op: "read", Err: errors.New("read: connection reset by peer")}, "reset"},
+		{errors.New("write: broken pipe"), "broken_pipe"},
+		{errors.New("use of closed network connection"), "closed"},
+		{errors.New("unknown"), "other"},
+	}
+	for _, tt := range tests {
+		if got := disconnectReason(tt.err); got != tt.want {
+			t.Errorf("disconnectReason(%v) = %s, want %s", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestIsRejected(t *testing.T) {
+	tests := []struct {
+		result, err string
+		want        bool
+	}{
+		{"true", "null", false},
+		{"true", "", false},
+		{"false", "null", true},
+		{"null", `[23,"low difficulty share",null]`, true},
+	}
+	for _, tt := range tests {
+		if got := isRejected(json.RawMessage(tt.result), json.RawMessage(tt.err)); got != tt.want {
+			t.Errorf("isRejected(%s, %s) = %v, want %v", tt.result, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestPoolAddress_DialHealth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := dialPool(addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := healthOf(addr).connections.Load(); got != 1 {
+		t.Fatalf("connections = %d, want 1", got)
+	}
+	_ = conn.Close()
+	_ = conn.Close()
+	if got := healthOf(addr).connections.Load(); got != 0 {
+		t.Fatalf("connections = %d after close, want 0", got)
+	}
+
+	_ = l.Close()
+	if _, err := dialPool(addr, ""); err == nil {
+		t.Fatal("dial closed listener should fail")
+	}
+	status := healthOf(addr).status()
+	if status.Dials != 2 || status.DialSuccessRate != 0.5 {
+		t.Fatalf("dials = %d, success rate = %v", status.Dials, status.DialSuccessRate)
+	}
+	if _, ok := LastPoolError(addr); !ok {
+		t.Fatal("last pool error should be recorded")
+	}
+}
+
+func TestHealthOf_evict(t *testing.T) {
+	defer func(max int) { maxHealths = max }(maxHealths)
+	maxHealths = 3
+	keep := healthOf("evict-keep:3333")
+	keep.connections.Inc()
+	defer keep.connections.Dec()
+	dialing := dialHealth("evict-dialing:3333")
+	defer dialing.dialing.Dec()
+	for i := 0; i < 10; i++ {
+		healthOf(fmt.Sprintf("evict-%d:3333", i)).active.Add(int64(i))
+	}
+	if n := healthCount.Load(); n > int64(maxHealths) {
+		t.Fatalf("health records = %d, want <= %d", n, maxHealths)
+	}
+	for addr, want := range map[string]bool{"evict-keep:3333": true, "evict-dialing:3333": true, "evict-9:3333": true, "evict-0:3333": false} {
+		if _, ok := healths.Load(addr); ok != want {
+			t.Errorf("health record %s exists = %v, want %v", addr, ok, want)
+		}
+	}
+}
@@ -1,8 +1,8 @@
 package backend
 
 import (
-	"io"
 	"miner-proxy/pkg"
+	"miner-proxy/proxy/stratum"
 	"net"
 	"strings"
 	"sync"
@@ -13,22 +13,67 @@ import (
 	"go.uber.org/atomic"
 )
 
+const (
+	// reconnectTimes 每一个矿池地址重连的次数
+	reconnectTimes = 3
+	// replayTimeout 重放握手等待矿池响应的超时时间
+	replayTimeout = time.Second * 10
+)
+
 type PoolConn struct {
-	stop   sync.Once
-	addr   string
-	conn   net.Conn
-	input  <-chan []byte
-	output chan<- []byte
-	closed *atomic.Bool
+	stop    sync.Once
+	m       sync.RWMutex
+	primary string
+	addr    string
+	// key 客户端id, 用于选择源地址
+	key       string
+	backups   []string
+	conn      net.Conn
+	input     <-chan []byte
+	output    chan<- []byte
+	closed    *atomic.Bool
+	switching *atomic.Bool
+	handshake *handshake
+	// difficulty 矿机授权时建议的难度, toPool 用于按行改写矿机的数据, suggest 为最后一次建议难度的消息, 重连之后重新发送
+	difficulty DifficultyFunc
+	toPool     stratum.Splitter
+	suggest    []byte
+	// worker 改写矿工名, workers 矿机使用的矿工名 -> 发送给矿池的矿工名
+	worker  WorkerFunc
+	workers map[string]string
+	errors  *errorStats
+	// resume 矿机在其他服务端上的会话, 第一次连接矿池之后重放
+	resume *stratum.SessionState
+	// reattach 矿机重新连接到该矿池连接, 重新发送的握手在本地响应, fromMiner 只在 answerHandshake 中使用
+	reattach  *atomic.Bool
+	fromMiner stratum.Splitter
+	// changed 重连之后 conn 改变时关闭并且替换, done 在 Close 时关闭, 写入协程用来等待读取协程完成重连
+	changed chan struct{}
+	done    chan struct{}
 }
 
-func NewPoolConn(addr string, input <-chan []byte, output chan<- []byte) (*PoolConn, error) {
+// NewPoolConn 连接到矿池, key 为客户端id, backups 为矿池断开之后重连失败时依次尝试的备用矿池
+func NewPoolConn(addr, key string, backups []string, input <-chan []byte, output chan<- []byte) (*PoolConn, error) {
 	p := &PoolConn{
-		addr:   addr,
-		input:  input,
-		output: output,
-		closed: atomic.NewBool(false),
+		primary:   addr,
+		addr:      addr,
+		key:       key,
+		backups:   backups,
+		input:     input,
+		output:    output,
+		closed:    atomic.NewBool(false),
+		reattach:  atomic.NewBool(false),
+		switching: atomic.NewBool(false),
+		handshake: newHandshake(),
+		changed:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	p.handshake.onShare = func(accepted bool) {
+		healthOf(p.Address()).share(accepted)
 	}
+	p.errors = newErrorStats(p.Address, key)
+	p.handshake.onPoolError = p.errors.record
+	p.handshake.onAuthorized = p.errors.authorized
 	if err := p.init(); err != nil {
 		return nil, err
 	}
@@ -45,24 +90,31 @@ func (p *PoolConn) init() error {
 	if p.input == nil || p.output == nil {
 		return errors.New("input or output not make")
 	}
-	conn, err := net.DialTimeout("tcp", p.addr, time.Second*10)
+	conn, err := p.dial(p.addr)
 	if err != nil {
-		return errors.Wrapf(err, "dial mine pool %s error", p.addr)
+		return err
 	}
 	p.conn = conn
 	return nil
 }
 
+func (p *PoolConn) dial(addr string) (net.Conn, error) {
+	return dialPool(addr, p.key)
+}
+
 func (p *PoolConn) Close() {
 	p.stop.Do(func() {
-		if p.conn != nil {
-			_ = p.conn.Close()
+		p.closed.Store(true)
+		if conn := p.current(); conn != nil {
+			_ = conn.Close()
 		}
 		if p.output != nil {
 			close(p.output)
 		}
+		if p.done != nil {
+			close(p.done)
+		}
 	})
-	p.closed.Store(true)
 }
 
 func (p *PoolConn) IsClosed() bool {
@@ -70,43 +122,240 @@ func (p *PoolConn) IsClosed() bool {
 }
 
 func (p *PoolConn) Address() string {
+	p.m.RLock()
+	defer p.m.RUnlock()
 	return p.addr
 }
 
-func (p *PoolConn) Start() {
-	defer p.Close()
+func (p *PoolConn) Dialects() (stratum.Dialect, stratum.Dialect) {
+	return p.handshake.dialects()
+}
+
+func (p *PoolConn) Difficulty() float64 {
+	return p.handshake.currentDifficulty()
+}
+
+func (p *PoolConn) OverrideDifficulty(f DifficultyFunc) {
+	p.difficulty = f
+}
+
+func (p *PoolConn) PoolErrors() map[string]int64 {
+	return p.errors.snapshot()
+}
+
+func (p *PoolConn) OnAlert(f func(a Alert)) {
+	p.errors.m.Lock()
+	defer p.errors.m.Unlock()
+	p.errors.onAlert = f
+}
+
+func (p *PoolConn) RewriteWorker(f WorkerFunc) {
+	p.worker = f
+}
 
-	go func() {
-		defer p.Close()
-		defer func() {
-			if err := recover(); err != nil {
-				if strings.Contains(cast.ToString(err), "send on closed channel") {
-					return
-				}
+func (p *PoolConn) Workers() map[string]string {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	result := make(map[string]string, len(p.workers))
+	for k, v := range p.workers {
+		result[k] = v
+	}
+	return result
+}
+
+// rewrite 改写矿机发往矿池的数据, 没有改写规则时原样返回, 只会在 Start 中调用
+// 难度规则按照矿机原始的矿工名匹配, 之后再改写矿工名
+func (p *PoolConn) rewrite(data []byte) []byte {
+	if p.difficulty == nil && p.worker == nil {
+		return data
+	}
+	var result []byte
+	for _, line := range p.toPool.Feed(data) {
+		var suggest []byte
+		if p.difficulty != nil {
+			line, suggest = overrideDifficulty(p.difficulty, line)
+		}
+		if p.worker != nil {
+			p.m.Lock()
+			if p.workers == nil {
+				p.workers = make(map[string]string)
 			}
-		}()
-		for !p.IsClosed() {
-			data := make([]byte, 1024)
-			n, err := p.conn.Read(data)
-			switch err {
-			case nil:
-			case io.EOF:
-				return
-			default:
-				pkg.Warn("read data from miner pool error %s", err)
+			line = rewriteWorker(p.worker, p.workers, line)
+			p.m.Unlock()
+		}
+		result = append(result, line...)
+		if suggest != nil {
+			result = append(result, suggest...)
+			p.m.Lock()
+			p.suggest = suggest
+			p.m.Unlock()
+		}
+	}
+	return result
+}
+
+func (p *PoolConn) current() net.Conn {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.conn
+}
+
+// Switch 切换矿池, 关闭当前连接之后读取协程会连接新的矿池并且重放握手
+func (p *PoolConn) Switch(addr string, backups []string) {
+	p.m.Lock()
+	p.primary = addr
+	p.backups = backups
+	conn := p.conn
+	p.m.Unlock()
+	if conn == nil || p.closed.Load() {
+		return
+	}
+	p.switching.Store(true)
+	_ = conn.Close()
+}
+
+// reconnect 重新连接矿池并且重放握手, 矿机的连接保持不变, 只会在读取协程中调用
+// 返回需要转发给矿机的数据
+func (p *PoolConn) reconnect(old net.Conn) ([][]byte, error) {
+	_ = old.Close()
+
+	p.m.RLock()
+	addresses := append([]string{p.primary}, p.backups...)
+	p.m.RUnlock()
+	var lastErr error
+	for _, addr := range addresses {
+		for i := 0; i < reconnectTimes && !p.closed.Load(); i++ {
+			if i != 0 {
+				time.Sleep(time.Second * time.Duration(i))
+			}
+			conn, err := p.dial(addr)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			forward, err := p.handshake.replay(conn, replayTimeout)
+			if err != nil {
+				_ = conn.Close()
+				lastErr = errors.Wrapf(err, "replay handshake to %s error", addr)
+				continue
+			}
+			pkg.Info("reconnect mine pool %s -> %s success", p.Address(), addr)
+			p.m.RLock()
+			suggest := p.suggest
+			p.m.RUnlock()
+			if suggest != nil { // 与重放握手一样不持有锁写入矿池
+				_ = conn.SetWriteDeadline(time.Now().Add(replayTimeout))
+				_, _ = conn.Write(suggest)
+				_ = conn.SetWriteDeadline(time.Time{})
+			}
+			p.m.Lock()
+			p.conn = conn
+			p.addr = addr
+			close(p.changed)
+			p.changed = make(chan struct{})
+			p.m.Unlock()
+			if p.closed.Load() { // 重连期间被关闭
+				_ = conn.Close()
+				return nil, errors.New("pool connection closed")
+			}
+			return forward, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("pool connection closed")
+	}
+	return nil, lastErr
+}
+
+// waitReconnect 等待读取协程完成重连, 所有矿池地址都重连失败时读取协程会关闭连接
+func (p *PoolConn) waitReconnect(old net.Conn) net.Conn {
+	for {
+		p.m.RLock()
+		conn, changed := p.conn, p.changed
+		p.m.RUnlock()
+		if conn != old {
+			return conn
+		}
+		select {
+		case <-changed:
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+func (p *PoolConn) readLoop() {
+	defer p.Close()
+	defer func() {
+		if err := recover(); err != nil {
+			if strings.Contains(cast.ToString(err), "send on closed channel") {
 				return
 			}
-			p.output <- data[:n]
 		}
 	}()
+	for !p.IsClosed() {
+		conn := p.current()
+		data := make([]byte, 1024)
+		n, err := conn.Read(data)
+		if err != nil {
+			if p.IsClosed() {
+				return
+			}
+			if p.switching.CAS(true, false) {
+				pkg.Info("switch mine pool %s", p.Address())
+			} else {
+				healthOf(p.Address()).disconnected(err)
+				pkg.Warn("read data from miner pool %s error %s, reconnecting", p.Address(), err)
+			}
+			forward, err := p.reconnect(conn)
+			if err != nil {
+				pkg.Warn("reconnect mine pool error: %s", err)
+				return
+			}
+			for _, v := range forward {
+				p.output <- v
+			}
+			continue
+		}
+		p.handshake.onRead(data[:n])
+		p.output <- data[:n]
+	}
+}
+
+func (p *PoolConn) Start() {
+	defer p.Close()
+
+	if err := p.resumeSession(); err != nil {
+		pkg.Warn("resume miner session on mine pool %s error: %s", p.Address(), err)
+		return
+	}
+	go p.readLoop()
 
 	for !p.IsClosed() {
 		data, isOpen := <-p.input
 		if !isOpen {
 			break
 		}
-		if _, err := p.conn.Write(data); err != nil {
+		if p.reattach.Load() {
+			if data = p.answerHandshake(data); len(data) == 0 {
+				continue
+			}
+		}
+		if data = p.rewrite(data); len(data) == 0 {
+			continue
+		}
+		p.handshake.onWrite(data)
+		conn := p.current()
+		for conn != nil {
+			_, err := conn.Write(data)
+			if err == nil {
+				break
+			}
 			pkg.Debug("write data to miner pool error: %s", err)
+			_ = conn.Close() // 让读取协程发现连接断开并且重连
+			conn = p.waitReconnect(conn)
+		}
+		if conn == nil {
 			return
 		}
 	}
@@ -0,0 +1,43 @@
+package backend
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func TestPoolConn_waitReconnect(t *testing.T) {
+	old, _ := net.Pipe()
+	p := &PoolConn{conn: old, closed: atomic.NewBool(false), changed: make(chan struct{}), done: make(chan struct{})}
+
+	// 重连完成之前一直等待, 没有超时
+	result := make(chan net.Conn, 1)
+	go func() { result <- p.waitReconnect(old) }()
+	select {
+	case <-result:
+		t.Fatal("waitReconnect() returned before reconnect")
+	case <-time.After(time.Millisecond * 100):
+	}
+	conn, _ := net.Pipe()
+	p.m.Lock()
+	p.conn = conn
+	close(p.changed)
+	p.changed = make(chan struct{})
+	p.m.Unlock()
+	if got := <-result; got != conn {
+		t.Fatalf("waitReconnect() = %v, want new connection", got)
+	}
+
+	go func() { result <- p.waitReconnect(conn) }()
+	p.Close()
+	select {
+	case got := <-result:
+		if got != nil {
+			t.Fatalf("waitReconnect() = %v after Close, want nil", got)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("waitReconnect() not returned after Close")
+	}
+}
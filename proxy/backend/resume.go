@@ -0,0 +1,191 @@
+package backend
+
+import (
+	"encoding/json"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/stratum"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+)
+
+// Resumer 支持恢复矿机会话的矿池连接
+type Resumer interface {
+	// Resume 需要在 Start 之前调用, 矿池连接建立之后先重放矿机的握手, 握手的响应不会转发给矿机
+	Resume(state stratum.SessionState) error
+}
+
+// Reattacher 支持矿机断开之后重新连接到还在运行的矿池连接
+type Reattacher interface {
+	// Reattach 矿机重新连接之后调用, 矿机重新发送的握手在本地响应, 之后下发矿池最后的难度与任务
+	// 返回 false 时该连接不支持重新连接
+	Reattach() bool
+}
+
+// SessionRecorder 记录矿机的握手与矿池下发的 extranonce, 用于在其他服务端上恢复矿机的会话
+type SessionRecorder struct {
+	h *handshake
+}
+
+func NewSessionRecorder() *SessionRecorder {
+	return &SessionRecorder{h: newHandshake()}
+}
+
+// OnMiner 记录矿机 -> 矿池的数据
+func (r *SessionRecorder) OnMiner(data []byte) {
+	r.h.onWrite(data)
+}
+
+// OnPool 记录矿池 -> 矿机的数据
+func (r *SessionRecorder) OnPool(data []byte) {
+	r.h.onRead(data)
+}
+
+// State 返回当前的会话, 矿机还没有握手时返回 false
+func (r *SessionRecorder) State() (stratum.SessionState, bool) {
+	r.h.m.Lock()
+	defer r.h.m.Unlock()
+	if len(r.h.requests) == 0 {
+		return stratum.SessionState{}, false
+	}
+	state := stratum.SessionState{
+		Extranonce1:          r.h.extranonce1,
+		Extranonce2Size:      r.h.extranonce2Size,
+		ExtranonceSubscribed: r.h.extranonceSubscribed,
+	}
+	for _, v := range r.h.requests {
+		state.Requests = append(state.Requests, v.Encode())
+	}
+	return state, true
+}
+
+// seed 使用矿机已有的会话初始化握手, 之后通过 replay 在新的矿池连接上重放
+func (h *handshake) seed(data []byte, state stratum.SessionState) {
+	h.onWrite(data)
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.pending = make(map[string]string)
+	h.extranonce1, h.extranonce2Size = state.Extranonce1, state.Extranonce2Size
+	h.extranonceSubscribed = h.extranonceSubscribed || state.ExtranonceSubscribed
+}
+
+func (p *PoolConn) Resume(state stratum.SessionState) error {
+	if len(state.Requests) == 0 {
+		return errors.New("empty session")
+	}
+	p.resume = &state
+	return nil
+}
+
+// resumeSession 在第一个矿池连接上重放恢复的会话, 并且将需要转发给矿机的数据发送给矿机, 只会在 Start 中调用
+func (p *PoolConn) resumeSession() (err error) {
+	if p.resume == nil {
+		return nil
+	}
+	var data []byte
+	for _, v := range p.resume.Requests {
+		data = append(data, v...)
+	}
+	p.handshake.seed(p.rewrite(data), *p.resume)
+	p.resume = nil
+	forward, err := p.handshake.replay(p.current(), replayTimeout)
+	if err != nil {
+		return err
+	}
+	p.m.Lock()
+	if p.suggest != nil {
+		_, _ = p.conn.Write(p.suggest)
+	}
+	p.m.Unlock()
+	pkg.Info("resume miner session on mine pool %s", p.Address())
+	defer func() {
+		if recover() != nil { // 矿机在恢复期间断开
+			err = errors.New("pool connection closed")
+		}
+	}()
+	for _, v := range forward {
+		p.output <- v
+	}
+	return nil
+}
+
+func (p *PoolConn) Reattach() bool {
+	p.reattach.Store(true)
+	return true
+}
+
+// sameWorker 矿机重新发送的授权与矿池连接上已经授权的矿工名是否一致
+func (p *PoolConn) sameWorker(msg stratum.Message) bool {
+	var params []interface{}
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) == 0 {
+		return false
+	}
+	worker := cast.ToString(params[0])
+	if p.worker != nil {
+		if rewritten, ok := p.worker(worker); ok {
+			worker = rewritten
+		}
+	}
+	authorized, ok := p.handshake.authorizedWorker()
+	return ok && worker == authorized
+}
+
+// answerHandshake 矿机重新连接之后在本地响应订阅与授权, 矿池连接已经完成了握手, 只会在 Start 中调用
+// 授权之后或者矿机开始提交份额时结束, 返回需要发送给矿池的数据
+func (p *PoolConn) answerHandshake(data []byte) (result []byte) {
+	defer func() {
+		if recover() != nil { // 矿机在恢复期间断开
+			result = nil
+		}
+	}()
+	for _, line := range p.fromMiner.Feed(data) {
+		msg, err := stratum.Decode(line)
+		if err != nil || !p.reattach.Load() {
+			result = append(result, line...)
+			continue
+		}
+		switch msg.Method {
+		case methodSubscribe:
+			extranonce1, extranonce2Size := p.handshake.extranonce()
+			subscribe, _ := json.Marshal([]interface{}{
+				[][]string{{methodSetDifficulty, "1"}, {methodNotify, "1"}},
+				extranonce1, extranonce2Size,
+			})
+			p.output <- stratum.Message{Id: msg.Id, Result: subscribe}.Encode()
+		case methodExtranonceSubscribe:
+			p.output <- stratum.Message{Id: msg.Id, Result: json.RawMessage("true")}.Encode()
+		case methodAuthorize, methodEthSubmitLogin:
+			if !p.sameWorker(msg) { // 不是之前的矿机, 让矿机重新登录
+				pkg.Warn("miner reattached to mine pool %s with another worker, close the session", p.Address())
+				p.Close()
+				return nil
+			}
+			p.output <- stratum.Message{Id: msg.Id, Result: json.RawMessage("true")}.Encode()
+			p.reattach.Store(false)
+			for _, v := range p.handshake.lastJob() {
+				p.output <- v
+			}
+			pkg.Info("miner reattached to mine pool %s", p.Address())
+		default:
+			if isSubmitMethod(msg.Method) {
+				p.reattach.Store(false)
+			}
+			result = append(result, line...)
+		}
+	}
+	if !p.reattach.Load() {
+		result = append(result, p.fromMiner.Pending()...)
+		p.fromMiner.Reset()
+	}
+	return result
+}
+
+// Resume 协议转换时矿机的握手与矿池的握手不同, 无法恢复
+func (c *EthTranslateConn) Resume(_ stratum.SessionState) error {
+	return errors.New("eth translate connection does not support session resume")
+}
+
+// Reattach 协议转换的状态在 EthTranslateConn 中, 内部的矿池连接无法在本地响应矿机的握手
+func (c *EthTranslateConn) Reattach() bool {
+	return false
+}
@@ -0,0 +1,161 @@
+package backend
+
+import (
+	"miner-proxy/proxy/stratum"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolConn_Resume(t *testing.T) {
+	tests := []struct {
+		name        string
+		extranonce1 string
+		subscribe   bool
+		want        string
+	}{
+		{"same extranonce", "aabb", false, "mining.set_difficulty"},
+		{"set extranonce", "ccdd", true, "mining.set_extranonce"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := NewSessionRecorder()
+			recorder.OnMiner([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n"))
+			if tt.subscribe {
+				recorder.OnMiner([]byte(`{"id":2,"method":"mining.extranonce.subscribe","params":[]}` + "\n"))
+			}
+			recorder.OnMiner([]byte(`{"id":3,"method":"mining.authorize","params":["w","x"]}` + "\n"))
+			recorder.OnPool([]byte(`{"id":1,"result":[[["mining.notify","1"]],"aabb",4],"error":null}` + "\n"))
+			state, ok := recorder.State()
+			if !ok || state.Extranonce1 != "aabb" || state.Extranonce2Size != 4 {
+				t.Fatalf("State() = %+v, %v", state, ok)
+			}
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				fakePool(conn, tt.extranonce1)
+			}()
+
+			input, output := make(chan []byte), make(chan []byte)
+			p, err := NewPoolConn(l.Addr().String(), "", nil, input, output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			if err := p.Resume(state); err != nil {
+				t.Fatal(err)
+			}
+			go p.Start()
+
+			// 握手的响应不会转发给矿机
+			if msg := readMessage(t, output); msg.Method != tt.want {
+				t.Fatalf("first message = %+v, want %s", msg, tt.want)
+			}
+			go func() {
+				input <- []byte(`{"id":4,"method":"mining.submit","params":["w","1","00","00","00"]}` + "\n")
+			}()
+			for {
+				msg := readMessage(t, output)
+				if msg.IsResponse() {
+					if msg.IdKey() != "4" {
+						t.Fatalf("unexpected response %+v", msg)
+					}
+					break
+				}
+			}
+		})
+	}
+
+	var e EthTranslateConn
+	if err := e.Resume(stratum.SessionState{Requests: [][]byte{[]byte("{}\n")}}); err == nil {
+		t.Errorf("EthTranslateConn.Resume() should fail")
+	}
+}
+
+func TestPoolConn_Reattach(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		fakePool(conn, "aabb")
+	}()
+	input, output := make(chan []byte), make(chan []byte)
+	p, err := NewPoolConn(l.Addr().String(), "", nil, input, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	go p.Start()
+
+	handshake := func(subscribeId, authorizeId, worker string) {
+		go func() {
+			input <- []byte(`{"id":` + subscribeId + `,"method":"mining.subscribe","params":[]}` + "\n" +
+				`{"id":` + authorizeId + `,"method":"mining.authorize","params":["` + worker + `","x"]}` + "\n")
+		}()
+	}
+	// 矿池的多个响应可能在一次读取中
+	var splitter stratum.Splitter
+	var lines [][]byte
+	expect := func(want ...string) []stratum.Message {
+		var result []stratum.Message
+		for _, w := range want {
+			for len(lines) == 0 {
+				select {
+				case data := <-output:
+					lines = splitter.Feed(data)
+				case <-time.After(time.Second * 3):
+					t.Fatalf("wait %s timeout", w)
+				}
+			}
+			msg, _ := stratum.Decode(lines[0])
+			lines = lines[1:]
+			if msg.IdKey() != w && msg.Method != w {
+				t.Fatalf("message = %+v, want %s", msg, w)
+			}
+			result = append(result, msg)
+		}
+		return result
+	}
+	handshake("1", "2", "w")
+	expect("1", "mining.set_difficulty", "2")
+
+	// 矿机重新连接之后的握手在本地响应, 然后下发最后的难度
+	if !p.Reattach() {
+		t.Fatal("Reattach() = false")
+	}
+	handshake("5", "6", "w")
+	if msg := expect("5", "6", "mining.set_difficulty")[0]; !strings.Contains(string(msg.Result), `"aabb",4`) {
+		t.Fatalf("subscribe response = %+v", msg)
+	}
+
+	// 使用其他矿工名授权的矿机不能使用该矿池连接
+	p.Reattach()
+	handshake("7", "8", "other")
+	expect("7")
+	select {
+	case _, ok := <-output:
+		if ok {
+			t.Fatal("authorize with another worker should not be answered")
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("pool connection should be closed")
+	}
+	if !p.IsClosed() {
+		t.Fatal("pool connection should be closed")
+	}
+}
@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"miner-proxy/pkg"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/atomic"
+)
+
+const (
+	// SourceRoundRobin 依次使用每一个源地址
+	SourceRoundRobin = "round_robin"
+	// SourceLeastConn 使用到该矿池连接数最少的源地址
+	SourceLeastConn = "least_conn"
+	// SourceSticky 同一个客户端总是使用同一个源地址
+	SourceSticky = "sticky"
+)
+
+var (
+	// sources 连接矿池使用的源地址, 为空时使用默认路由
+	sources *sourcePool
+)
+
+type sourcePool struct {
+	ips      []net.IP
+	strategy string
+	next     *atomic.Uint64
+}
+
+// SetSourceAddresses 设置连接矿池使用的本地源地址与选择策略
+func SetSourceAddresses(ips []string, strategy string) error {
+	if len(ips) == 0 {
+		sources = nil
+		return nil
+	}
+	switch strategy {
+	case "":
+		strategy = SourceRoundRobin
+	case SourceRoundRobin, SourceLeastConn, SourceSticky:
+	default:
+		return errors.Errorf("unsupported source strategy %s", strategy)
+	}
+	s := &sourcePool{strategy: strategy, next: atomic.NewUint64(0)}
+	for _, v := range ips {
+		ip := net.ParseIP(strings.TrimSpace(v))
+		if ip == nil {
+			return errors.Errorf("invalid source ip %s", v)
+		}
+		s.ips = append(s.ips, ip)
+	}
+	sources = s
+	return nil
+}
+
+// pick 为连接矿池选择源地址, key 为 sticky 策略使用的客户端id, 没有配置源地址时返回 nil
+func (s *sourcePool) pick(h *poolHealth, key string) net.IP {
+	if s == nil {
+		return nil
+	}
+	switch s.strategy {
+	case SourceSticky:
+		if key != "" {
+			return s.ips[pkg.Crc32IEEE([]byte(key))%uint32(len(s.ips))]
+		}
+	case SourceLeastConn:
+		counts := h.sourceConnections()
+		best := s.ips[0]
+		for _, ip := range s.ips[1:] {
+			if counts[ip.String()] < counts[best.String()] {
+				best = ip
+			}
+		}
+		return best
+	}
+	return s.ips[(s.next.Inc()-1)%uint64(len(s.ips))]
+}
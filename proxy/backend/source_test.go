@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSourcePool_pick(t *testing.T) {
+	defer SetSourceAddresses(nil, "")
+	h := healthOf("source.pool.com:3333")
+	tests := []struct {
+		strategy string
+		key      string
+		want     []string
+	}{
+		{strategy: SourceRoundRobin, want: []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"}},
+		{strategy: SourceSticky, key: "client", want: []string{"127.0.0.2", "127.0.0.2", "127.0.0.2"}},
+		{strategy: SourceLeastConn, want: []string{"127.0.0.1", "127.0.0.2", "127.0.0.1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			if err := SetSourceAddresses([]string{"127.0.0.1", "127.0.0.2"}, tt.strategy); err != nil {
+				t.Fatal(err)
+			}
+			for i, want := range tt.want {
+				ip := sources.pick(h, tt.key)
+				if ip.String() != want {
+					t.Fatalf("pick() #%d = %s, want %s", i, ip, want)
+				}
+				h.addSource(ip.String(), 1)
+			}
+			for k, v := range h.sourceConnections() {
+				h.addSource(k, -v)
+			}
+		})
+	}
+
+	if err := SetSourceAddresses([]string{"127.0.0.1"}, "random"); err == nil {
+		t.Error("unsupported strategy should fail")
+	}
+	if err := SetSourceAddresses([]string{"localhost"}, ""); err == nil {
+		t.Error("invalid ip should fail")
+	}
+}
+
+func TestPoolAddress_DialSource(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remote := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		remote <- conn.RemoteAddr().(*net.TCPAddr).IP.String()
+		_ = conn.Close()
+	}()
+
+	if err := SetSourceAddresses([]string{"127.0.0.2"}, SourceSticky); err != nil {
+		t.Fatal(err)
+	}
+	defer SetSourceAddresses(nil, "")
+	conn, err := dialPool(l.Addr().String(), "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-remote; got != "127.0.0.2" {
+		t.Errorf("remote ip = %s, want 127.0.0.2", got)
+	}
+	if got := healthOf(l.Addr().String()).status().Sources["127.0.0.2"]; got != 1 {
+		t.Errorf("source connections = %d, want 1", got)
+	}
+	_ = conn.Close()
+	if got := healthOf(l.Addr().String()).status().Sources; len(got) != 0 {
+		t.Errorf("source connections after close = %v", got)
+	}
+}
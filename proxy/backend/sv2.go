@@ -0,0 +1,531 @@
+package backend
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/stratum"
+	"miner-proxy/proxy/sv2"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+	"go.uber.org/atomic"
+)
+
+const (
+	// SV2Scheme 使用 stratum v2 协议的矿池地址前缀, 例如 stratum2+tcp://worker@host:port/authority_pubkey
+	SV2Scheme = "stratum2+tcp://"
+	// sv2DefaultIdentity 矿池地址中没有指定用户时打开通道使用的身份
+	sv2DefaultIdentity = "miner-proxy"
+	// sv2Timeout 建立连接与打开通道的超时时间
+	sv2Timeout = time.Second * 10
+	// sv2NominalHashRate 打开通道时声明的算力, 矿池会根据份额调整难度
+	sv2NominalHashRate = 1e12
+	// sv2VersionRollingMask BIP320 允许矿机修改的 version 位
+	sv2VersionRollingMask uint32 = 0x1fffe000
+	// sv2MaxJobs 最多保留的任务数量
+	sv2MaxJobs      = 64
+	methodConfigure = "mining.configure"
+)
+
+var (
+	// diff1Target 难度为1时的 target
+	diff1Target, _ = new(big.Int).SetString("00000000ffff0000000000000000000000000000000000000000000000000000", 16)
+)
+
+// IsSV2Address 矿池地址是否使用 stratum v2 协议
+func IsSV2Address(addr string) bool {
+	return strings.HasPrefix(strings.ToLower(addr), SV2Scheme)
+}
+
+// parseSV2Address 解析 stratum2+tcp://[user@]host:port/authority_pubkey[?insecure=true]
+// authority_pubkey 为矿池公布的 base58check 或者 hex 编码的公钥, 只有设置 insecure 时才可以省略, 此时不校验矿池的身份
+func parseSV2Address(addr string) (host, identity string, authority []byte, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", nil, errors.Wrapf(err, "parse stratum v2 address %s error", addr)
+	}
+	if u.Host == "" {
+		return "", "", nil, errors.Errorf("stratum v2 address %s missing host", addr)
+	}
+	identity = sv2DefaultIdentity
+	if u.User != nil && u.User.Username() != "" {
+		identity = u.User.Username()
+	}
+	if key := strings.Trim(u.Path, "/"); key != "" {
+		authority, err = sv2.ParseAuthorityKey(key)
+		if err != nil {
+			return "", "", nil, errors.Wrapf(err, "invalid stratum v2 authority public key %s", key)
+		}
+	} else if !cast.ToBool(u.Query().Get("insecure")) {
+		return "", "", nil, errors.Errorf("stratum v2 address %s missing authority public key, add ?insecure=true to skip verification", addr)
+	}
+	return u.Host, identity, authority, nil
+}
+
+// SV2Conn 矿池一侧使用 stratum v2 的扩展通道, 矿机一侧仍然是 stratum v1
+// 标准通道只下发 merkle root, stratum v1 矿机需要自己拼接 coinbase, 所以这里使用扩展通道
+// 通道的 extranonce_prefix 作为矿机的 extranonce1, 通道在连接时以矿池地址中的用户打开,
+// 矿机的 mining.authorize 在本地响应; 矿池断开之后不会重连, 由矿机重新连接
+// 矿机的矿工名不会发送给矿池, 矿池只能看到地址中的用户, 无法统计每一个矿工的算力
+type SV2Conn struct {
+	stop sync.Once
+	// m 保护通道状态, 不能持有 m 等待矿机读取数据; done 关闭之后不再等待矿机读取数据
+	m        sync.Mutex
+	done     chan struct{}
+	addr     string
+	conn     *sv2.Conn
+	input    <-chan []byte
+	output   chan<- []byte
+	closed   *atomic.Bool
+	splitter stratum.Splitter
+
+	channelId      uint32
+	extranonce     []byte
+	extranonceSize int
+	difficulty     float64
+	authorized     bool
+	versionMask    uint32
+	prevHash       *sv2.SetNewPrevHash
+	jobs           map[uint32]*sv2.NewExtendedMiningJob
+	seq            uint32
+	// pending 份额的序号 -> 矿机请求 id
+	pending map[uint32]json.RawMessage
+}
+
+// NewSV2Conn 连接 stratum v2 矿池, 完成 noise 握手与 SetupConnection 并且打开扩展通道
+func NewSV2Conn(addr, key string, input <-chan []byte, output chan<- []byte) (*SV2Conn, error) {
+	if input == nil || output == nil {
+		return nil, errors.New("input or output not make")
+	}
+	host, identity, authority, err := parseSV2Address(addr)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := PoolAddress{Raw: addr, Scheme: strings.TrimSuffix(SV2Scheme, "://"), Host: host}.Dial(key)
+	if err != nil {
+		return nil, err
+	}
+	c := &SV2Conn{
+		addr:    addr,
+		input:   input,
+		output:  output,
+		closed:  atomic.NewBool(false),
+		done:    make(chan struct{}),
+		jobs:    make(map[uint32]*sv2.NewExtendedMiningJob),
+		pending: make(map[uint32]json.RawMessage),
+	}
+	_ = raw.SetDeadline(time.Now().Add(sv2Timeout))
+	if err := c.setup(raw, host, identity, authority); err != nil {
+		_ = raw.Close()
+		err = errors.Wrapf(err, "setup stratum v2 connection to %s error", host)
+		healthOf(addr).setupFailed(err)
+		return nil, err
+	}
+	_ = raw.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *SV2Conn) setup(raw net.Conn, host, identity string, authority []byte) error {
+	conn, err := sv2.Client(raw, authority)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+
+	hostname, port, _ := net.SplitHostPort(host)
+	setup := &sv2.SetupConnection{
+		Protocol:     sv2.ProtocolMining,
+		MinVersion:   2,
+		MaxVersion:   2,
+		Flags:        sv2.FlagRequiresVersionRolling,
+		EndpointHost: hostname,
+		EndpointPort: cast.ToUint16(port),
+		Vendor:       "miner-proxy",
+	}
+	if err := conn.WriteFrame(sv2.Encode(setup)); err != nil {
+		return err
+	}
+	f, err := conn.ReadFrame()
+	if err != nil {
+		return err
+	}
+	switch f.MsgType {
+	case sv2.MsgSetupConnectionSuccess:
+	case sv2.MsgSetupConnectionError:
+		var e sv2.SetupConnectionError
+		_ = sv2.Decode(f, &e)
+		return errors.Errorf("mine pool reject setup connection: %s", e.ErrorCode)
+	default:
+		return errors.Errorf("unexpected sv2 message %#x", f.MsgType)
+	}
+
+	open := &sv2.OpenExtendedMiningChannel{
+		RequestId:       1,
+		UserIdentity:    identity,
+		NominalHashRate: sv2NominalHashRate,
+		MaxTarget:       []byte(strings.Repeat("\xff", 32)),
+	}
+	if err := conn.WriteFrame(sv2.Encode(open)); err != nil {
+		return err
+	}
+	// 通道打开之前矿池可能已经下发任务, 这里只处理通道相关的响应
+	for {
+		f, err := conn.ReadFrame()
+		if err != nil {
+			return err
+		}
+		switch f.MsgType {
+		case sv2.MsgOpenExtendedMiningChannelSuccess:
+			var success sv2.OpenExtendedMiningChannelSuccess
+			if err := sv2.Decode(f, &success); err != nil {
+				return err
+			}
+			c.channelId = success.ChannelId
+			c.extranonce = success.ExtranoncePrefix
+			c.extranonceSize = int(success.ExtranonceSize)
+			c.difficulty = target2Difficulty(success.Target)
+			return nil
+		case sv2.MsgOpenMiningChannelError:
+			var e sv2.OpenMiningChannelError
+			_ = sv2.Decode(f, &e)
+			return errors.Errorf("mine pool reject open channel: %s", e.ErrorCode)
+		default:
+			c.handlePool(f)
+		}
+	}
+}
+
+// target2Difficulty 将小端序的 U256 target 转换为 stratum v1 的难度
+func target2Difficulty(target []byte) float64 {
+	be := make([]byte, len(target))
+	for i, v := range target {
+		be[len(target)-1-i] = v
+	}
+	t := new(big.Int).SetBytes(be)
+	if t.Sign() == 0 {
+		return 0
+	}
+	result, _ := new(big.Float).Quo(new(big.Float).SetInt(diff1Target), new(big.Float).SetInt(t)).Float64()
+	return result
+}
+
+// swapWords 区块头字节序的 prevhash 转换为 stratum v1 的格式, 每4个字节翻转一次
+func swapWords(data []byte) []byte {
+	result := make([]byte, len(data))
+	for i := 0; i+4 <= len(data); i += 4 {
+		result[i], result[i+1], result[i+2], result[i+3] = data[i+3], data[i+2], data[i+1], data[i]
+	}
+	return result
+}
+
+func (c *SV2Conn) Close() {
+	c.stop.Do(func() {
+		c.closed.Store(true)
+		close(c.done)
+		close(c.output)
+		if c.conn != nil {
+			_ = c.conn.Close()
+		}
+	})
+}
+
+func (c *SV2Conn) IsClosed() bool {
+	return c.closed.Load()
+}
+
+func (c *SV2Conn) Address() string {
+	return c.addr
+}
+
+func (c *SV2Conn) Difficulty() float64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.difficulty
+}
+
+func (c *SV2Conn) Dialects() (stratum.Dialect, stratum.Dialect) {
+	return stratum.DialectStratum, stratum.DialectStratumV2
+}
+
+// sendMiner 发送数据给矿机, 连接关闭之后直接丢弃
+func (c *SV2Conn) sendMiner(data []byte) {
+	defer func() {
+		_ = recover() // 矿机连接已经关闭
+	}()
+	if c.closed.Load() {
+		return
+	}
+	select {
+	case c.output <- data:
+	case <-c.done:
+	}
+}
+
+// reply 生成矿机请求的响应
+func reply(id json.RawMessage, result interface{}, e interface{}) []byte {
+	msg := stratum.Message{Id: id}
+	msg.Result, _ = json.Marshal(result)
+	msg.Error, _ = json.Marshal(e)
+	return msg.Encode()
+}
+
+func (c *SV2Conn) writePool(m sv2.Message) {
+	if err := c.conn.WriteFrame(sv2.Encode(m)); err != nil {
+		pkg.Warn("write data to stratum v2 pool %s error: %s", c.addr, err)
+		c.Close()
+	}
+}
+
+// notify 生成 stratum v1 的 mining.notify, 调用者需要持有 m 锁
+func (c *SV2Conn) notify(job *sv2.NewExtendedMiningJob, ntime uint32, clean bool) []byte {
+	merkle := make([]string, 0, len(job.MerklePath))
+	for _, v := range job.MerklePath {
+		merkle = append(merkle, hex.EncodeToString(v))
+	}
+	msg := stratum.NewNotify(methodNotify,
+		fmt.Sprintf("%x", job.JobId),
+		hex.EncodeToString(swapWords(c.prevHash.PrevHash)),
+		hex.EncodeToString(job.CoinbasePrefix),
+		hex.EncodeToString(job.CoinbaseSuffix),
+		merkle,
+		fmt.Sprintf("%08x", job.Version),
+		fmt.Sprintf("%08x", c.prevHash.Nbits),
+		fmt.Sprintf("%08x", ntime),
+		clean,
+	)
+	return msg.Encode()
+}
+
+// handlePool 处理矿池的消息, 返回需要发送给矿机的数据, 调用者需要持有 m 锁
+func (c *SV2Conn) handlePool(f sv2.Frame) [][]byte {
+	var lines [][]byte
+	switch f.MsgType {
+	case sv2.MsgSetTarget:
+		var m sv2.SetTarget
+		if err := sv2.Decode(f, &m); err != nil {
+			return nil
+		}
+		c.difficulty = target2Difficulty(m.MaximumTarget)
+		lines = append(lines, stratum.NewNotify(methodSetDifficulty, c.difficulty).Encode())
+	case sv2.MsgNewExtendedMiningJob:
+		var m sv2.NewExtendedMiningJob
+		if err := sv2.Decode(f, &m); err != nil {
+			return nil
+		}
+		if len(c.jobs) > sv2MaxJobs {
+			c.jobs = make(map[uint32]*sv2.NewExtendedMiningJob)
+		}
+		c.jobs[m.JobId] = &m
+		if m.MinNtime != nil && c.prevHash != nil { // 基于当前 prevhash 的任务立即下发
+			ntime := *m.MinNtime
+			if ntime < c.prevHash.MinNtime {
+				ntime = c.prevHash.MinNtime
+			}
+			lines = append(lines, c.notify(&m, ntime, false))
+		}
+	case sv2.MsgSetNewPrevHash:
+		var m sv2.SetNewPrevHash
+		if err := sv2.Decode(f, &m); err != nil {
+			return nil
+		}
+		c.prevHash = &m
+		if job, ok := c.jobs[m.JobId]; ok {
+			lines = append(lines, c.notify(job, m.MinNtime, true))
+		}
+	case sv2.MsgSubmitSharesSuccess:
+		var m sv2.SubmitSharesSuccess
+		if err := sv2.Decode(f, &m); err != nil {
+			return nil
+		}
+		for seq, id := range c.pending {
+			if seq <= m.LastSequenceNumber {
+				delete(c.pending, seq)
+				healthOf(c.addr).share(true)
+				lines = append(lines, stratum.Message{Id: id, Result: json.RawMessage("true"), Error: json.RawMessage("null")}.Encode())
+			}
+		}
+	case sv2.MsgSubmitSharesError:
+		var m sv2.SubmitSharesError
+		if err := sv2.Decode(f, &m); err != nil {
+			return nil
+		}
+		if id, ok := c.pending[m.SequenceNumber]; ok {
+			delete(c.pending, m.SequenceNumber)
+			healthOf(c.addr).share(false)
+			e, _ := json.Marshal([]interface{}{20, m.ErrorCode, nil})
+			lines = append(lines, stratum.Message{Id: id, Result: json.RawMessage("false"), Error: e}.Encode())
+		}
+	default:
+		pkg.Debug("ignore stratum v2 message %#x from %s", f.MsgType, c.addr)
+	}
+	if !c.authorized { // 授权之前只更新状态
+		return nil
+	}
+	return lines
+}
+
+// latest 矿机授权之后下发当前的难度与任务, 调用者需要持有 m 锁
+func (c *SV2Conn) latest() [][]byte {
+	lines := [][]byte{stratum.NewNotify(methodSetDifficulty, c.difficulty).Encode()}
+	if c.prevHash == nil {
+		return lines
+	}
+	if job, ok := c.jobs[c.prevHash.JobId]; ok {
+		lines = append(lines, c.notify(job, c.prevHash.MinNtime, true))
+	}
+	return lines
+}
+
+func parseHexUint32(s string) (uint32, error) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 32)
+	return uint32(v), err
+}
+
+// submit 将 mining.submit 转换为 SubmitSharesExtended, 调用者需要持有 m 锁
+func (c *SV2Conn) submit(msg stratum.Message) (*sv2.SubmitSharesExtended, error) {
+	var params []string
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) < 5 {
+		return nil, errors.New("invalid params")
+	}
+	jobId, err := parseHexUint32(params[1])
+	if err != nil {
+		return nil, errors.New("job not found")
+	}
+	job, ok := c.jobs[jobId]
+	if !ok {
+		return nil, errors.New("job not found")
+	}
+	extranonce, err := hex.DecodeString(params[2])
+	if err != nil || len(extranonce) != c.extranonceSize {
+		return nil, errors.New("invalid extranonce2")
+	}
+	ntime, err := parseHexUint32(params[3])
+	if err != nil {
+		return nil, errors.New("invalid ntime")
+	}
+	nonce, err := parseHexUint32(params[4])
+	if err != nil {
+		return nil, errors.New("invalid nonce")
+	}
+	version := job.Version
+	if len(params) > 5 && job.VersionRollingAllowed {
+		bits, err := parseHexUint32(params[5])
+		if err != nil {
+			return nil, errors.New("invalid version bits")
+		}
+		version = (version &^ c.versionMask) | (bits & c.versionMask)
+	}
+	c.seq++
+	c.pending[c.seq] = msg.Id
+	return &sv2.SubmitSharesExtended{
+		ChannelId:      c.channelId,
+		SequenceNumber: c.seq,
+		JobId:          jobId,
+		Nonce:          nonce,
+		Ntime:          ntime,
+		Version:        version,
+		Extranonce:     extranonce,
+	}, nil
+}
+
+// handleMiner 处理矿机的消息, 返回需要发送给矿机的数据, 调用者需要持有 m 锁
+func (c *SV2Conn) handleMiner(line []byte) [][]byte {
+	msg, err := stratum.Decode(line)
+	if err != nil {
+		pkg.Debug("stratum v2 session receive invalid data: %s", strings.TrimSpace(string(line)))
+		return nil
+	}
+	switch msg.Method {
+	case methodSubscribe:
+		return [][]byte{reply(msg.Id, []interface{}{
+			[][]string{{methodSetDifficulty, "1"}, {methodNotify, "1"}},
+			hex.EncodeToString(c.extranonce), c.extranonceSize,
+		}, nil)}
+	case methodExtranonceSubscribe:
+		return [][]byte{reply(msg.Id, true, nil)}
+	case methodConfigure:
+		var params []json.RawMessage
+		_ = json.Unmarshal(msg.Params, &params)
+		mask := sv2VersionRollingMask
+		if len(params) > 1 {
+			var options map[string]interface{}
+			_ = json.Unmarshal(params[1], &options)
+			if v, ok := options["version-rolling.mask"].(string); ok {
+				if m, err := parseHexUint32(v); err == nil {
+					mask &= m
+				}
+			}
+		}
+		c.versionMask = mask
+		return [][]byte{reply(msg.Id, map[string]interface{}{
+			"version-rolling":      true,
+			"version-rolling.mask": fmt.Sprintf("%08x", mask),
+		}, nil)}
+	case methodAuthorize:
+		result := [][]byte{reply(msg.Id, true, nil)}
+		if !c.authorized {
+			c.authorized = true
+			result = append(result, c.latest()...)
+		}
+		return result
+	case methodSubmit:
+		share, err := c.submit(msg)
+		if err != nil {
+			return [][]byte{reply(msg.Id, false, []interface{}{20, err.Error(), nil})}
+		}
+		c.writePool(share)
+		return nil
+	case "": // 矿机对矿池请求的响应
+		return nil
+	default:
+		return [][]byte{reply(msg.Id, nil, []interface{}{20, "unsupported method", nil})}
+	}
+}
+
+func (c *SV2Conn) readLoop() {
+	defer c.Close()
+	for !c.IsClosed() {
+		f, err := c.conn.ReadFrame()
+		if err != nil {
+			if !c.IsClosed() {
+				healthOf(c.addr).disconnected(err)
+				pkg.Warn("read data from stratum v2 pool %s error: %s", c.addr, err)
+			}
+			return
+		}
+		c.m.Lock()
+		lines := c.handlePool(f)
+		c.m.Unlock()
+		for _, v := range lines {
+			c.sendMiner(v)
+		}
+	}
+}
+
+func (c *SV2Conn) Start() {
+	defer c.Close()
+	go c.readLoop()
+	for !c.IsClosed() {
+		data, isOpen := <-c.input
+		if !isOpen {
+			return
+		}
+		for _, line := range c.splitter.Feed(data) {
+			c.m.Lock()
+			lines := c.handleMiner(line)
+			c.m.Unlock()
+			for _, v := range lines {
+				c.sendMiner(v)
+			}
+		}
+	}
+}
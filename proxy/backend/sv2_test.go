@@ -0,0 +1,143 @@
+package backend
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"miner-proxy/proxy/sv2"
+	"net"
+	"testing"
+	"time"
+)
+
+// littleEndian256 将 big.Int 转换为小端序的 U256
+func littleEndian256(v *big.Int) []byte {
+	be := v.FillBytes(make([]byte, 32))
+	result := make([]byte, 32)
+	for i := range be {
+		result[31-i] = be[i]
+	}
+	return result
+}
+
+func TestSV2Conn(t *testing.T) {
+	authority, err := sv2.GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	static, err := sv2.GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := sv2.NewCertificate(authority.Private, static.XOnly(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	prevHash := make([]byte, 32)
+	for i := range prevHash {
+		prevHash[i] = byte(i)
+	}
+	shares := make(chan sv2.SubmitSharesExtended, 1)
+	identities := make(chan string, 1)
+	go func() {
+		raw, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer raw.Close()
+		conn, err := sv2.Server(raw, static, cert)
+		if err != nil {
+			return
+		}
+		for {
+			f, err := conn.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f.MsgType {
+			case sv2.MsgSetupConnection:
+				_ = conn.WriteFrame(sv2.Encode(&sv2.SetupConnectionSuccess{UsedVersion: 2}))
+			case sv2.MsgOpenExtendedMiningChannel:
+				var open sv2.OpenExtendedMiningChannel
+				_ = sv2.Decode(f, &open)
+				identities <- open.UserIdentity
+				_ = conn.WriteFrame(sv2.Encode(&sv2.OpenExtendedMiningChannelSuccess{
+					RequestId: open.RequestId, ChannelId: 7, ExtranonceSize: 4, ExtranoncePrefix: []byte{0x01, 0x02},
+					Target: littleEndian256(new(big.Int).Rsh(diff1Target, 1)),
+				}))
+				_ = conn.WriteFrame(sv2.Encode(&sv2.NewExtendedMiningJob{
+					ChannelId: 7, JobId: 5, Version: 0x20000000, VersionRollingAllowed: true,
+					MerklePath: [][]byte{make([]byte, 32)}, CoinbasePrefix: []byte{0xaa}, CoinbaseSuffix: []byte{0xbb},
+				}))
+				_ = conn.WriteFrame(sv2.Encode(&sv2.SetNewPrevHash{
+					ChannelId: 7, JobId: 5, PrevHash: prevHash, MinNtime: 0x61000000, Nbits: 0x1d00ffff,
+				}))
+			case sv2.MsgSubmitSharesExtended:
+				var share sv2.SubmitSharesExtended
+				_ = sv2.Decode(f, &share)
+				shares <- share
+				_ = conn.WriteFrame(sv2.Encode(&sv2.SubmitSharesSuccess{
+					ChannelId: 7, LastSequenceNumber: share.SequenceNumber, NewSubmitsAcceptedCount: 1,
+				}))
+			}
+		}
+	}()
+
+	input, output := make(chan []byte, 10), make(chan []byte, 10)
+	addr := SV2Scheme + "rig@" + l.Addr().String() + "/" + hex.EncodeToString(authority.XOnly())
+	if !IsSV2Address(addr) {
+		t.Fatalf("IsSV2Address(%s) = false", addr)
+	}
+	c, err := NewSV2Conn(addr, "client", input, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go c.Start()
+	if identity := <-identities; identity != "rig" {
+		t.Errorf("identity = %s", identity)
+	}
+
+	input <- []byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n")
+	msg := readMessage(t, output)
+	var subscribe []json.RawMessage
+	_ = json.Unmarshal(msg.Result, &subscribe)
+	if len(subscribe) != 3 || string(subscribe[1]) != `"0102"` || string(subscribe[2]) != "4" {
+		t.Fatalf("subscribe result = %s", msg.Result)
+	}
+
+	input <- []byte(`{"id":2,"method":"mining.configure","params":[["version-rolling"],{"version-rolling.mask":"ffffffff"}]}` + "\n")
+	if msg := readMessage(t, output); string(msg.Result) != `{"version-rolling":true,"version-rolling.mask":"1fffe000"}` {
+		t.Fatalf("configure result = %s", msg.Result)
+	}
+
+	input <- []byte(`{"id":3,"method":"mining.authorize","params":["user","x"]}` + "\n")
+	if msg := readMessage(t, output); string(msg.Result) != "true" {
+		t.Fatalf("authorize result = %s", msg.Result)
+	}
+	if msg := readMessage(t, output); msg.Method != methodSetDifficulty || string(msg.Params) != "[2]" {
+		t.Fatalf("difficulty = %s %s", msg.Method, msg.Params)
+	}
+	msg = readMessage(t, output)
+	want := `["5","03020100070605040b0a09080f0e0d0c13121110171615141b1a19181f1e1d1c","aa","bb",` +
+		`["0000000000000000000000000000000000000000000000000000000000000000"],"20000000","1d00ffff","61000000",true]`
+	if msg.Method != methodNotify || string(msg.Params) != want {
+		t.Fatalf("notify = %s %s", msg.Method, msg.Params)
+	}
+
+	input <- []byte(`{"id":4,"method":"mining.submit","params":["user","5","0a0b0c0d","61000001","deadbeef","00002000"]}` + "\n")
+	if msg := readMessage(t, output); msg.IdKey() != "4" || string(msg.Result) != "true" {
+		t.Fatalf("submit response = %+v", msg)
+	}
+	share := <-shares
+	if share.ChannelId != 7 || share.JobId != 5 || share.Nonce != 0xdeadbeef || share.Ntime != 0x61000001 ||
+		share.Version != 0x20002000 || hex.EncodeToString(share.Extranonce) != "0a0b0c0d" {
+		t.Errorf("share = %+v", share)
+	}
+}
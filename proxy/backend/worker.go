@@ -0,0 +1,55 @@
+package backend
+
+import (
+	"encoding/json"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/stratum"
+
+	"github.com/spf13/cast"
+)
+
+// WorkerFunc 返回改写之后的矿工名, 返回 false 时不做修改
+type WorkerFunc func(worker string) (string, bool)
+
+// WorkerRewriter 支持改写矿工名的矿池连接
+type WorkerRewriter interface {
+	// RewriteWorker 需要在 Start 之前调用
+	RewriteWorker(f WorkerFunc)
+	// Workers 矿机使用的矿工名 -> 发送给矿池的矿工名
+	Workers() map[string]string
+}
+
+// maxWorkers 一个矿池连接最多记录的矿工名映射数量
+const maxWorkers = 1024
+
+// rewriteWorker 改写 mining.authorize 与 mining.submit 中的矿工名, workers 记录原始名称与改写之后的名称
+// 份额中的矿工名使用授权时的映射, 矿池的响应不需要改写
+func rewriteWorker(f WorkerFunc, workers map[string]string, line []byte) []byte {
+	msg, err := stratum.Decode(line)
+	if err != nil || (msg.Method != methodAuthorize && msg.Method != methodSubmit) {
+		return line
+	}
+	var params []interface{}
+	if err := json.Unmarshal(msg.Params, &params); err != nil || len(params) == 0 {
+		return line
+	}
+	worker := cast.ToString(params[0])
+	rewritten, ok := workers[worker]
+	if msg.Method == methodAuthorize {
+		if _, exist := workers[worker]; !exist && len(workers) >= maxWorkers {
+			// 无法记录映射时不改写, 否则份额中的矿工名与授权时不一致
+			pkg.Warn("too many workers on one pool connection, authorize %s without rewrite", worker)
+			return line
+		}
+		if rewritten, ok = f(worker); !ok {
+			rewritten = worker
+		}
+		workers[worker] = rewritten
+	}
+	if !ok || rewritten == worker {
+		return line
+	}
+	params[0] = rewritten
+	msg.Params, _ = json.Marshal(params)
+	return msg.Encode()
+}
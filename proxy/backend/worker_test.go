@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRewriteWorker(t *testing.T) {
+	f := func(worker string) (string, bool) {
+		if worker == "keep.me" {
+			return "", false
+		}
+		return "farm." + worker, true
+	}
+	workers := make(map[string]string)
+	tests := []struct {
+		line, want string
+	}{
+		{
+			line: `{"id":2,"method":"mining.authorize","params":["acc.rig1","x"]}` + "\n",
+			want: `{"id":2,"method":"mining.authorize","params":["farm.acc.rig1","x"]}` + "\n",
+		},
+		{
+			line: `{"id":3,"method":"mining.submit","params":["acc.rig1","job","00","5e","01"]}` + "\n",
+			want: `{"id":3,"method":"mining.submit","params":["farm.acc.rig1","job","00","5e","01"]}` + "\n",
+		},
+		{
+			line: `{"id":4,"method":"mining.authorize","params":["keep.me","x"]}` + "\n",
+			want: `{"id":4,"method":"mining.authorize","params":["keep.me","x"]}` + "\n",
+		},
+		{
+			line: `{"id":5,"method":"mining.submit","params":["unknown","job","00","5e","01"]}` + "\n",
+			want: `{"id":5,"method":"mining.submit","params":["unknown","job","00","5e","01"]}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := rewriteWorker(f, workers, []byte(tt.line)); string(got) != tt.want {
+			t.Errorf("rewriteWorker(%s) = %s, want %s", tt.line, got, tt.want)
+		}
+	}
+	if workers["acc.rig1"] != "farm.acc.rig1" || workers["keep.me"] != "keep.me" {
+		t.Errorf("workers = %v", workers)
+	}
+
+	for i := len(workers); i < maxWorkers; i++ {
+		workers[fmt.Sprintf("w%d", i)] = ""
+	}
+	// 映射已满时新的矿工不改写, 已经记录的矿工继续改写
+	full := `{"id":6,"method":"mining.authorize","params":["acc.rig2","x"]}` + "\n"
+	if got := rewriteWorker(f, workers, []byte(full)); string(got) != full {
+		t.Errorf("rewriteWorker(%s) = %s, want unchanged", full, got)
+	}
+	submit := `{"id":7,"method":"mining.submit","params":["acc.rig1","job","00","5e","01"]}` + "\n"
+	if got := rewriteWorker(f, workers, []byte(submit)); !strings.Contains(string(got), "farm.acc.rig1") {
+		t.Errorf("rewriteWorker(%s) = %s, want rewritten", submit, got)
+	}
+}
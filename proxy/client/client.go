@@ -1,9 +1,12 @@
 package client
 
 import (
+	"crypto/tls"
 	"fmt"
+	"math/rand"
 	"miner-proxy/pkg"
 	"miner-proxy/pkg/cache"
+	"miner-proxy/proxy/backend"
 	"miner-proxy/proxy/protocol"
 	"net"
 	"strings"
@@ -21,55 +24,99 @@ var (
 	// key=client id value=*ServerManage
 	serverManage sync.Map
 	localIPv4    = pkg.LocalIPv4s()
+	// serverDialer 连接服务端使用的 Dialer, 可以配置为通过代理连接
+	serverDialer pkg.Dialer = pkg.DirectDialer{}
+	// heartbeatMisses 连续多少次没有收到服务端的心跳时重建隧道连接
+	heartbeatMisses = 3
 )
 
-func InitServerManage(maxConn int, secretKey, serverAddress, clientId, pool string) error {
-	s, err := NewServerManage(maxConn, secretKey, serverAddress, clientId, pool)
+const (
+	// heartbeatInterval 服务端发送心跳的间隔
+	heartbeatInterval = time.Second * 20
+)
+
+// SetHeartbeatMisses 设置连续多少次没有收到心跳时重建隧道连接
+func SetHeartbeatMisses(n int) {
+	if n > 0 {
+		heartbeatMisses = n
+	}
+}
+
+// SetDialer 设置连接服务端使用的 Dialer
+func SetDialer(d pkg.Dialer) {
+	serverDialer = d
+}
+
+// InitServerManage 连接服务端, 隧道数量在 minConn 与 maxConn 之间根据矿机数量与等待确认的数据自动调整
+// serverAddress 可以是多个服务端, 格式为 host:port[#权重],host:port[#权重]
+func InitServerManage(minConn, maxConn int, secretKey, serverAddress, clientId, pool string) error {
+	s, err := NewServerManage(minConn, maxConn, secretKey, serverAddress, clientId, pool)
 	if err != nil {
 		return err
 	}
-
-	go func() {
-		for {
-			s.m.RLock()
-			size := len(s.connIds)
-			s.m.RUnlock()
-			for i := 0; i < maxConn-size; i++ {
-				server := s.NewServer(ksuid.New().String())
-				if server == nil {
-					pkg.Warn("connection to server failed")
-				}
-			}
-			time.Sleep(time.Second * 5)
-		}
-	}()
+	go s.maintain()
 	serverManage.Store(clientId, s)
 	return nil
 }
 
 type ServerManage struct {
-	secretKey, serverAddress, clientId, pool string
-	maxConn                                  int
-	m                                        sync.RWMutex
-	conns                                    sync.Map
-	connIds                                  []string
-	index                                    *atomic.Int64
+	secretKey, clientId, pool string
+	// ip 发送给服务端的客户端ip, 中继模式下为下游客户端的ip
+	ip               string
+	minConn, maxConn int
+	endpoints        []*serverEndpoint
+	m                sync.RWMutex
+	conns            sync.Map
+	connIds          []string
+}
+
+func NewServerManage(minConn, maxConn int, secretKey, serverAddress, clientId, pool string) (*ServerManage, error) {
+	return newServerManage(minConn, maxConn, secretKey, serverAddress, clientId, pool, localIPv4)
 }
 
-func NewServerManage(maxConn int, secretKey, serverAddress, clientId, pool string) (*ServerManage, error) {
+func newServerManage(minConn, maxConn int, secretKey, serverAddress, clientId, pool, ip string) (*ServerManage, error) {
+	if maxConn < 1 {
+		maxConn = 1
+	}
+	if minConn < 1 {
+		minConn = 1
+	}
+	if minConn > maxConn {
+		minConn = maxConn
+	}
+	endpoints, err := parseServerEndpoints(serverAddress)
+	if err != nil {
+		return nil, err
+	}
 	s := &ServerManage{
-		secretKey: secretKey, serverAddress: serverAddress,
-		maxConn: maxConn, index: atomic.NewInt64(0),
+		secretKey: secretKey, endpoints: endpoints,
+		minConn: minConn, maxConn: maxConn,
 		clientId: clientId,
 		pool:     pool,
+		ip:       ip,
 	}
-	for i := 0; i < maxConn; i++ {
-		server := s.NewServer(ksuid.New().String())
-		if server == nil {
-			return nil, errors.New("connection to server error")
+	// 只需要连接上一个服务端, 其余的隧道由 maintain 补充
+	for _, e := range endpoints {
+		if s.NewServer(ksuid.New().String(), e.address) != nil {
+			return s, nil
+		}
+	}
+	return nil, errors.New("connection to server error")
+}
+
+// endpoint 返回 address 对应的服务端
+func (s *ServerManage) endpoint(address string) *serverEndpoint {
+	for _, e := range s.endpoints {
+		if e.address == address {
+			return e
 		}
 	}
-	return s, nil
+	return nil
+}
+
+// pickEndpoint 为新的矿机选择服务端
+func (s *ServerManage) pickEndpoint() string {
+	return pickEndpoint(s.endpoints, serverStrategy, rand.Float64()).address
 }
 
 func (s *ServerManage) DelServerConn(key string) {
@@ -95,54 +142,90 @@ func (s *ServerManage) SetServerConn(key string, server *Server) {
 	return
 }
 
-func (s *ServerManage) GetServer() *Server {
+// evictDead 关闭长时间没有收到心跳的隧道连接, 由调用者补充新的连接
+// 只检查收到过带时间戳心跳的连接, 旧版本的服务端只向其中一个连接发送心跳
+func (s *ServerManage) evictDead(now time.Time) {
+	timeout := heartbeatTimeout()
+	s.conns.Range(func(key, value interface{}) bool {
+		server := value.(*Server)
+		if !server.heartbeat.Load() || now.Sub(server.lastRead.Load()) <= timeout {
+			return true
+		}
+		pkg.Warn("隧道连接 %s 超过 %s 没有收到服务端的心跳, 重新建立连接", server.id, timeout)
+		server.Close()
+		s.DelServerConn(cast.ToString(key))
+		return true
+	})
+}
+
+// GetServer 按照 tunnelSelector 的策略选择连接到 address 的隧道, key 为矿机id, 所有连接都失效时新建连接
+func (s *ServerManage) GetServer(key, address string) *Server {
 	s.m.RLock()
-	connSize := len(s.connIds)
-	if connSize == 0 {
-		s.m.RUnlock()
-		return nil
+	servers := make([]*Server, 0, len(s.connIds))
+	tunnels := make([]pkg.Tunnel, 0, len(s.connIds))
+	for _, id := range s.connIds {
+		if v, ok := s.conns.Load(id); ok && v.(*Server) != nil && v.(*Server).address == address {
+			servers = append(servers, v.(*Server))
+			tunnels = append(tunnels, v.(*Server))
+		}
 	}
-	index := s.index.Add(1) % int64(connSize)
-	key := s.connIds[index]
 	s.m.RUnlock()
-	v, ok := s.conns.Load(key)
-	if !ok {
+	if len(servers) == 0 {
 		return nil
 	}
-	server := v.(*Server)
-	if server == nil || server.close.Load() { // 连接
-		s.DelServerConn(key)
-		key = ksuid.New().String()
-		if server = s.NewServer(key); server == nil {
-			return nil
+	if index := tunnelSelector.Select(tunnels, key); index >= 0 {
+		return servers[index]
+	}
+	for _, v := range servers {
+		if v.close.Load() {
+			s.DelServerConn(v.id)
 		}
-		s.SetServerConn(key, server)
 	}
-	return server
+	return s.NewServer(ksuid.New().String(), address)
 }
 
-func (s *ServerManage) NewServer(id string) *Server {
-	conn, err := net.DialTimeout("tcp", s.serverAddress, time.Second*3)
+// NewServer 新建到 address 的隧道连接, 连续失败 endpointDownFailures 次之后该服务端上的矿机会切换到其他服务端
+func (s *ServerManage) NewServer(id, address string) *Server {
+	e := s.endpoint(address)
+	if e == nil {
+		return nil
+	}
+	conn, err := serverDialer.Dial(address, time.Second*3)
 	if err != nil {
+		e.failed(time.Now())
 		return nil
 	}
+	e.succeeded()
 	server := &Server{
-		id:      id,
-		address: s.serverAddress,
-		conn:    conn,
-		close:   atomic.NewBool(false),
+		id:        id,
+		address:   address,
+		conn:      conn,
+		close:     atomic.NewBool(false),
+		heartbeat: atomic.NewBool(false),
+		lastRead:  atomic.NewTime(time.Now()),
+		inflight:  atomic.NewInt64(0),
+		rtt:       atomic.NewInt64(0),
 	}
 
 	fc := protocol.NewGoframeProtocol(s.secretKey, true, server.conn)
 	var miners []string
 	clients.Range(func(key, value interface{}) bool {
-		miners = append(miners, cast.ToString(key))
+		// 还没有在该服务端上登录的矿机不能发送, 否则服务端会要求关闭这些矿机
+		if c := value.(*Client); c.endpoint.Load() == address && c.online.Load() {
+			miners = append(miners, cast.ToString(key))
+		}
+		return true
+	})
+	relayMiners.Range(func(key, value interface{}) bool {
+		if value.(relayMiner).endpoint == address {
+			miners = append(miners, cast.ToString(key))
+		}
 		return true
 	})
 	req := protocol.Request{
 		ClientId: s.clientId,
 		Type:     protocol.INIT,
-		Data:     []byte(fmt.Sprintf("%s|%s|%s", s.pool, strings.Join(miners, ","), localIPv4)),
+		Data:     []byte(fmt.Sprintf("%s|%s|%s", s.pool, strings.Join(miners, ","), s.ip)),
 	}
 
 	data, _ := protocol.Decode2Byte(req)
@@ -164,15 +247,23 @@ func (s *ServerManage) NewServer(id string) *Server {
 			if err != nil {
 				return
 			}
+			server.lastRead.Store(time.Now())
 			pkg.Debug("client <- server %s", req)
 			switch req.Type {
 			case protocol.PING, protocol.PONG:
+				if req.Time != 0 {
+					server.heartbeat.Store(true)
+				}
 				var needClose []string
 				for _, minerId := range strings.Split(string(req.Data), ",") {
 					if minerId == "" {
 						continue
 					}
-					if _, ok := clients.Load(minerId); !ok { // 发送删除
+					// 发送删除, 已经切换到其他服务端的矿机也需要删除
+					if c, ok := clients.Load(minerId); ok && c.(*Client).endpoint.Load() == server.address {
+						continue
+					}
+					if _, ok := relayed(minerId, server.address); !ok && !isDetached(minerId) {
 						needClose = append(needClose, minerId)
 					}
 				}
@@ -181,6 +272,7 @@ func (s *ServerManage) NewServer(id string) *Server {
 					ClientId: s.clientId,
 					Type:     protocol.PONG,
 					Data:     []byte(strings.Join(needClose, ",")),
+					Time:     req.Time,
 				}
 				data, _ := protocol.Decode2Byte(req)
 				pkg.Debug("client -> server %s", req)
@@ -193,26 +285,30 @@ func (s *ServerManage) NewServer(id string) *Server {
 			case protocol.CLOSE:
 				for _, v := range pkg.String2Array(string(req.Data), ",") {
 					value, ok := clients.Load(v)
-					if !ok {
+					if !ok || value.(*Client).endpoint.Load() != server.address {
+						deliverRelay(protocol.Request{ClientId: req.ClientId, MinerId: v, Type: protocol.CLOSE}, server)
 						continue
 					}
 					pkg.Debug("server send mandate close connection")
 					value.(*Client).Close()
 				}
 			}
+			if deliverRelay(req, server) { // 中继模式下转发给下游客户端
+				continue
+			}
 			v, ok := clients.Load(req.MinerId)
-			if !ok {
+			if !ok || v.(*Client).endpoint.Load() != server.address { // 矿机已经切换到其他服务端
 				continue
 			}
+			if req.Type == protocol.ACK {
+				releaseInflight(req.MinerId, server)
+			}
+			req.Received = time.Now()
 			v.(*Client).input <- req
 		}
 	}(server)
 
-	s.conns.Store(id, server)
-
-	s.m.RLock()
-	defer s.m.RUnlock()
-	s.connIds = append(s.connIds, id)
+	s.SetServerConn(id, server)
 	return server
 }
 
@@ -221,6 +317,11 @@ type Server struct {
 	close       *atomic.Bool
 	stop        sync.Once
 	id, address string
+	// heartbeat 服务端会向该连接发送带时间戳的心跳, lastRead 最后一次收到服务端数据的时间
+	heartbeat *atomic.Bool
+	lastRead  *atomic.Time
+	// inflight 等待 ACK 的数据帧, rtt 数据帧往返时间的平均值(纳秒)
+	inflight, rtt *atomic.Int64
 }
 
 func (s *Server) Close() {
@@ -244,6 +345,18 @@ type Client struct {
 	readyChan                                     chan struct{}
 	stop                                          sync.Once
 	seq                                           *atomic.Int64
+	// endpoint 矿机使用的服务端地址, online 已经在该服务端上登录
+	endpoint *atomic.String
+	online   *atomic.Bool
+	// session 矿机的握手, 切换服务端时用于恢复矿机的会话
+	session *backend.SessionRecorder
+	// switching 切换服务端时暂停发送矿机的数据, resuming 正在等待新的服务端响应 LOGIN, failing 已经开始切换
+	switching         sync.RWMutex
+	resuming, failing *atomic.Bool
+	login             chan struct{}
+	// token 服务端返回的恢复会话的令牌, resumeToken 客户端重启之前的令牌, 登录时恢复服务端上的会话
+	token       *atomic.String
+	resumeToken string
 }
 
 func newClient(ip string, serverAddress string, secretKey string, poolAddress string, conn net.Conn, clientId string) {
@@ -264,6 +377,17 @@ func newClient(ip string, serverAddress string, secretKey string, poolAddress st
 		id:            ksuid.New().String(),
 		poolAddress:   poolAddress,
 		seq:           atomic.NewInt64(0),
+		endpoint:      atomic.NewString(""),
+		online:        atomic.NewBool(false),
+		session:       backend.NewSessionRecorder(),
+		resuming:      atomic.NewBool(false),
+		failing:       atomic.NewBool(false),
+		login:         make(chan struct{}, 1),
+		token:         atomic.NewString(""),
+	}
+	if s, ok := claimSession(clientId, ip); ok { // 客户端重启之前的矿机重新连接
+		client.id, client.resumeToken = s.MinerId, s.Token
+		client.endpoint.Store(s.Endpoint)
 	}
 	defer func() {
 		client.Close()
@@ -298,19 +422,28 @@ func (c *Client) Close() {
 			_ = c.lconn.Close()
 		}
 		clients.Delete(c.id)
+		releaseInflight(c.id, nil)
 	})
 }
 
-func (c *Client) SendToServer(req protocol.Request, maxTry int, secretKey string) error {
+func (c *Client) manage() (*ServerManage, error) {
 	value, ok := serverManage.Load(c.ClientId)
 	if !ok {
-		return errors.Errorf("not found %s server connection", c.ClientId)
+		return nil, errors.Errorf("not found %s server connection", c.ClientId)
+	}
+	return value.(*ServerManage), nil
+}
+
+func (c *Client) SendToServer(req protocol.Request, maxTry int, secretKey string) error {
+	sm, err := c.manage()
+	if err != nil {
+		return err
 	}
-	sm := value.(*ServerManage)
 	return pkg.Try(func() bool {
-		s := sm.GetServer()
+		address := c.endpoint.Load()
+		s := sm.GetServer(c.id, address)
 		if s == nil {
-			s = sm.NewServer(ksuid.New().String())
+			s = sm.NewServer(ksuid.New().String(), address)
 		}
 		if s == nil {
 			pkg.Warn("没有server连接可用!也无法新建连接到server端, 检查网络是否畅通, 1S 后重试")
@@ -327,6 +460,9 @@ func (c *Client) SendToServer(req protocol.Request, maxTry int, secretKey string
 		if err := fc.WriteFrame(sendData); err != nil {
 			return false
 		}
+		if req.Type == protocol.DATA {
+			trackInflight(c.id, s)
+		}
 		return true
 	}, maxTry)
 }
@@ -350,11 +486,21 @@ func (c *Client) SendDataToServer(data []byte, secretKey string) error {
 		Seq:      c.seq.Inc(),
 	}
 
+	c.switching.RLock()
+	defer c.switching.RUnlock()
 	c.SetWait(req)
 	return c.SendToServer(req, 10, secretKey)
 }
 
 func (c *Client) Login() error {
+	sm, err := c.manage()
+	if err != nil {
+		return err
+	}
+	// 恢复会话时使用会话所在的服务端
+	if e := sm.endpoint(c.endpoint.Load()); e == nil || e.down() {
+		c.endpoint.Store(sm.pickEndpoint())
+	}
 	req := protocol.Request{
 		ClientId: c.ClientId,
 		MinerId:  c.id,
@@ -362,6 +508,7 @@ func (c *Client) Login() error {
 		Data: protocol.DecodeLoginRequest2Byte(protocol.LoginRequest{
 			PoolAddress: c.poolAddress,
 			MinerIp:     c.ip,
+			ResumeToken: c.resumeToken,
 		}),
 	}
 	c.SetWait(req)
@@ -379,26 +526,51 @@ func (c *Client) readServerData() {
 				return
 			}
 			switch req.Type {
-			case protocol.ERROR, protocol.CLOSE:
+			case protocol.ERROR:
+				e := protocol.Encode2ErrorResponse(req.Data)
+				if e.Code == protocol.ErrPoolRefused {
+					pkg.Error("server refused pool %s: %s", c.poolAddress, e.Message)
+					return
+				}
+				pkg.Warn("server send error %s, close connection", e)
+				return
+			case protocol.CLOSE:
 				pkg.Debug("server send mandate close connection")
 				return
-			case protocol.LOGIN, protocol.ACK:
+			case protocol.LOGIN:
+				c.online.Store(true)
+				c.loggedIn(req.Data)
+				if c.resuming.Load() { // 切换服务端时不改变等待 ACK 的数据
+					select {
+					case c.login <- struct{}{}:
+					default:
+					}
+					continue
+				}
+				c.SetReady()
+				continue
+			case protocol.ACK:
 				c.SetReady()
 				continue
 			}
+			ack := protocol.Request{
+				ClientId: c.ClientId,
+				MinerId:  c.id,
+				Type:     protocol.ACK,
+			}
 			if !c.IsSend(req) {
 				if _, err := c.lconn.Write(req.Data); err != nil {
 					pkg.Warn("write miner error: %s. close connection", err)
 					return
 				}
+				c.session.OnPool(req.Data)
 				c.SetSend(req)
+				if req.Time != 0 { // 写入矿机之后返回任务到达服务端的时间与客户端写入矿机的耗时
+					ack.Time, ack.Delay = req.Time, int64(time.Since(req.Received))
+				}
 			}
 
-			if err := c.SendToServer(protocol.Request{
-				ClientId: c.ClientId,
-				MinerId:  c.id,
-				Type:     protocol.ACK,
-			}, 2, c.secretKey); err != nil {
+			if err := c.SendToServer(ack, 2, c.secretKey); err != nil {
 				pkg.Error("send ACK to server error: %v close connection", err)
 				return
 			}
@@ -409,6 +581,8 @@ func (c *Client) readServerData() {
 }
 
 func (c *Client) SendTryLastRequest() {
+	c.switching.RLock()
+	defer c.switching.RUnlock()
 	if len(c.lastSendReq.Data) != 0 {
 		pkg.Debug("client -> server try %s", c.lastSendReq)
 		_ = c.SendToServer(c.lastSendReq, 1, c.secretKey)
@@ -438,6 +612,7 @@ func (c *Client) Run() {
 			return
 		}
 
+		c.session.OnMiner(data[:n])
 		if err := c.SendDataToServer(data[:n], c.secretKey); err != nil {
 			pkg.Error("send data to server error: %s try 10 times. close connection", err)
 			return
@@ -480,6 +655,19 @@ func RunClient(address, secretKey, serverAddress, poolAddress, clientId string)
 	if err != nil {
 		return err
 	}
+	return serve(s, secretKey, serverAddress, poolAddress, clientId)
+}
+
+// RunTLSClient 使用 tls 监听矿机的连接, 矿机使用 stratum+ssl://客户端ip:端口 连接
+func RunTLSClient(address, secretKey, serverAddress, poolAddress, clientId string, config *tls.Config) error {
+	s, err := tls.Listen("tcp", address, config)
+	if err != nil {
+		return err
+	}
+	return serve(s, secretKey, serverAddress, poolAddress, clientId)
+}
+
+func serve(s net.Listener, secretKey, serverAddress, poolAddress, clientId string) error {
 	for {
 		conn, err := s.Accept()
 		if err != nil {
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"math/rand"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/protocol"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cast"
+)
+
+const (
+	// ServerPriority 优先使用排在前面的服务端, 失效之后使用下一个
+	ServerPriority = "priority"
+	// ServerWeighted 新的矿机按照权重随机选择服务端
+	ServerWeighted = "weighted"
+
+	// endpointDownFailures 连续连接失败多少次之后认为服务端失效, 矿机切换到其他服务端
+	endpointDownFailures = 3
+	// failoverTimeout 切换服务端时等待新的服务端响应 LOGIN 的时间
+	failoverTimeout = time.Second * 10
+)
+
+var (
+	// serverStrategy 多个服务端时新的矿机选择服务端的策略
+	serverStrategy = ServerPriority
+)
+
+// SetServerStrategy 设置多个服务端时的选择策略
+func SetServerStrategy(strategy string) error {
+	switch strategy {
+	case "":
+		strategy = ServerPriority
+	case ServerPriority, ServerWeighted:
+	default:
+		return errors.Errorf("unsupported server strategy %s", strategy)
+	}
+	serverStrategy = strategy
+	return nil
+}
+
+// serverEndpoint 一个服务端地址以及连接状态
+type serverEndpoint struct {
+	address string
+	weight  int
+
+	m        sync.Mutex
+	failures int
+	// retryAt 连接失败之后下一次可以重试的时间
+	retryAt time.Time
+	// shrinkSince 隧道数量开始多于需要的时间, 只会在 scale 中使用
+	shrinkSince time.Time
+}
+
+// down 连续连接失败 endpointDownFailures 次, 直到重新连接成功
+func (e *serverEndpoint) down() bool {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.failures >= endpointDownFailures
+}
+
+func (e *serverEndpoint) failureCount() int {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.failures
+}
+
+// wait 连接失败之后还需要等待多长时间才能重试
+func (e *serverEndpoint) wait(now time.Time) time.Duration {
+	e.m.Lock()
+	defer e.m.Unlock()
+	return e.retryAt.Sub(now)
+}
+
+func (e *serverEndpoint) failed(now time.Time) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.failures++
+	e.retryAt = now.Add(reconnectBackoff(e.failures, rand.Float64()))
+}
+
+func (e *serverEndpoint) succeeded() {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.failures = 0
+	e.retryAt = time.Time{}
+}
+
+// CheckServerAddresses 检查服务端地址列表, 格式为 host:port[#权重],host:port[#权重]
+func CheckServerAddresses(addresses string) error {
+	_, err := parseServerEndpoints(addresses)
+	return err
+}
+
+func parseServerEndpoints(addresses string) ([]*serverEndpoint, error) {
+	var result []*serverEndpoint
+	for _, v := range strings.Split(strings.ReplaceAll(addresses, " ", ""), ",") {
+		if v == "" {
+			continue
+		}
+		e := &serverEndpoint{address: v, weight: 1}
+		if index := strings.LastIndex(v, "#"); index != -1 {
+			weight, err := cast.ToIntE(v[index+1:])
+			if err != nil || weight <= 0 {
+				return nil, errors.Errorf("invalid server weight %s", v)
+			}
+			e.address, e.weight = v[:index], weight
+		}
+		if _, _, err := net.SplitHostPort(e.address); err != nil {
+			return nil, errors.Wrapf(err, "invalid server address %s", v)
+		}
+		result = append(result, e)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("server address is empty")
+	}
+	return result, nil
+}
+
+// pickEndpoint 为新的矿机选择服务端, 都已经失效时使用连续失败次数最少的, random 取值 [0, 1)
+func pickEndpoint(endpoints []*serverEndpoint, strategy string, random float64) *serverEndpoint {
+	var available []*serverEndpoint
+	var total int
+	for _, e := range endpoints {
+		if !e.down() {
+			available = append(available, e)
+			total += e.weight
+		}
+	}
+	if len(available) == 0 {
+		best := endpoints[0]
+		for _, e := range endpoints[1:] {
+			if e.failureCount() < best.failureCount() {
+				best = e
+			}
+		}
+		return best
+	}
+	if strategy != ServerWeighted {
+		return available[0]
+	}
+	n := int(random * float64(total))
+	for _, e := range available {
+		if n < e.weight {
+			return e
+		}
+		n -= e.weight
+	}
+	return available[len(available)-1]
+}
+
+// failover 将连接到失效服务端的矿机切换到可用的服务端
+func (s *ServerManage) failover() {
+	target := pickEndpoint(s.endpoints, serverStrategy, rand.Float64())
+	if target.down() {
+		return
+	}
+	clients.Range(func(key, value interface{}) bool {
+		c := value.(*Client)
+		if c.ClientId != s.clientId || c.closed.Load() {
+			return true
+		}
+		e := s.endpoint(c.endpoint.Load())
+		if e == nil || !e.down() || !c.failing.CAS(false, true) {
+			return true
+		}
+		go func() {
+			defer c.failing.Store(false)
+			if err := c.failover(target.address); err != nil {
+				pkg.Warn("矿机 %s 从服务端 %s 切换到 %s 失败: %s, 关闭矿机连接", c.id, e.address, target.address, err)
+				c.Close()
+			}
+		}()
+		return true
+	})
+}
+
+// failover 在 address 上重新登录, 并且使用记录的握手恢复矿机与矿池的会话, 矿机不需要重新连接
+// 切换期间矿机的数据暂停发送, 登录成功之后重新发送还没有收到 ACK 的数据
+func (c *Client) failover(address string) error {
+	c.switching.Lock()
+	defer c.switching.Unlock()
+	old := c.endpoint.Load()
+	c.resuming.Store(true)
+	defer c.resuming.Store(false)
+	c.online.Store(false)
+	c.endpoint.Store(address)
+	releaseInflight(c.id, nil)
+	select {
+	case <-c.login:
+	default:
+	}
+
+	lr := protocol.LoginRequest{PoolAddress: c.poolAddress, MinerIp: c.ip}
+	if state, ok := c.session.State(); ok {
+		lr.Resume = &state
+	}
+	req := protocol.Request{
+		ClientId: c.ClientId,
+		MinerId:  c.id,
+		Type:     protocol.LOGIN,
+		Data:     protocol.DecodeLoginRequest2Byte(lr),
+	}
+	if err := c.SendToServer(req, 3, c.secretKey); err != nil {
+		return err
+	}
+	t := time.NewTimer(failoverTimeout)
+	defer t.Stop()
+	select {
+	case <-c.login:
+	case <-t.C:
+		return errors.New("wait login timeout")
+	}
+	pkg.Info("矿机 %s 从服务端 %s 切换到 %s", c.id, old, address)
+	if len(c.lastSendReq.Data) != 0 {
+		_ = c.SendToServer(c.lastSendReq, 1, c.secretKey)
+	}
+	return nil
+}
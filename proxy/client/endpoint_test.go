@@ -0,0 +1,65 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestParseServerEndpoints(t *testing.T) {
+	tests := []struct {
+		addresses string
+		want      []string
+		weights   []int
+		wantErr   bool
+	}{
+		{"127.0.0.1:80", []string{"127.0.0.1:80"}, []int{1}, false},
+		{"a.com:80#3, b.com:81", []string{"a.com:80", "b.com:81"}, []int{3, 1}, false},
+		{"a.com:80#0", nil, nil, true},
+		{"a.com", nil, nil, true},
+		{"", nil, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseServerEndpoints(tt.addresses)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseServerEndpoints(%q) error = %v, wantErr %v", tt.addresses, err, tt.wantErr)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("parseServerEndpoints(%q) = %d endpoints, want %d", tt.addresses, len(got), len(tt.want))
+		}
+		for i, e := range got {
+			if e.address != tt.want[i] || e.weight != tt.weights[i] {
+				t.Errorf("parseServerEndpoints(%q)[%d] = %s#%d, want %s#%d", tt.addresses, i, e.address, e.weight, tt.want[i], tt.weights[i])
+			}
+		}
+	}
+}
+
+func TestPickEndpoint(t *testing.T) {
+	endpoints := func(failures ...int) []*serverEndpoint {
+		var result []*serverEndpoint
+		for i, v := range failures {
+			result = append(result, &serverEndpoint{address: string(rune('a' + i)), weight: i + 1, failures: v})
+		}
+		return result
+	}
+	tests := []struct {
+		name      string
+		endpoints []*serverEndpoint
+		strategy  string
+		random    float64
+		want      string
+	}{
+		{"priority first", endpoints(0, 0, 0), ServerPriority, 0.9, "a"},
+		{"priority skip down", endpoints(3, 1, 0), ServerPriority, 0, "b"},
+		{"weighted low", endpoints(0, 0, 0), ServerWeighted, 0.1, "a"},
+		{"weighted high", endpoints(0, 0, 0), ServerWeighted, 0.9, "c"},
+		{"weighted skip down", endpoints(0, 0, 5), ServerWeighted, 0.9, "b"},
+		{"all down", endpoints(5, 3, 4), ServerPriority, 0, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickEndpoint(tt.endpoints, tt.strategy, tt.random); got.address != tt.want {
+				t.Errorf("pickEndpoint() = %s, want %s", got.address, tt.want)
+			}
+		})
+	}
+}
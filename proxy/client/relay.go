@@ -0,0 +1,124 @@
+package client
+
+import (
+	"miner-proxy/proxy/protocol"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// relayMiners 中继模式下通过当前程序转发的矿机, key=矿机id value=relayMiner
+	relayMiners sync.Map
+	// relayDeliver 把上游服务端发送给中继矿机的数据帧交给下游的客户端
+	relayDeliver func(clientId string, req protocol.Request)
+	// relayLock 避免同时为一个下游客户端建立多个 ServerManage
+	relayLock sync.Mutex
+)
+
+type relayMiner struct {
+	clientId, endpoint string
+}
+
+// SetRelay 开启中继模式, deliver 把上游服务端发送给矿机的数据帧交给下游的客户端
+func SetRelay(deliver func(clientId string, req protocol.Request)) {
+	relayDeliver = deliver
+}
+
+// InitRelayManage 中继模式下使用下游客户端的id, 矿池与ip连接上游服务端, 上游服务端看到的是原始的客户端
+func InitRelayManage(minConn, maxConn int, secretKey, serverAddress, clientId, pool, ip string) error {
+	relayLock.Lock()
+	defer relayLock.Unlock()
+	if _, ok := serverManage.Load(clientId); ok {
+		return nil
+	}
+	s, err := newServerManage(minConn, maxConn, secretKey, serverAddress, clientId, pool, ip)
+	if err != nil {
+		return err
+	}
+	go s.maintain()
+	serverManage.Store(clientId, s)
+	return nil
+}
+
+// Relay 把下游客户端的数据帧原样转发给上游服务端, 矿机在 LOGIN 时选择上游服务端, 之后一直使用该服务端
+func Relay(req protocol.Request) error {
+	value, ok := serverManage.Load(req.ClientId)
+	if !ok {
+		return errors.Errorf("not found %s upstream connection", req.ClientId)
+	}
+	sm := value.(*ServerManage)
+	var miner relayMiner
+	if v, ok := relayMiners.Load(req.MinerId); ok {
+		miner = v.(relayMiner)
+	} else if req.Type == protocol.LOGIN {
+		miner = relayMiner{clientId: req.ClientId, endpoint: sm.pickEndpoint()}
+		relayMiners.Store(req.MinerId, miner)
+	} else if req.Type == protocol.CLOSE {
+		return nil
+	} else {
+		return errors.Errorf("relay miner %s need login", req.MinerId)
+	}
+	if req.Type == protocol.CLOSE {
+		relayMiners.Delete(req.MinerId)
+		releaseInflight(req.MinerId, nil)
+	}
+	server := sm.GetServer(req.MinerId, miner.endpoint)
+	if server == nil {
+		return errors.Errorf("not found upstream server %s connection", miner.endpoint)
+	}
+	data, err := protocol.Decode2Byte(req)
+	if err != nil {
+		return err
+	}
+	if err := protocol.NewGoframeProtocol(sm.secretKey, true, server.conn).WriteFrame(data); err != nil {
+		return err
+	}
+	if req.Type == protocol.DATA {
+		trackInflight(req.MinerId, server)
+	}
+	return nil
+}
+
+// IsRelayMiner 矿机是否通过中继转发
+func IsRelayMiner(minerId string) bool {
+	_, ok := relayMiners.Load(minerId)
+	return ok
+}
+
+// RelayMiners 返回下游客户端id -> 通过中继转发的矿机
+func RelayMiners() map[string][]string {
+	result := make(map[string][]string)
+	relayMiners.Range(func(key, value interface{}) bool {
+		clientId := value.(relayMiner).clientId
+		result[clientId] = append(result[clientId], key.(string))
+		return true
+	})
+	return result
+}
+
+// relayed 上游服务端 address 发送的数据帧是否属于中继的矿机
+func relayed(minerId, address string) (relayMiner, bool) {
+	v, ok := relayMiners.Load(minerId)
+	if !ok || v.(relayMiner).endpoint != address {
+		return relayMiner{}, false
+	}
+	return v.(relayMiner), true
+}
+
+// deliverRelay 把上游服务端的数据帧交给下游客户端, 上游要求关闭或者返回错误时不再转发该矿机
+func deliverRelay(req protocol.Request, server *Server) bool {
+	miner, ok := relayed(req.MinerId, server.address)
+	if !ok || relayDeliver == nil {
+		return false
+	}
+	switch req.Type {
+	case protocol.CLOSE, protocol.ERROR:
+		relayMiners.Delete(req.MinerId)
+		releaseInflight(req.MinerId, nil)
+	case protocol.ACK:
+		releaseInflight(req.MinerId, server)
+	}
+	relayDeliver(miner.clientId, req)
+	return true
+}
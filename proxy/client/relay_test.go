@@ -0,0 +1,71 @@
+package client
+
+import (
+	"miner-proxy/proxy/protocol"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func TestRelay(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	sm := &ServerManage{secretKey: "0123456789abcdef", clientId: "farm", endpoints: []*serverEndpoint{{address: "upstream:1", weight: 1}}}
+	server := &Server{id: "s1", address: "upstream:1", conn: local, close: atomic.NewBool(false),
+		heartbeat: atomic.NewBool(false), lastRead: atomic.NewTime(time.Now()),
+		inflight: atomic.NewInt64(0), rtt: atomic.NewInt64(0)}
+	sm.SetServerConn(server.id, server)
+	serverManage.Store(sm.clientId, sm)
+	defer serverManage.Delete(sm.clientId)
+
+	var delivered []protocol.Request
+	SetRelay(func(clientId string, req protocol.Request) {
+		if clientId != "farm" {
+			t.Errorf("deliver to client %s, want farm", clientId)
+		}
+		delivered = append(delivered, req)
+	})
+	defer SetRelay(nil)
+
+	if err := Relay(protocol.Request{ClientId: "farm", MinerId: "m1", Type: protocol.DATA}); err == nil {
+		t.Fatal("Relay() DATA before LOGIN should fail")
+	}
+
+	received := make(chan protocol.Request, 1)
+	go func() {
+		data, err := protocol.NewGoframeProtocol("0123456789abcdef", true, remote).ReadFrame()
+		if err != nil {
+			return
+		}
+		req, _ := protocol.Encode2Request(data)
+		received <- req
+	}()
+	login := protocol.Request{ClientId: "farm", MinerId: "m1", Type: protocol.LOGIN, Data: []byte("login")}
+	if err := Relay(login); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case req := <-received:
+		if req.ClientId != "farm" || req.MinerId != "m1" || string(req.Data) != "login" {
+			t.Fatalf("upstream received %s", req)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("upstream receive timeout")
+	}
+	if !IsRelayMiner("m1") || len(RelayMiners()["farm"]) != 1 {
+		t.Fatal("m1 should be a relay miner of farm")
+	}
+
+	if deliverRelay(protocol.Request{MinerId: "m1", Type: protocol.ERROR}, &Server{address: "other:1"}) {
+		t.Fatal("frame from another upstream server should not be delivered")
+	}
+	if !deliverRelay(protocol.Request{MinerId: "m1", Type: protocol.ERROR}, server) || len(delivered) != 1 {
+		t.Fatal("ERROR should be delivered to the client")
+	}
+	if IsRelayMiner("m1") {
+		t.Fatal("m1 should be removed after ERROR")
+	}
+}
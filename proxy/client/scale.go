@@ -0,0 +1,168 @@
+package client
+
+import (
+	"miner-proxy/pkg"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	// minersPerTunnel 每个隧道连接承载的矿机数量, 用于计算需要的隧道数量
+	minersPerTunnel = 4
+	// scaleDownDelay 隧道数量多于需要的数量持续多长时间之后关闭一个空闲连接
+	scaleDownDelay = time.Minute
+	// reconnectBaseDelay, reconnectMaxDelay 连接服务端失败之后的重试间隔
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = time.Minute
+)
+
+// desiredTunnels 根据矿机数量与等待确认的数据帧计算需要的隧道数量, 总是保留一个空闲的隧道
+func desiredTunnels(miners int, inflight int64, minConn, maxConn int) int {
+	desired := (miners + minersPerTunnel - 1) / minersPerTunnel
+	if int(inflight)+1 > desired {
+		desired = int(inflight) + 1
+	}
+	if desired < minConn {
+		desired = minConn
+	}
+	if desired > maxConn {
+		desired = maxConn
+	}
+	return desired
+}
+
+// reconnectBackoff 第 failures 次连接失败之后的等待时间, 指数增长并且加入 50% 的随机抖动, jitter 取值 [0, 1)
+func reconnectBackoff(failures int, jitter float64) time.Duration {
+	delay := reconnectBaseDelay
+	for i := 1; i < failures && delay < reconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > reconnectMaxDelay {
+		delay = reconnectMaxDelay
+	}
+	return time.Duration(float64(delay) * (0.5 + jitter))
+}
+
+func (s *ServerManage) ConnCount() int {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return len(s.connIds)
+}
+
+// connCount 连接到 address 的隧道数量
+func (s *ServerManage) connCount(address string) int {
+	var count int
+	s.conns.Range(func(key, value interface{}) bool {
+		if value.(*Server).address == address {
+			count++
+		}
+		return true
+	})
+	return count
+}
+
+// load 返回使用该客户端id并且连接到 address 的矿机数量(包括中继的矿机)以及这些隧道等待确认的数据帧
+func (s *ServerManage) load(address string) (int, int64) {
+	var miners int
+	clients.Range(func(key, value interface{}) bool {
+		if c := value.(*Client); c.ClientId == s.clientId && !c.closed.Load() && c.endpoint.Load() == address {
+			miners++
+		}
+		return true
+	})
+	relayMiners.Range(func(key, value interface{}) bool {
+		if miner := value.(relayMiner); miner.clientId == s.clientId && miner.endpoint == address {
+			miners++
+		}
+		return true
+	})
+	var total int64
+	s.conns.Range(func(key, value interface{}) bool {
+		if server := value.(*Server); server.address == address {
+			total += server.Inflight()
+		}
+		return true
+	})
+	return miners, total
+}
+
+// scale 调整每一个服务端的隧道数量, 新的矿机使用的服务端在 minConn 与 maxConn 之间调整,
+// 其他服务端只为还在使用的矿机保留连接, 失效的服务端按照 reconnectBackoff 的间隔尝试重新连接
+func (s *ServerManage) scale(now time.Time) {
+	primary := pickEndpoint(s.endpoints, serverStrategy, 0)
+	for _, e := range s.endpoints {
+		var minConn, maxConn int
+		miners, inflight := s.load(e.address)
+		switch {
+		case e == primary, serverStrategy == ServerWeighted && !e.down():
+			minConn, maxConn = s.minConn, s.maxConn
+		case miners > 0:
+			minConn, maxConn = 1, s.maxConn
+		case e.down():
+			minConn, maxConn = 1, 1
+		}
+		s.scaleEndpoint(e, now, desiredTunnels(miners, inflight, minConn, maxConn))
+	}
+}
+
+// scaleEndpoint 新建连接失败之后按照 reconnectBackoff 等待, 多余的连接空闲一段时间之后逐个关闭
+func (s *ServerManage) scaleEndpoint(e *serverEndpoint, now time.Time, desired int) {
+	size := s.connCount(e.address)
+	switch {
+	case size < desired:
+		e.shrinkSince = time.Time{}
+		if e.wait(now) > 0 {
+			return
+		}
+		for ; size < desired; size++ {
+			if s.NewServer(ksuid.New().String(), e.address) == nil {
+				pkg.Warn("connection to server %s failed, retry after %s", e.address, e.wait(now))
+				return
+			}
+		}
+	case size > desired:
+		if e.shrinkSince.IsZero() {
+			e.shrinkSince = now
+			return
+		}
+		if now.Sub(e.shrinkSince) < scaleDownDelay {
+			return
+		}
+		if s.closeIdle(e.address) {
+			e.shrinkSince = now
+		}
+	default:
+		e.shrinkSince = time.Time{}
+	}
+}
+
+// closeIdle 关闭一个连接到 address 并且没有等待确认数据帧的隧道连接
+func (s *ServerManage) closeIdle(address string) bool {
+	var idle *Server
+	s.conns.Range(func(key, value interface{}) bool {
+		if server := value.(*Server); server.address == address && server.Inflight() == 0 {
+			idle = server
+			return false
+		}
+		return true
+	})
+	if idle == nil {
+		return false
+	}
+	pkg.Debug("隧道连接数量多于需要的数量, 关闭空闲连接 %s", idle.id)
+	s.DelServerConn(idle.id)
+	idle.Close()
+	return true
+}
+
+// maintain 定时清理失效的隧道, 调整隧道数量, 并且将失效服务端上的矿机切换到其他服务端
+func (s *ServerManage) maintain() {
+	for {
+		now := time.Now()
+		s.evictDead(now)
+		s.scale(now)
+		s.failover()
+		time.Sleep(time.Second)
+	}
+}
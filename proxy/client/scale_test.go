@@ -0,0 +1,47 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDesiredTunnels(t *testing.T) {
+	tests := []struct {
+		name             string
+		miners           int
+		inflight         int64
+		minConn, maxConn int
+		want             int
+	}{
+		{"idle", 0, 0, 2, 10, 2},
+		{"by miners", 17, 0, 2, 10, 5},
+		{"by inflight", 8, 6, 2, 10, 7},
+		{"max", 100, 40, 2, 10, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := desiredTunnels(tt.miners, tt.inflight, tt.minConn, tt.maxConn); got != tt.want {
+				t.Errorf("desiredTunnels() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		jitter   float64
+		want     time.Duration
+	}{
+		{1, 0.5, time.Second},
+		{3, 0.5, 4 * time.Second},
+		{3, 0, 2 * time.Second},
+		{20, 0.5, time.Minute},
+		{20, 0.99, time.Duration(float64(time.Minute) * 1.49)},
+	}
+	for _, tt := range tests {
+		if got := reconnectBackoff(tt.failures, tt.jitter); got != tt.want {
+			t.Errorf("reconnectBackoff(%d, %v) = %s, want %s", tt.failures, tt.jitter, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"encoding/json"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/protocol"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// sessionSaveInterval 保存可以恢复的会话的间隔
+	sessionSaveInterval = time.Second * 5
+)
+
+var (
+	sessionFile string
+	// resumeWindow 客户端重启之后多长时间之内重新连接的矿机可以恢复服务端上的会话, 0 表示不恢复
+	resumeWindow time.Duration
+	// detached 客户端重启之前的会话, 等待矿机重新连接, key=矿机id value=resumeSession
+	detached sync.Map
+)
+
+// resumeSession 客户端重启之后可以恢复的服务端会话
+type resumeSession struct {
+	MinerId  string `json:"miner_id"`
+	ClientId string `json:"client_id"`
+	MinerIp  string `json:"miner_ip"`
+	Endpoint string `json:"endpoint"`
+	Token    string `json:"token"`
+	// Time 最后一次保存的时间
+	Time time.Time `json:"time"`
+}
+
+// SetSessionResume 定时将矿机的会话保存到 file, 客户端重启之后 window 之内从同一个ip重新连接的矿机恢复服务端上的会话
+// file 为空时保存在程序所在的目录, window 为 0 时不恢复
+func SetSessionResume(file string, window time.Duration) error {
+	if window <= 0 {
+		return nil
+	}
+	if file == "" {
+		dir := "."
+		if executable, err := os.Executable(); err == nil {
+			dir = filepath.Dir(executable)
+		}
+		file = filepath.Join(dir, "miner-proxy.sessions")
+	}
+	sessionFile, resumeWindow = file, window
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "read session file %s", file)
+	}
+	var sessions []resumeSession
+	if len(data) != 0 {
+		if err := json.Unmarshal(data, &sessions); err != nil {
+			pkg.Warn("session file %s is invalid, ignore it: %s", file, err)
+		}
+	}
+	now := time.Now()
+	for _, v := range sessions {
+		if now.Sub(v.Time) <= window {
+			detached.Store(v.MinerId, v)
+		}
+	}
+	go func() {
+		for {
+			time.Sleep(sessionSaveInterval)
+			if err := saveSessions(time.Now()); err != nil {
+				pkg.Warn("save sessions error: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// saveSessions 保存已经登录的矿机与还在等待矿机重新连接的会话
+func saveSessions(now time.Time) error {
+	sessions := make([]resumeSession, 0)
+	clients.Range(func(key, value interface{}) bool {
+		c := value.(*Client)
+		if token := c.token.Load(); token != "" && !c.closed.Load() {
+			sessions = append(sessions, resumeSession{
+				MinerId: c.id, ClientId: c.ClientId, MinerIp: c.ip,
+				Endpoint: c.endpoint.Load(), Token: token, Time: now,
+			})
+		}
+		return true
+	})
+	detached.Range(func(key, value interface{}) bool {
+		if s := value.(resumeSession); now.Sub(s.Time) <= resumeWindow {
+			sessions = append(sessions, s)
+		} else {
+			detached.Delete(key)
+		}
+		return true
+	})
+	data, _ := json.Marshal(sessions)
+	tmp := sessionFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sessionFile)
+}
+
+// isDetached 会话还在等待矿机重新连接, 不能通知服务端关闭
+func isDetached(minerId string) bool {
+	v, ok := detached.Load(minerId)
+	return ok && time.Since(v.(resumeSession).Time) <= resumeWindow
+}
+
+// claimSession 为新连接的矿机选择一个同一个ip的还在等待恢复的会话, 每个会话只能使用一次
+func claimSession(clientId, ip string) (resumeSession, bool) {
+	var result resumeSession
+	var found bool
+	now := time.Now()
+	detached.Range(func(key, value interface{}) bool {
+		s := value.(resumeSession)
+		if s.ClientId != clientId || s.MinerIp != ip || now.Sub(s.Time) > resumeWindow {
+			return true
+		}
+		if _, ok := detached.LoadAndDelete(key); ok {
+			result, found = s, true
+			return false
+		}
+		return true
+	})
+	return result, found
+}
+
+// loggedIn 处理 LOGIN 的响应, 保存恢复会话使用的令牌, 恢复了服务端上的会话时继续使用服务端的序号
+func (c *Client) loggedIn(data []byte) {
+	resp, err := protocol.Encode2LoginResponse(data)
+	if err != nil || resp.Token == "" { // 旧版本的服务端
+		return
+	}
+	c.token.Store(resp.Token)
+	if resp.Resumed {
+		c.seq.Store(resp.Seq)
+		pkg.Info("矿机 %s %s 恢复了服务端上的会话", c.ip, c.id)
+	}
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionResume(t *testing.T) {
+	defer func() {
+		detached.Range(func(key, value interface{}) bool {
+			detached.Delete(key)
+			return true
+		})
+	}()
+	sessionFile, resumeWindow = filepath.Join(t.TempDir(), "sessions"), time.Minute
+	now := time.Now()
+	detached.Store("m1", resumeSession{MinerId: "m1", ClientId: "c1", MinerIp: "10.0.0.1", Token: "t1", Time: now})
+	detached.Store("m2", resumeSession{MinerId: "m2", ClientId: "c1", MinerIp: "10.0.0.2", Token: "t2", Time: now.Add(-time.Hour)})
+	if err := saveSessions(now); err != nil {
+		t.Fatal(err)
+	}
+	if isDetached("m2") {
+		t.Fatal("expired session m2 should not be detached")
+	}
+
+	detached.Delete("m1")
+	if err := SetSessionResume(sessionFile, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !isDetached("m1") {
+		t.Fatal("session m1 should be loaded from file")
+	}
+	if _, ok := claimSession("c2", "10.0.0.1"); ok {
+		t.Fatal("session of another client should not be claimed")
+	}
+	s, ok := claimSession("c1", "10.0.0.1")
+	if !ok || s.MinerId != "m1" || s.Token != "t1" {
+		t.Fatalf("claimSession() = %+v, %v", s, ok)
+	}
+	if _, ok := claimSession("c1", "10.0.0.1"); ok {
+		t.Fatal("session should be claimed only once")
+	}
+}
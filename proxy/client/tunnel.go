@@ -0,0 +1,82 @@
+package client
+
+import (
+	"miner-proxy/pkg"
+	"sync"
+	"time"
+)
+
+var (
+	// tunnelSelector 发送数据给服务端时选择隧道连接的策略
+	tunnelSelector, _ = pkg.NewTunnelSelector(pkg.TunnelRoundRobin)
+	// inflight 矿机id -> 等待 ACK 的数据帧
+	inflight sync.Map
+)
+
+type inflightFrame struct {
+	server *Server
+	sent   time.Time
+}
+
+// SetTunnelStrategy 设置选择隧道连接的策略
+func SetTunnelStrategy(strategy string) error {
+	selector, err := pkg.NewTunnelSelector(strategy)
+	if err != nil {
+		return err
+	}
+	tunnelSelector = selector
+	return nil
+}
+
+// Healthy 已经关闭或者心跳超时的连接不再使用
+func (s *Server) Healthy() bool {
+	if s.close.Load() {
+		return false
+	}
+	return !s.heartbeat.Load() || time.Since(s.lastRead.Load()) <= heartbeatTimeout()
+}
+
+func (s *Server) Inflight() int64 {
+	return s.inflight.Load()
+}
+
+// RTT 数据帧从发送到收到 ACK 的平均时间, 服务端在同一个连接上回复 ACK
+func (s *Server) RTT() (time.Duration, bool) {
+	rtt := s.rtt.Load()
+	return time.Duration(rtt), rtt != 0
+}
+
+func heartbeatTimeout() time.Duration {
+	return heartbeatInterval * time.Duration(heartbeatMisses+1)
+}
+
+// trackInflight 记录矿机等待 ACK 的数据帧所在的隧道连接
+func trackInflight(minerId string, server *Server) {
+	releaseInflight(minerId, nil)
+	server.inflight.Inc()
+	inflight.Store(minerId, inflightFrame{server: server, sent: time.Now()})
+}
+
+// releaseInflight 矿机的数据帧已经确认或者矿机已经断开, ACK 从发送数据帧的连接返回时记录往返延迟
+func releaseInflight(minerId string, ackServer *Server) {
+	v, ok := inflight.LoadAndDelete(minerId)
+	if !ok {
+		return
+	}
+	frame := v.(inflightFrame)
+	frame.server.inflight.Dec()
+	if frame.server != ackServer {
+		return
+	}
+	rtt := int64(time.Since(frame.sent))
+	for {
+		old := frame.server.rtt.Load()
+		next := rtt
+		if old != 0 {
+			next = old + (rtt-old)/8
+		}
+		if frame.server.rtt.CAS(old, next) {
+			return
+		}
+	}
+}
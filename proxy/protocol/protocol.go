@@ -4,8 +4,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"miner-proxy/pkg"
+	"miner-proxy/proxy/stratum"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/panjf2000/gnet"
 	"github.com/smallnest/goframe"
@@ -134,6 +136,12 @@ type Request struct {
 	Type     RequestType `msgpack:"type"`
 	Data     []byte      `msgpack:"data"`
 	Seq      int64       `msgpack:"seq"`
+	// Time 服务端收到矿池任务的时间(纳秒), 客户端写入矿机之后在 ACK 中原样返回, 用于计算任务传播延迟
+	Time int64 `msgpack:"time,omitempty"`
+	// Delay ACK 中客户端从收到任务到写入矿机完成的时间(纳秒)
+	Delay int64 `msgpack:"delay,omitempty"`
+	// Received 客户端从隧道连接读取到数据帧的时间, 不会发送
+	Received time.Time `msgpack:"-"`
 }
 
 func CopyRequest(req Request) Request {
@@ -185,6 +193,68 @@ func (r Request) String() string {
 type LoginRequest struct {
 	PoolAddress string `msgpack:"pool_address"`
 	MinerIp     string `msgpack:"miner_ip"`
+	// Resume 矿机从其他服务端切换过来时的会话, 服务端连接矿池之后重放握手, 矿机不需要重新连接
+	Resume *stratum.SessionState `msgpack:"resume,omitempty"`
+	// ResumeToken 客户端重启之后使用之前的矿机id与令牌重新连接服务端上还在运行的会话
+	ResumeToken string `msgpack:"resume_token,omitempty"`
+}
+
+// LoginResponse LOGIN 响应的数据, 旧版本服务端的响应没有数据
+type LoginResponse struct {
+	// Token 恢复会话使用的令牌
+	Token string `msgpack:"token"`
+	// Resumed 重新连接到了服务端上已有的会话, Seq 为服务端最后收到的矿机数据帧序号
+	Resumed bool  `msgpack:"resumed"`
+	Seq     int64 `msgpack:"seq"`
+}
+
+// ErrorCode ERROR 请求中的错误类型
+type ErrorCode int
+
+const (
+	ErrUnknown ErrorCode = iota
+	// ErrNeedLogin 矿机没有登录或者已经被服务端关闭
+	ErrNeedLogin
+	// ErrPoolRefused 服务端策略拒绝了客户端请求的矿池
+	ErrPoolRefused
+	// ErrPoolUnavailable 无法连接到矿池
+	ErrPoolUnavailable
+)
+
+func (e ErrorCode) String() string {
+	switch e {
+	case ErrNeedLogin:
+		return "need_login"
+	case ErrPoolRefused:
+		return "pool_refused"
+	case ErrPoolUnavailable:
+		return "pool_unavailable"
+	}
+	return "unknown"
+}
+
+// ErrorResponse ERROR 请求的数据
+type ErrorResponse struct {
+	Code    ErrorCode `msgpack:"code"`
+	Message string    `msgpack:"message"`
+}
+
+func (e ErrorResponse) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func NewErrorRequest(minerId string, code ErrorCode, message string) Request {
+	data, _ := msgpack.Marshal(ErrorResponse{Code: code, Message: message})
+	return Request{Type: ERROR, MinerId: minerId, Data: data}
+}
+
+// Encode2ErrorResponse 解析 ERROR 请求的数据, 旧版本服务端发送的是纯文本
+func Encode2ErrorResponse(data []byte) ErrorResponse {
+	var result ErrorResponse
+	if err := msgpack.Unmarshal(data, &result); err != nil {
+		return ErrorResponse{Code: ErrUnknown, Message: string(data)}
+	}
+	return result
 }
 
 func Encode2Request(data []byte) (Request, error) {
@@ -216,6 +286,17 @@ func DecodeLoginRequest2Byte(req LoginRequest) []byte {
 	return data
 }
 
+func Encode2LoginResponse(data []byte) (LoginResponse, error) {
+	var result LoginResponse
+	err := msgpack.Unmarshal(data, &result)
+	return result, err
+}
+
+func DecodeLoginResponse2Byte(resp LoginResponse) []byte {
+	data, _ := msgpack.Marshal(resp)
+	return data
+}
+
 type GoframeProtocol struct {
 	frame goframe.FrameConn
 	*EncryptionProtocol
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/backend"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAlerts 保留最近的告警数量
+	maxAlerts = 100
+)
+
+var (
+	alerts  []AlertEvent
+	alertsM sync.Mutex
+)
+
+// AlertEvent 矿机连续授权失败或者被矿池封禁时产生的告警
+type AlertEvent struct {
+	Time     string `json:"time"`
+	ClientId string `json:"client_id"`
+	MinerId  string `json:"miner_id"`
+	Ip       string `json:"ip"`
+	Pool     string `json:"pool"`
+	Category string `json:"category"`
+	Message  string `json:"message"`
+	Count    int    `json:"count"`
+}
+
+func (e AlertEvent) String() string {
+	if e.Category == backend.ErrorBan {
+		return fmt.Sprintf("矿机 %s(客户端 %s) 被矿池 %s 封禁: %s", e.Ip, e.ClientId, e.Pool, e.Message)
+	}
+	return fmt.Sprintf("矿机 %s(客户端 %s) 在矿池 %s 连续 %d 次授权失败: %s", e.Ip, e.ClientId, e.Pool, e.Count, e.Message)
+}
+
+// raiseAlert 记录告警并且发送微信通知
+func raiseAlert(c *Client, a backend.Alert) {
+	e := AlertEvent{
+		Time:     time.Now().Format("2006-01-02 15:04:05"),
+		ClientId: c.clientId,
+		MinerId:  c.id,
+		Ip:       c.ip,
+		Pool:     a.Pool,
+		Category: a.Category,
+		Message:  a.Message,
+		Count:    a.Count,
+	}
+	pkg.Error(e.String())
+	alertsM.Lock()
+	alerts = append(alerts, e)
+	if len(alerts) > maxAlerts {
+		alerts = alerts[len(alerts)-maxAlerts:]
+	}
+	alertsM.Unlock()
+	go pushers.Range(func(key, value interface{}) bool {
+		if err := value.(*pusher).SendMessage2All(e.String()); err != nil {
+			pkg.Error("发送告警通知失败: %s", err)
+		}
+		return true
+	})
+}
+
+// Alerts 最近的告警, 最新的在前
+func Alerts() []AlertEvent {
+	alertsM.Lock()
+	defer alertsM.Unlock()
+	result := make([]AlertEvent, 0, len(alerts))
+	for i := len(alerts) - 1; i >= 0; i-- {
+		result = append(result, alerts[i])
+	}
+	return result
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"miner-proxy/pkg"
 	"sync"
 	"time"
 
@@ -14,7 +15,6 @@ type ClientDispatch struct {
 	pool       string
 	conns      sync.Map
 	connIds    []string
-	index      *atomic.Int64
 	ClientId   string
 	startTime  time.Time
 }
@@ -22,11 +22,35 @@ type ClientDispatch struct {
 type Conn struct {
 	gnet.Conn
 	Id string
+	// rtt 通过带时间戳的 PING/PONG 测量的往返延迟
+	rtt *rttStats
+	// missed 连续没有收到 PONG 的 PING 次数, 包括最近一次还在等待的 PING
+	missed *atomic.Int64
+	// inflight 已经发送还没有收到 ACK 的数据帧, frames 发送的数据帧总数
+	inflight, frames *atomic.Int64
+}
+
+// Healthy 连续 heartbeatMisses 次 PING 没有收到 PONG 时认为隧道已经失效
+func (c *Conn) Healthy() bool {
+	return c.missed == nil || c.missed.Load() <= int64(heartbeatMisses)
+}
+
+func (c *Conn) Inflight() int64 {
+	if c.inflight == nil {
+		return 0
+	}
+	return c.inflight.Load()
+}
+
+func (c *Conn) RTT() (time.Duration, bool) {
+	if c.rtt == nil {
+		return 0, false
+	}
+	return c.rtt.recent(time.Now())
 }
 
 func NewClientDispatch(clientId, pool, remoteAddr string) *ClientDispatch {
 	return &ClientDispatch{
-		index:      atomic.NewInt64(0),
 		ClientId:   clientId,
 		pool:       pool,
 		remoteAddr: remoteAddr,
@@ -34,24 +58,33 @@ func NewClientDispatch(clientId, pool, remoteAddr string) *ClientDispatch {
 	}
 }
 
-func (c *ClientDispatch) GetConn() *Conn {
+// GetConn 按照 tunnelSelector 的策略选择一个健康的隧道连接, key 为矿机id
+func (c *ClientDispatch) GetConn(key string) *Conn {
 	c.m.RLock()
-	defer c.m.RUnlock()
-	if len(c.connIds) == 0 {
-		return nil
+	conns := make([]*Conn, 0, len(c.connIds))
+	tunnels := make([]pkg.Tunnel, 0, len(c.connIds))
+	for _, id := range c.connIds {
+		if v, ok := c.conns.Load(id); ok {
+			conns = append(conns, v.(*Conn))
+			tunnels = append(tunnels, v.(*Conn))
+		}
 	}
-	index := c.index.Add(1) % int64(len(c.connIds))
-	v, ok := c.conns.Load(c.connIds[index])
-	if !ok {
+	c.m.RUnlock()
+	index := tunnelSelector.Select(tunnels, key)
+	if index < 0 {
 		return nil
 	}
-	return v.(*Conn)
+	return conns[index]
 }
 
 func (c *ClientDispatch) SetConn(id string, conn gnet.Conn) {
 	c.conns.Store(id, &Conn{
-		Conn: conn,
-		Id:   id,
+		Conn:     conn,
+		Id:       id,
+		rtt:      newRTTStats(),
+		missed:   atomic.NewInt64(0),
+		inflight: atomic.NewInt64(0),
+		frames:   atomic.NewInt64(0),
 	})
 	c.m.Lock()
 	defer c.m.Unlock()
@@ -77,3 +110,55 @@ func (c *ClientDispatch) ConnCount() int {
 	defer c.m.RUnlock()
 	return len(c.connIds)
 }
+
+// inflightFrames 矿机已经发送还没有收到 ACK 的数据帧所在的隧道连接, 按照发送顺序排列
+type inflightFrames struct {
+	m     sync.Mutex
+	conns []*Conn
+}
+
+// trackInflight 记录矿机等待 ACK 的数据帧所在的隧道连接, 每个数据帧单独计数
+func trackInflight(minerId string, conn *Conn) {
+	if conn.inflight == nil {
+		return
+	}
+	v, _ := inflight.LoadOrStore(minerId, new(inflightFrames))
+	frames := v.(*inflightFrames)
+	frames.m.Lock()
+	frames.conns = append(frames.conns, conn)
+	frames.m.Unlock()
+	conn.inflight.Inc()
+	conn.frames.Inc()
+}
+
+// ackInflight 矿机最早发送的一个数据帧已经确认
+func ackInflight(minerId string) {
+	v, ok := inflight.Load(minerId)
+	if !ok {
+		return
+	}
+	frames := v.(*inflightFrames)
+	frames.m.Lock()
+	defer frames.m.Unlock()
+	if len(frames.conns) == 0 {
+		return
+	}
+	frames.conns[0].inflight.Dec()
+	frames.conns[0] = nil
+	frames.conns = frames.conns[1:]
+}
+
+// releaseInflight 矿机已经断开, 释放所有还没有确认的数据帧
+func releaseInflight(minerId string) {
+	v, ok := inflight.LoadAndDelete(minerId)
+	if !ok {
+		return
+	}
+	frames := v.(*inflightFrames)
+	frames.m.Lock()
+	defer frames.m.Unlock()
+	for _, conn := range frames.conns {
+		conn.inflight.Dec()
+	}
+	frames.conns = nil
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"miner-proxy/proxy/protocol"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet"
+	"go.uber.org/atomic"
+)
+
+func TestClientDispatch_GetConn(t *testing.T) {
+	cd := NewClientDispatch("c1", "", "")
+	for _, id := range []string{"a", "b", "c"} {
+		cd.SetConn(id, nil)
+	}
+	v, _ := cd.conns.Load("b")
+	v.(*Conn).missed.Store(int64(heartbeatMisses) + 1)
+
+	for i := 0; i < 6; i++ {
+		if conn := cd.GetConn(""); conn == nil || conn.Id == "b" {
+			t.Fatalf("GetConn() returned unhealthy connection %+v", conn)
+		}
+	}
+	for _, id := range []string{"a", "c"} {
+		v, _ := cd.conns.Load(id)
+		v.(*Conn).missed.Store(int64(heartbeatMisses) + 1)
+	}
+	if conn := cd.GetConn(""); conn != nil {
+		t.Errorf("GetConn() = %s, want nil", conn.Id)
+	}
+}
+
+// fakeTunnel 记录服务端写入隧道连接的 PING
+type fakeTunnel struct {
+	gnet.Conn
+	addr   net.Addr
+	pings  *atomic.Int64
+	closed *atomic.Bool
+}
+
+func (c *fakeTunnel) RemoteAddr() net.Addr { return c.addr }
+
+func (c *fakeTunnel) AsyncWrite(data []byte) error {
+	c.pings.Inc()
+	return nil
+}
+
+func (c *fakeTunnel) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestServer_Tick(t *testing.T) {
+	cd := NewClientDispatch("tick-client", "", "")
+	ps := &Server{}
+	tunnels := make(map[string]*fakeTunnel)
+	var ids []string
+	for i := 0; i < 10; i++ {
+		tunnel := &fakeTunnel{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000 + i},
+			pings: atomic.NewInt64(0), closed: atomic.NewBool(false)}
+		id := ps.getConnId(cd.ClientId, tunnel)
+		tunnels[id], ids = tunnel, append(ids, id)
+		cd.SetConn(id, tunnel)
+		connId2Id.Store(tunnel.addr.String(), cd.ClientId)
+	}
+	conns.Store(cd.ClientId, cd)
+	defer func() {
+		conns.Delete(cd.ClientId)
+		for _, tunnel := range tunnels {
+			connId2Id.Delete(tunnel.addr.String())
+		}
+	}()
+
+	for i := 1; i <= heartbeatMisses; i++ {
+		ps.Tick()
+		for id, tunnel := range tunnels {
+			if tunnel.pings.Load() != int64(i) || tunnel.closed.Load() {
+				t.Fatalf("tick %d: tunnel %s pings = %d, closed = %v", i, id, tunnel.pings.Load(), tunnel.closed.Load())
+			}
+			if v, _ := cd.conns.Load(id); !v.(*Conn).Healthy() {
+				t.Fatalf("tick %d: tunnel %s should be healthy", i, id)
+			}
+		}
+	}
+	// 一个隧道响应了心跳, 其他隧道连续 heartbeatMisses 次没有响应
+	ps.pong(protocol.Request{ClientId: cd.ClientId, Type: protocol.PONG}, tunnels[ids[0]], time.Now())
+	ps.Tick()
+	if cd.ConnCount() != 1 {
+		t.Fatalf("ConnCount() = %d, want 1", cd.ConnCount())
+	}
+	if tunnels[ids[0]].closed.Load() || !tunnels[ids[1]].closed.Load() {
+		t.Fatal("only tunnels without PONG should be closed")
+	}
+}
+
+func TestTrackInflight(t *testing.T) {
+	cd := NewClientDispatch("inflight-client", "", "")
+	cd.SetConn("a", nil)
+	cd.SetConn("b", nil)
+	a, _ := cd.conns.Load("a")
+	b, _ := cd.conns.Load("b")
+	ca, cb := a.(*Conn), b.(*Conn)
+
+	// 同一个矿机连续发送的数据帧分别计数, 每个 ACK 只确认最早的一帧
+	trackInflight("inflight-miner", ca)
+	trackInflight("inflight-miner", ca)
+	trackInflight("inflight-miner", cb)
+	if ca.Inflight() != 2 || cb.Inflight() != 1 {
+		t.Fatalf("Inflight() = %d, %d, want 2, 1", ca.Inflight(), cb.Inflight())
+	}
+	ackInflight("inflight-miner")
+	if ca.Inflight() != 1 || cb.Inflight() != 1 {
+		t.Fatalf("Inflight() after ack = %d, %d, want 1, 1", ca.Inflight(), cb.Inflight())
+	}
+	releaseInflight("inflight-miner")
+	if ca.Inflight() != 0 || cb.Inflight() != 0 {
+		t.Fatalf("Inflight() after release = %d, %d, want 0, 0", ca.Inflight(), cb.Inflight())
+	}
+	ackInflight("inflight-miner")
+	if ca.Inflight() != 0 {
+		t.Fatalf("Inflight() after extra ack = %d, want 0", ca.Inflight())
+	}
+}
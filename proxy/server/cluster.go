@@ -0,0 +1,274 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"hash/fnv"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/protocol"
+	"miner-proxy/proxy/state"
+	"time"
+
+	"github.com/panjf2000/gnet"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// forwardFrame 节点之间转发的数据帧
+type forwardFrame struct {
+	// ToClient 为 true 时由持有客户端隧道连接的节点发送给客户端, 否则由持有矿机矿池连接的节点处理
+	ToClient bool             `msgpack:"to_client"`
+	Request  protocol.Request `msgpack:"request"`
+}
+
+// forwardJob 等待按顺序处理的数据帧, c 为收到数据帧的隧道连接, 其他节点转发的数据帧 c 为 nil
+// 需要读写共享状态或者上游服务端的数据帧都在队列中处理, 不阻塞事件循环
+type forwardJob struct {
+	frame forwardFrame
+	c     gnet.Conn
+}
+
+// ownerEntry 缓存的矿机所在节点, node 为空表示矿池连接不在其他节点上
+type ownerEntry struct {
+	node     string
+	expireAt time.Time
+}
+
+var (
+	// ownerTTL 缓存矿机所在节点的时间, 避免每个数据帧都读取共享状态
+	ownerTTL = time.Second * 5
+	// forwardQueues 同一个矿机的数据帧在同一个队列中按顺序处理, 不同的矿机之间互不阻塞
+	forwardQueues    = 16
+	forwardQueueSize = 1024
+)
+
+// joinCluster 订阅发送给当前节点的数据帧, 单个服务端时使用内存中的状态
+func (ps *Server) joinCluster() error {
+	if ps.state == nil {
+		ps.state = state.NewMemory()
+	}
+	ps.forwards = make([]chan forwardJob, forwardQueues)
+	for i := range ps.forwards {
+		ps.forwards[i] = make(chan forwardJob, forwardQueueSize)
+		go ps.runForward(ps.forwards[i])
+	}
+	return ps.state.Subscribe(ps.node, ps.onForward)
+}
+
+// onForward 接收其他节点转发过来的数据帧, 无法使用当前节点的密钥验证的数据帧会被丢弃
+func (ps *Server) onForward(data []byte) {
+	frame, err := ps.open(data)
+	if err != nil {
+		pkg.Warn("drop forward frame: %s", err)
+		return
+	}
+	pkg.Debug("server <- node %s", frame.Request)
+	ps.dispatch(forwardJob{frame: frame})
+}
+
+func (ps *Server) dispatch(job forwardJob) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(job.frame.Request.MinerId))
+	ps.forwards[h.Sum32()%uint32(len(ps.forwards))] <- job
+}
+
+func (ps *Server) runForward(jobs chan forwardJob) {
+	for job := range jobs {
+		ps.forward(job)
+	}
+}
+
+// forward 处理队列中的数据帧, 其他节点转发过来的数据帧不会再次转发
+func (ps *Server) forward(job forwardJob) {
+	defer pkg.Recover(true)
+	req := job.frame.Request
+	if job.frame.ToClient {
+		if err := ps.sendToClient(req, 3, req.ClientId, req.MinerId, false); err != nil {
+			pkg.Warn("send forward frame to client %s error: %s", req.ClientId, err)
+		}
+		return
+	}
+	if ps.Relay != nil && job.c != nil { // 中继模式下转发给上游服务端
+		waitRelay(req.ClientId)
+		if out, _ := ps.relay(req); out != nil {
+			_ = job.c.AsyncWrite(out)
+		}
+		return
+	}
+	if job.c != nil {
+		if node, ok := ps.owner(req.MinerId); ok && ps.publish(node, forwardFrame{Request: req}) {
+			return
+		}
+		out, action := ps.handle(req, job.c)
+		if out != nil {
+			_ = job.c.AsyncWrite(out)
+		}
+		if action == gnet.Close {
+			_ = job.c.Close()
+		}
+		return
+	}
+	out, _ := ps.handle(req, nil)
+	if out == nil {
+		return
+	}
+	// 响应通过持有隧道连接的节点返回给客户端
+	resp, err := protocol.Encode2Request(out)
+	if err != nil {
+		return
+	}
+	if resp.ClientId == "" {
+		resp.ClientId = req.ClientId
+	}
+	_ = ps.SendToClient(resp, 3, req.ClientId, req.MinerId)
+}
+
+// seal 使用隧道的密钥加密并签名转发的数据帧, 没有设置密钥时不加密
+func (ps *Server) seal(frame forwardFrame) ([]byte, error) {
+	data, err := msgpack.Marshal(frame)
+	if err != nil || ps.secretKey == "" {
+		return data, err
+	}
+	key := []byte(ps.secretKey)
+	data, err = pkg.AesEncrypt(data, key)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, errors.New("encrypt forward frame error")
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(data)
+	return mac.Sum(data), nil
+}
+
+// open 验证并解密其他节点转发的数据帧
+func (ps *Server) open(data []byte) (forwardFrame, error) {
+	var frame forwardFrame
+	if ps.secretKey != "" {
+		if len(data) < sha256.Size {
+			return frame, errors.New("forward frame too short")
+		}
+		key := []byte(ps.secretKey)
+		body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+		mac := hmac.New(sha256.New, key)
+		_, _ = mac.Write(body)
+		if !hmac.Equal(mac.Sum(nil), sum) {
+			return frame, errors.New("forward frame signature mismatch")
+		}
+		var err error
+		if data, err = pkg.AesDecrypt(body, key); err != nil {
+			return frame, err
+		}
+	}
+	err := msgpack.Unmarshal(data, &frame)
+	return frame, err
+}
+
+func (ps *Server) publish(node string, frame forwardFrame) bool {
+	data, err := ps.seal(frame)
+	if err != nil {
+		pkg.Warn("seal forward frame error: %s", err)
+		return false
+	}
+	if err := ps.state.Publish(node, data); err != nil {
+		pkg.Warn("forward frame to node %s error: %s", node, err)
+		return false
+	}
+	pkg.Debug("server -> node %s %s", node, frame.Request)
+	return true
+}
+
+// owner 矿机的矿池连接在其他节点上时返回该节点, 结果缓存 ownerTTL, 会读取共享状态, 不能在事件循环中调用
+func (ps *Server) owner(minerId string) (string, bool) {
+	if ps.state == nil || minerId == "" {
+		return "", false
+	}
+	if _, ok := ps.getClient(minerId); ok {
+		return "", false
+	}
+	if v, ok := ps.owners.Load(minerId); ok && time.Now().Before(v.(ownerEntry).expireAt) {
+		node := v.(ownerEntry).node
+		return node, node != ""
+	}
+	node, ok, err := ps.state.Miner(minerId)
+	if err != nil {
+		pkg.Warn("load miner %s from state error: %s", minerId, err)
+		return "", false
+	}
+	if !ok || node == ps.node {
+		node = ""
+	}
+	ps.owners.Store(minerId, ownerEntry{node: node, expireAt: time.Now().Add(ownerTTL)})
+	return node, node != ""
+}
+
+// forwardToOwner 当前节点没有矿机的矿池连接时, 在队列中查询矿机所在的节点之后转发或者在当前节点处理
+func (ps *Server) forwardToOwner(req protocol.Request, c gnet.Conn) bool {
+	switch req.Type {
+	case protocol.INIT, protocol.PING, protocol.PONG:
+		return false
+	}
+	if ps.forwards == nil || req.MinerId == "" {
+		return false
+	}
+	if _, ok := ps.getClient(req.MinerId); ok {
+		return false
+	}
+	ps.dispatch(forwardJob{frame: forwardFrame{Request: req}, c: c})
+	return true
+}
+
+// forwardToClient 当前节点没有客户端的隧道连接时通过其他节点发送
+func (ps *Server) forwardToClient(req protocol.Request, clientId string) bool {
+	if ps.state == nil {
+		return false
+	}
+	nodes, err := ps.state.Tunnels(clientId)
+	if err != nil {
+		pkg.Warn("load client %s tunnels from state error: %s", clientId, err)
+		return false
+	}
+	for _, node := range nodes {
+		if node != ps.node && ps.publish(node, forwardFrame{ToClient: true, Request: req}) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshState 在 state.TTL 之内刷新当前节点持有的矿机与隧道连接
+func (ps *Server) refreshState() {
+	if ps.state == nil {
+		return
+	}
+	clients.Range(func(key, value interface{}) bool {
+		if c := value.(*Client); !c.closed.Load() {
+			_ = ps.state.SetMiner(c.id, ps.node)
+		}
+		return true
+	})
+	conns.Range(func(key, value interface{}) bool {
+		if cd := value.(*ClientDispatch); cd.ConnCount() != 0 {
+			_ = ps.state.AddTunnel(cd.ClientId, ps.node)
+		}
+		return true
+	})
+}
+
+// stateRefreshInterval 小于 state.TTL, 节点下线之后其他节点最多在 state.TTL 之后不再转发
+var stateRefreshInterval = state.TTL / 3
+
+func (ps *Server) keepState() {
+	for {
+		time.Sleep(stateRefreshInterval)
+		ps.refreshState()
+		now := time.Now()
+		ps.owners.Range(func(key, value interface{}) bool {
+			if now.After(value.(ownerEntry).expireAt) {
+				ps.owners.Delete(key)
+			}
+			return true
+		})
+	}
+}
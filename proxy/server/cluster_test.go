@@ -0,0 +1,86 @@
+package server
+
+import (
+	"miner-proxy/proxy/protocol"
+	"miner-proxy/proxy/state"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func TestServer_forwardBetweenNodes(t *testing.T) {
+	mem := state.NewMemory()
+	defer mem.Close()
+	key := "0123456789abcdef"
+	a := &Server{pool: p, state: mem, node: "node-a", secretKey: key}
+	if err := a.joinCluster(); err != nil {
+		t.Fatal(err)
+	}
+	b := &Server{pool: p, state: mem, node: "node-b", secretKey: key}
+	received := make(chan []byte, 100)
+	if err := mem.Subscribe(b.node, func(data []byte) { received <- data }); err != nil {
+		t.Fatal(err)
+	}
+	_ = mem.SetMiner("cluster-miner", b.node)
+
+	// node-a 收到的数据帧按顺序转发给持有矿池连接的 node-b, 不在事件循环中读取共享状态
+	tunnel := &fakeTunnel{addr: &net.TCPAddr{Port: 1}, pings: atomic.NewInt64(0), closed: atomic.NewBool(false)}
+	for i := int64(1); i <= 50; i++ {
+		frame, _ := protocol.Decode2Byte(protocol.Request{
+			ClientId: "cluster-client", MinerId: "cluster-miner", Type: protocol.DATA, Seq: i,
+		})
+		if out, _ := a.React(frame, tunnel); out != nil {
+			t.Fatalf("React() = %q, want forwarded", out)
+		}
+	}
+	var first []byte
+	for i := int64(1); i <= 50; i++ {
+		select {
+		case data := <-received:
+			if first == nil {
+				first = data
+			}
+			frame, err := b.open(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.Request.Seq != i || frame.ToClient {
+				t.Fatalf("received seq %d, want %d", frame.Request.Seq, i)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("forward timeout")
+		}
+	}
+	other := &Server{secretKey: "fedcba9876543210"}
+	if _, err := other.open(first); err == nil {
+		t.Fatal("open() with another secret key succeeded")
+	}
+	if _, err := other.open(append(first[:len(first)-1:len(first)-1], first[len(first)-1]^1)); err == nil {
+		t.Fatal("open() of a tampered frame succeeded")
+	}
+
+	// node-b 通过持有隧道连接的 node-a 发送给客户端
+	cd := NewClientDispatch("cluster-client", "", "")
+	cd.SetConn("cluster-conn", tunnel)
+	conns.Store(cd.ClientId, cd)
+	defer conns.Delete(cd.ClientId)
+	if !b.publish(a.node, forwardFrame{ToClient: true, Request: protocol.Request{
+		ClientId: cd.ClientId, MinerId: "cluster-miner", Type: protocol.CLOSE,
+	}}) {
+		t.Fatal("publish() failed")
+	}
+	_ = mem.Publish(a.node, []byte("forged"))
+	deadline := time.Now().Add(time.Second * 3)
+	for tunnel.pings.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("forward to client timeout")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if n := tunnel.pings.Load(); n != 1 {
+		t.Fatalf("tunnel written %d times, want 1", n)
+	}
+}
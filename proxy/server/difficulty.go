@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"miner-proxy/proxy/backend"
+	"path"
+)
+
+// DifficultyRule 矿机授权之后向矿池建议的难度, 只对非聚合的 stratum v1 矿池连接生效
+type DifficultyRule struct {
+	// Clients 规则生效的客户端id, 为空时对所有客户端生效
+	Clients []string `json:"clients"`
+	// Worker 矿工名称的通配符, 例如 "*.small*", 为空时匹配所有矿工
+	Worker string `json:"worker"`
+	// Difficulty 建议的难度
+	Difficulty float64 `json:"difficulty"`
+	// Mode suggest(默认) 发送 mining.suggest_difficulty; password 在授权密码中加入 d=难度
+	Mode string `json:"mode"`
+}
+
+// checkDifficulty 检查难度规则
+func (p *PoolPolicy) checkDifficulty() error {
+	for i, v := range p.Difficulty {
+		if v.Difficulty <= 0 {
+			return fmt.Errorf("difficulty rule %d: difficulty must be greater than 0", i)
+		}
+		switch v.Mode {
+		case "":
+			p.Difficulty[i].Mode = backend.DifficultySuggest
+		case backend.DifficultySuggest, backend.DifficultyPassword:
+		default:
+			return fmt.Errorf("difficulty rule %d: unsupported mode %s", i, v.Mode)
+		}
+		if _, err := path.Match(v.Worker, ""); err != nil {
+			return fmt.Errorf("difficulty rule %d: invalid worker pattern %s", i, v.Worker)
+		}
+	}
+	return nil
+}
+
+func (r DifficultyRule) match(clientId, worker string) bool {
+	if !clientMatches(r.Clients, clientId) {
+		return false
+	}
+	if r.Worker == "" {
+		return true
+	}
+	ok, _ := path.Match(r.Worker, worker)
+	return ok
+}
+
+// difficultyFunc 返回客户端的难度规则, 没有规则时返回 nil
+func (p *PoolPolicy) difficultyFunc(clientId string) backend.DifficultyFunc {
+	if p == nil || len(p.Difficulty) == 0 {
+		return nil
+	}
+	return func(worker string) (backend.DifficultyOverride, bool) {
+		for _, v := range p.Difficulty {
+			if v.match(clientId, worker) {
+				return backend.DifficultyOverride{Difficulty: v.Difficulty, Mode: v.Mode}, true
+			}
+		}
+		return backend.DifficultyOverride{}, false
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/tls"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/protocol"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	// directClientPrefix 直连矿机的客户端id前缀, 同一个监听地址的矿机属于同一个客户端
+	directClientPrefix = "direct-"
+)
+
+// listenStratum 监听矿机直接连接的 stratum 端口, tlsConfig 不为空时使用 tls, 返回实际监听的地址
+func (ps *Server) listenStratum(address string, tlsConfig *tls.Config) (net.Addr, error) {
+	var l net.Listener
+	var err error
+	if tlsConfig != nil {
+		l, err = tls.Listen("tcp", address, tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "listen stratum %s error", address)
+	}
+	clientId := directClientPrefix + address
+	if tlsConfig != nil {
+		clientId += "-tls"
+	}
+	conns.LoadOrStore(clientId, NewClientDispatch(clientId, ps.PoolAddress, l.Addr().String()))
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				pkg.Error("accept stratum connection error: %s", err)
+				return
+			}
+			go ps.serveDirect(conn, clientId)
+		}
+	}()
+	return l.Addr(), nil
+}
+
+// directData 矿池发送给直接连接的矿机的数据, at 为到达服务端的时间
+type directData struct {
+	data []byte
+	at   time.Time
+}
+
+// serveDirect 没有客户端的矿机直接连接到服务端, 与隧道中的矿机使用同样的 Client 和矿池连接
+func (ps *Server) serveDirect(conn net.Conn, clientId string) {
+	defer conn.Close()
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	req := protocol.Request{
+		ClientId: clientId,
+		MinerId:  ksuid.New().String(),
+		Type:     protocol.LOGIN,
+		Data:     protocol.DecodeLoginRequest2Byte(protocol.LoginRequest{MinerIp: ip}),
+	}
+	c := new(Client)
+	if err := c.Init(req, ps.Config, clientId); err != nil {
+		pkg.Warn("miner %s connect mine pool error: %s", ip, err)
+		return
+	}
+	defer c.Close()
+	clients.Store(req.MinerId, c)
+	pkg.Debug("miner %s connect to server directly", ip)
+	_ = ps.pool.Submit(c.pool.Start)
+
+	// 矿池的数据到达时记录时间, 任务传播延迟包括等待前面的数据写入矿机的时间
+	arrived := make(chan directData, 32)
+	go func() {
+		defer close(arrived)
+		for data := range c.output {
+			arrived <- directData{data: data, at: time.Now()}
+		}
+	}()
+	go func() {
+		defer conn.Close()
+		for v := range arrived {
+			if _, err := conn.Write(v.data); err != nil {
+				pkg.Debug("write miner %s error: %s", ip, err)
+				c.Close()
+				for range arrived { // 矿池连接关闭之前丢弃剩下的数据
+				}
+				return
+			}
+			if isJobNotify(v.data) {
+				c.latency.add(time.Since(v.at))
+			}
+			c.dataSize.Add(int64(len(v.data)))
+		}
+	}()
+
+	for !c.closed.Load() {
+		data := make([]byte, 1024)
+		n, err := conn.Read(data)
+		if err != nil {
+			return
+		}
+		if !ps.sendInput(c, data[:n]) {
+			return
+		}
+		c.dataSize.Add(int64(n))
+	}
+}
+
+// sendInput 发送矿机的数据给矿池连接, 连接已经关闭时返回 false
+func (ps *Server) sendInput(c *Client, data []byte) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			ok = false
+		}
+	}()
+	c.input <- data
+	return true
+}
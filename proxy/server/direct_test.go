@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_listenStratum(t *testing.T) {
+	pool, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	go func() {
+		conn, err := pool.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("pool:" + line))
+		}
+	}()
+
+	ps := &Server{pool: p, Config: Config{PoolAddress: pool.Addr().String()}}
+	addr, err := ps.listenStratum("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miner, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer miner.Close()
+	_ = miner.SetDeadline(time.Now().Add(time.Second * 3))
+	if _, err := miner.Write([]byte(`{"id":1,"method":"mining.subscribe","params":[]}` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(miner).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "pool:") {
+		t.Fatalf("read = %q, %v", line, err)
+	}
+
+	var found bool
+	for _, v := range ClientInfo() {
+		if v.ClientId == directClientPrefix+"127.0.0.1:0" && len(v.Miners) == 1 && v.Miners[0].Ip == "127.0.0.1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("direct miner not found in ClientInfo()")
+	}
+}
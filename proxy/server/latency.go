@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// jobLatencySamples 每个矿机保留最近多少个任务的传播延迟
+	jobLatencySamples = 256
+)
+
+var methodNotify = []byte("mining.notify")
+
+// isJobNotify 矿池发送给矿机的数据中是否包含新的任务
+func isJobNotify(data []byte) bool {
+	return bytes.Contains(data, methodNotify)
+}
+
+// JobLatency 任务从矿池到达服务端到写入矿机连接的延迟分位数
+type JobLatency struct {
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Count int
+}
+
+func (l JobLatency) String() string {
+	if l.Count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("p50 %s / p95 %s / p99 %s", l.P50, l.P95, l.P99)
+}
+
+// latencyWindow 最近 jobLatencySamples 个任务的传播延迟
+type latencyWindow struct {
+	m       sync.Mutex
+	samples []time.Duration
+	next    int
+	// send 最近一个任务从到达服务端到写入隧道连接的时间
+	send time.Duration
+}
+
+func newLatencyWindow() *latencyWindow {
+	return &latencyWindow{samples: make([]time.Duration, 0, jobLatencySamples)}
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	if w == nil {
+		return
+	}
+	if d < 0 {
+		d = 0
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	if len(w.samples) < jobLatencySamples {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % jobLatencySamples
+}
+
+func (w *latencyWindow) sent(d time.Duration) {
+	if w == nil {
+		return
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.send = d
+}
+
+func (w *latencyWindow) lastSend() time.Duration {
+	if w == nil {
+		return 0
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.send
+}
+
+func (w *latencyWindow) values() []time.Duration {
+	if w == nil {
+		return nil
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	return append([]time.Duration(nil), w.samples...)
+}
+
+// percentiles 使用 nearest-rank 计算分位数
+func percentiles(samples []time.Duration) JobLatency {
+	if len(samples) == 0 {
+		return JobLatency{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	rank := func(p int) time.Duration {
+		index := (p*len(sorted)+99)/100 - 1
+		if index < 0 {
+			index = 0
+		}
+		return sorted[index]
+	}
+	return JobLatency{P50: rank(50), P95: rank(95), P99: rank(99), Count: len(sorted)}
+}
+
+// jobLatency 根据客户端回复的 ACK 计算任务传播延迟, stamp 为任务到达服务端的时间
+// send 为服务端写入隧道连接的耗时, delay 为客户端返回的从收到任务到写入矿机完成的耗时, 服务端到客户端的单程延迟使用往返延迟的一半
+// 旧版本的客户端不返回 delay, 使用收到 ACK 的时间减去客户端到服务端的单程延迟估算
+func jobLatency(stamp int64, now time.Time, rtt, send, delay time.Duration) time.Duration {
+	d := send + rtt/2 + delay
+	if delay <= 0 {
+		d = now.Sub(time.Unix(0, stamp)) - rtt/2
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentiles(t *testing.T) {
+	var samples []time.Duration
+	for i := 100; i >= 1; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		want    JobLatency
+	}{
+		{"empty", nil, JobLatency{}},
+		{"single", []time.Duration{time.Second}, JobLatency{time.Second, time.Second, time.Second, 1}},
+		{"hundred", samples, JobLatency{50 * time.Millisecond, 95 * time.Millisecond, 99 * time.Millisecond, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentiles(tt.samples); got != tt.want {
+				t.Errorf("percentiles() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	w := newLatencyWindow()
+	for i := 0; i < jobLatencySamples+10; i++ {
+		w.add(time.Duration(i))
+	}
+	values := w.values()
+	if len(values) != jobLatencySamples {
+		t.Fatalf("len(values) = %d, want %d", len(values), jobLatencySamples)
+	}
+	if values[0] != jobLatencySamples || values[10] != 10 {
+		t.Errorf("oldest samples not replaced: %v", values[:11])
+	}
+}
+
+func TestJobLatency(t *testing.T) {
+	now := time.Now()
+	stamp := now.Add(-30 * time.Millisecond).UnixNano()
+	tests := []struct {
+		name             string
+		rtt, send, delay time.Duration
+		want             time.Duration
+	}{
+		{"measured", 20 * time.Millisecond, time.Millisecond, 5 * time.Millisecond, 16 * time.Millisecond},
+		{"old client", 20 * time.Millisecond, time.Millisecond, 0, 20 * time.Millisecond},
+		{"old client slow ack", time.Second, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jobLatency(stamp, now, tt.rtt, tt.send, tt.delay); got != tt.want {
+				t.Errorf("jobLatency() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
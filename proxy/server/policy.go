@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"miner-proxy/proxy/backend"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPoolRefused 客户端请求的矿池不在白名单中
+	ErrPoolRefused = errors.New("pool refused by server policy")
+)
+
+// RewriteRule 将客户端请求的矿池替换为指定的地址
+type RewriteRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// PoolPolicy 服务端的矿池访问策略, 规则格式为 host:port, host 支持通配符(*.f2pool.com), 省略端口或者端口为*表示任意端口
+// 默认矿池与备用矿池总是允许的; 客户端在 Clients 中有规则时只使用客户端的规则, 否则使用 Allow
+// Allow 与 Clients 都为空时拒绝其他矿池, 只有设置 AllowAny 才允许客户端连接任意地址
+type PoolPolicy struct {
+	// AllowAny 没有白名单时允许客户端连接任意地址, 此时服务端是一个开放的中继, 任何知道密钥的客户端都可以用它连接任意 host:port
+	AllowAny bool `json:"allow_any"`
+	// Allow 所有客户端都可以使用的矿池
+	Allow []string `json:"allow"`
+	// Clients 客户端id -> 该客户端可以使用的矿池
+	Clients map[string][]string `json:"clients"`
+	// Rewrite 按照顺序匹配, 第一个匹配的规则生效
+	Rewrite []RewriteRule `json:"rewrite"`
+	// Schedule 按照时间切换矿池, 按照顺序匹配, 第一个匹配的规则生效
+	Schedule []ScheduleRule `json:"schedule"`
+	// Difficulty 按照客户端与矿工名称建议难度, 按照顺序匹配, 第一个匹配的规则生效
+	Difficulty []DifficultyRule `json:"difficulty"`
+	// Workers 改写矿工名, 按照顺序匹配, 第一个匹配的规则生效
+	Workers []WorkerRule `json:"workers"`
+}
+
+// LoadPoolPolicy 从 json 文件中加载策略, path 为空时返回空策略
+func LoadPoolPolicy(path string) (*PoolPolicy, error) {
+	policy := new(PoolPolicy)
+	if path == "" {
+		return policy, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read pool policy %s error: %w", path, err)
+	}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("parse pool policy %s error: %w", path, err)
+	}
+	if err := policy.compileSchedule(); err != nil {
+		return nil, fmt.Errorf("parse pool policy %s error: %w", path, err)
+	}
+	if err := policy.checkDifficulty(); err != nil {
+		return nil, fmt.Errorf("parse pool policy %s error: %w", path, err)
+	}
+	if err := policy.compileWorkers(); err != nil {
+		return nil, fmt.Errorf("parse pool policy %s error: %w", path, err)
+	}
+	return policy, nil
+}
+
+// IsEmpty 策略是否没有白名单
+func (p *PoolPolicy) IsEmpty() bool {
+	return p == nil || (len(p.Allow) == 0 && len(p.Clients) == 0)
+}
+
+// IsOpen 是否允许客户端连接任意地址
+func (p *PoolPolicy) IsOpen() bool {
+	return p.IsEmpty() && p != nil && p.AllowAny
+}
+
+// ruleEndpoint 去掉规则中的协议, 返回 host 与 port, 规则只由服务端配置
+func ruleEndpoint(rule string) (string, string) {
+	if index := strings.Index(rule, "://"); index >= 0 {
+		rule = rule[index+3:]
+	}
+	host, port, err := net.SplitHostPort(rule)
+	if err != nil {
+		return strings.ToLower(rule), ""
+	}
+	return strings.ToLower(host), port
+}
+
+// poolEndpoint 使用与拨号相同的解析方式返回矿池实际连接的 host 与 port, 无法解析时返回 false
+func poolEndpoint(address string) (string, string, bool) {
+	addr, err := backend.ParsePoolAddress(address)
+	if err != nil {
+		return "", "", false
+	}
+	host, port, err := net.SplitHostPort(addr.Host)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.ToLower(host), port, true
+}
+
+// matchPool 矿池地址是否匹配规则, 无法解析的地址不匹配任何规则, 矿池组只匹配同名的矿池组
+func matchPool(rule, address string) bool {
+	if backend.IsGroupAddress(address) {
+		return backend.IsGroupAddress(rule) && backend.GroupName(rule) == backend.GroupName(address)
+	}
+	host, port, ok := poolEndpoint(address)
+	if !ok {
+		return false
+	}
+	ruleHost, rulePort := ruleEndpoint(rule)
+	if rulePort != "" && rulePort != "*" && rulePort != port {
+		return false
+	}
+	ok, _ = path.Match(ruleHost, host)
+	return ok
+}
+
+// clientMatches 规则是否对客户端生效, clients 为空时对所有客户端生效
+func clientMatches(clients []string, clientId string) bool {
+	if len(clients) == 0 {
+		return true
+	}
+	for _, v := range clients {
+		if v == clientId {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(rules []string, address string) bool {
+	for _, v := range rules {
+		if matchPool(v, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed 客户端是否可以使用该矿池
+func (p *PoolPolicy) Allowed(clientId, address string) bool {
+	if p.IsEmpty() {
+		return p != nil && p.AllowAny
+	}
+	if rules, ok := p.Clients[clientId]; ok {
+		return matchAny(rules, address)
+	}
+	return matchAny(p.Allow, address)
+}
+
+// rewrite 返回替换之后的矿池地址
+func (p *PoolPolicy) rewrite(address string) string {
+	if p == nil {
+		return address
+	}
+	for _, v := range p.Rewrite {
+		if matchPool(v.From, address) {
+			return v.To
+		}
+	}
+	return address
+}
+
+// Resolve 检查客户端请求的矿池并且返回实际连接的矿池地址与备用矿池
+func (c Config) Resolve(clientId, address string) (string, []string, error) {
+	target, backups, err := c.resolveTarget(clientId, address, time.Now())
+	if err != nil {
+		return "", nil, err
+	}
+	return c.selectGroup(target, backups)
+}
+
+// resolveTarget 检查客户端请求的矿池, 返回经过替换与时间表之后的目标地址, 目标地址可能是矿池组
+func (c Config) resolveTarget(clientId, address string, now time.Time) (string, []string, error) {
+	target, backups := address, []string(nil)
+	switch {
+	case address == "" || address == c.PoolAddress: // 备用矿池只对默认矿池生效
+		target, backups = c.PoolAddress, c.BackupPools
+	case backend.IsGroupAddress(address): // 矿池组由服务端配置, 总是允许的
+	default:
+		if _, err := backend.ParsePoolAddress(address); err != nil {
+			return "", nil, err
+		}
+		if !matchAny(c.BackupPools, address) && !c.Policy.Allowed(clientId, address) {
+			return "", nil, fmt.Errorf("%w: %s", ErrPoolRefused, address)
+		}
+		target = c.Policy.rewrite(address)
+	}
+	if to, ok := c.Policy.scheduled(clientId, target, now); ok {
+		return to, nil, nil
+	}
+	return target, backups, nil
+}
+
+// selectGroup 地址为矿池组时返回组中当前最快的端点, 其他端点按照延迟排在备用矿池之前
+func (c Config) selectGroup(address string, backups []string) (string, []string, error) {
+	if !backend.IsGroupAddress(address) {
+		return address, backups, nil
+	}
+	g, ok := c.PoolGroups[backend.GroupName(address)]
+	if !ok {
+		return "", nil, fmt.Errorf("pool group %s not found", backend.GroupName(address))
+	}
+	selected, others := g.Select()
+	return selected, append(others, backups...), nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/client"
+	"miner-proxy/proxy/protocol"
+	"sync"
+
+	"github.com/panjf2000/gnet"
+)
+
+// RelayConfig 中继模式, 客户端的数据帧不连接矿池, 原样通过隧道转发给上游服务端
+type RelayConfig struct {
+	// Address 上游服务端地址, 多个使用,分割, 格式与客户端的 -r 参数相同
+	Address string
+	// SecretKey 连接上游服务端使用的密钥
+	SecretKey string
+	// MinConn, MaxConn 每一个客户端连接上游服务端的隧道数量
+	MinConn, MaxConn int
+}
+
+// startRelay 上游服务端发送的数据帧通过持有客户端隧道连接的节点原样发送给客户端
+func (ps *Server) startRelay() {
+	client.SetRelay(func(clientId string, req protocol.Request) {
+		_ = ps.pool.Submit(func() {
+			if err := ps.SendToClient(req, 3, clientId, req.MinerId); err != nil {
+				pkg.Warn("relay frame to client %s error: %s", clientId, err)
+			}
+		})
+	})
+}
+
+// relayInits 客户端id -> 连接上游服务端完成之后关闭的 chan
+var relayInits sync.Map
+
+// relayInit 客户端的第一个隧道连接建立时使用客户端的id, 矿池与ip连接上游服务端
+// 连接上游服务端在协程池中进行, 失败时断开隧道连接, 客户端重新连接时重试
+func (ps *Server) relayInit(clientId, pool, ip string, c gnet.Conn) {
+	done := make(chan struct{})
+	if _, loaded := relayInits.LoadOrStore(clientId, done); loaded {
+		return
+	}
+	_ = ps.pool.Submit(func() {
+		defer close(done)
+		err := client.InitRelayManage(ps.Relay.MinConn, ps.Relay.MaxConn, ps.Relay.SecretKey, ps.Relay.Address, clientId, pool, ip)
+		if err != nil {
+			relayInits.Delete(clientId)
+			pkg.Warn("client %s connect to upstream server error: %s", clientId, err)
+			_ = c.Close()
+		}
+	})
+}
+
+// waitRelay 等待客户端连接上游服务端完成
+func waitRelay(clientId string) {
+	if v, ok := relayInits.Load(clientId); ok {
+		<-v.(chan struct{})
+	}
+}
+
+// relay 把客户端的数据帧原样转发给上游服务端, DATA 转发失败时由客户端重新发送
+func (ps *Server) relay(req protocol.Request) (out []byte, action gnet.Action) {
+	err := client.Relay(req)
+	if err == nil {
+		return nil, gnet.None
+	}
+	pkg.Warn("relay %s to upstream error: %s", req, err)
+	switch {
+	case req.Type == protocol.LOGIN:
+		out, _ = protocol.Decode2Byte(protocol.NewErrorRequest(req.MinerId, protocol.ErrPoolUnavailable, err.Error()))
+	case req.Type == protocol.DATA && !isRelayMiner(req.MinerId):
+		out, _ = protocol.Decode2Byte(protocol.NewErrorRequest(req.MinerId, protocol.ErrNeedLogin, "need login"))
+	}
+	return out, gnet.None
+}
+
+func isRelayMiner(minerId string) bool {
+	return client.IsRelayMiner(minerId)
+}
+
+func relayMiners() map[string][]string {
+	return client.RelayMiners()
+}
+
+// relayClose 客户端已经没有该矿机, 通知上游服务端关闭矿池连接, 与矿机的其他数据帧在同一个队列中按顺序发送
+func (ps *Server) relayClose(clientId, minerId string, c gnet.Conn) {
+	req := protocol.Request{ClientId: clientId, MinerId: minerId, Type: protocol.CLOSE}
+	if ps.forwards == nil || c == nil {
+		_ = client.Relay(req)
+		return
+	}
+	ps.dispatch(forwardJob{frame: forwardFrame{Request: req}, c: c})
+}
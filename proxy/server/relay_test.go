@@ -0,0 +1,35 @@
+package server
+
+import (
+	"miner-proxy/proxy/protocol"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/gnet"
+	"go.uber.org/atomic"
+)
+
+func TestServer_relayInit(t *testing.T) {
+	ps := &Server{pool: p, Config: Config{Relay: &RelayConfig{Address: "127.0.0.1:1", MinConn: 1, MaxConn: 1}}}
+	tunnel := &fakeTunnel{addr: &net.TCPAddr{Port: 2}, pings: atomic.NewInt64(0), closed: atomic.NewBool(false)}
+	defer conns.Delete("relay-client")
+	defer connId2Id.Delete(tunnel.addr.String())
+
+	// 上游服务端不可用时不阻塞事件循环, 连接失败之后断开隧道连接
+	_, action := ps.init(protocol.Request{ClientId: "relay-client", Type: protocol.INIT, Data: []byte("pool|m1|1.1.1.1")}, tunnel)
+	if action != gnet.None {
+		t.Fatalf("init() action = %v, want None", action)
+	}
+	deadline := time.Now().Add(time.Second * 10)
+	for !tunnel.closed.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel not closed after upstream connect error")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	waitRelay("relay-client")
+	if _, ok := relayInits.Load("relay-client"); ok {
+		t.Fatal("failed relay init not removed")
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/backend"
+	"time"
+)
+
+var (
+	// ErrInvalidToken 恢复会话的令牌与服务端上的会话不一致, 或者会话不支持恢复
+	ErrInvalidToken = errors.New("invalid resume token")
+)
+
+// resume 客户端重启之后矿机使用之前的矿机id与令牌重新连接服务端上还在运行的会话
+// 矿池连接保持不变, 矿机重新发送的握手由矿池连接在本地响应
+func (c *Client) resume(token string) error {
+	if token != c.token {
+		return ErrInvalidToken
+	}
+	r, ok := c.pool.(backend.Reattacher)
+	if !ok || !r.Reattach() {
+		return ErrInvalidToken
+	}
+	c.SetReady() // 发送给之前矿机连接的数据不再重发
+	return nil
+}
+
+// online 客户端在当前节点或者其他节点上还有隧道连接
+func (ps *Server) online(clientId string) bool {
+	if v, ok := conns.Load(clientId); ok && v.(*ClientDispatch).ConnCount() != 0 {
+		return true
+	}
+	if ps.state == nil {
+		return false
+	}
+	nodes, err := ps.state.Tunnels(clientId)
+	if err != nil { // 无法确认时当作在线, 由发送失败处理
+		return true
+	}
+	for _, node := range nodes {
+		if node != ps.node {
+			return true
+		}
+	}
+	return false
+}
+
+// detached 客户端已经没有隧道连接, 矿机的会话需要保留等待客户端重新连接
+func (ps *Server) detached(c *Client) bool {
+	return ps.ResumeWindow > 0 && !ps.online(c.clientId)
+}
+
+// waitAttach 客户端没有隧道连接时暂停发送矿池的数据, 矿池连接保持不变
+// 在 ResumeWindow 之内客户端重新连接或者矿机使用令牌恢复了会话时返回 true, 否则返回 false 关闭会话
+func (ps *Server) waitAttach(c *Client) bool {
+	pkg.Info("client %s 没有可用的隧道连接, 矿机 %s 的会话保留 %s", c.clientId, c.id, ps.ResumeWindow)
+	deadline := time.NewTimer(ps.ResumeWindow)
+	defer deadline.Stop()
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for !c.closed.Load() {
+		select {
+		case <-c.readyChan: // 矿机恢复了会话
+			return true
+		case <-t.C:
+			if ps.online(c.clientId) {
+				return true
+			}
+		case <-deadline.C:
+			pkg.Warn("client %s 在 %s 之内没有重新连接, 关闭矿机 %s 的会话", c.clientId, ps.ResumeWindow, c.id)
+			return false
+		}
+	}
+	return false
+}
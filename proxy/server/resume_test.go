@@ -0,0 +1,93 @@
+package server
+
+import (
+	"miner-proxy/proxy/protocol"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// reattachPool 记录是否调用了 Reattach, support 为 false 时不支持重新连接
+type reattachPool struct {
+	switchPool
+	support, reattached bool
+}
+
+func (p *reattachPool) Reattach() bool {
+	p.reattached = true
+	return p.support
+}
+
+func TestServer_login_resume(t *testing.T) {
+	tests := []struct {
+		name        string
+		token       string
+		support     bool
+		wantType    protocol.RequestType
+		wantResumed bool
+	}{
+		{name: "resume", token: "token", support: true, wantType: protocol.LOGIN, wantResumed: true},
+		{name: "token mismatch", token: "other", support: true, wantType: protocol.ERROR},
+		{name: "pool not support reattach", token: "token", wantType: protocol.ERROR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := &reattachPool{support: tt.support}
+			c := &Client{id: "resume-miner", clientId: "farm", pool: pool, token: "token",
+				closed: atomic.NewBool(false), ready: atomic.NewBool(false), readyChan: make(chan struct{}, 1),
+				received: atomic.NewInt64(7)}
+			clients.Store(c.id, c)
+			defer clients.Delete(c.id)
+
+			ps := &Server{}
+			out, _ := ps.login(protocol.Request{ClientId: "farm", MinerId: c.id, Type: protocol.LOGIN,
+				Data: protocol.DecodeLoginRequest2Byte(protocol.LoginRequest{ResumeToken: tt.token})}, nil)
+			resp, err := protocol.Encode2Request(out)
+			if err != nil || resp.Type != tt.wantType {
+				t.Fatalf("login() = %s, %v, want %s", resp, err, tt.wantType)
+			}
+			if resp.Type == protocol.ERROR {
+				if e := protocol.Encode2ErrorResponse(resp.Data); e.Code != protocol.ErrNeedLogin {
+					t.Fatalf("error = %s, want need_login", e)
+				}
+				if c.ready.Load() {
+					t.Fatal("failed resume should not release the pending frame")
+				}
+				return
+			}
+			login, err := protocol.Encode2LoginResponse(resp.Data)
+			if err != nil || login.Resumed != tt.wantResumed || login.Token != "token" || login.Seq != 7 {
+				t.Fatalf("login response = %+v, %v", login, err)
+			}
+			if !pool.reattached || !c.ready.Load() {
+				t.Fatal("resumed session should reattach the pool connection and be ready")
+			}
+		})
+	}
+}
+
+func TestServer_waitAttach(t *testing.T) {
+	ps := &Server{Config: Config{ResumeWindow: time.Millisecond * 200}}
+	newClient := func() *Client {
+		return &Client{id: "detached-miner", clientId: "detached-client", closed: atomic.NewBool(false),
+			ready: atomic.NewBool(false), readyChan: make(chan struct{})}
+	}
+	c := newClient()
+	if !ps.detached(c) {
+		t.Fatal("client without tunnels should be detached")
+	}
+	start := time.Now()
+	if ps.waitAttach(c) || time.Since(start) < ps.ResumeWindow {
+		t.Fatal("waitAttach() should keep the session for the resume window and then give up")
+	}
+
+	c = newClient()
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		c.SetReady() // 矿机使用令牌恢复了会话
+	}()
+	if !ps.waitAttach(c) {
+		t.Fatal("waitAttach() should return after the session is resumed")
+	}
+}
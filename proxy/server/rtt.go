@@ -0,0 +1,213 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// rttHistory 每个隧道连接保留多长时间的往返延迟记录
+	rttHistory = time.Hour
+	// rttStale 超过该时间没有收到 PONG 时认为延迟未知
+	rttStale = time.Minute * 2
+)
+
+// rttBuckets 往返延迟直方图的区间上限, 最后一个区间没有上限
+var rttBuckets = []struct {
+	name  string
+	upper time.Duration
+}{
+	{"<10ms", time.Millisecond * 10},
+	{"<25ms", time.Millisecond * 25},
+	{"<50ms", time.Millisecond * 50},
+	{"<100ms", time.Millisecond * 100},
+	{"<250ms", time.Millisecond * 250},
+	{"<500ms", time.Millisecond * 500},
+	{"<1s", time.Second},
+	{">=1s", 0},
+}
+
+// RTTSample 一次 PING/PONG 的往返延迟, RTT 的单位为纳秒
+type RTTSample struct {
+	Time time.Time     `json:"time"`
+	RTT  time.Duration `json:"rtt"`
+}
+
+// rttStats 一个隧道连接的往返延迟统计
+type rttStats struct {
+	m         sync.Mutex
+	last      RTTSample
+	avg       time.Duration
+	min, max  time.Duration
+	count     int64
+	histogram []int64
+	history   []RTTSample
+}
+
+func newRTTStats() *rttStats {
+	return &rttStats{histogram: make([]int64, len(rttBuckets))}
+}
+
+func rttBucket(rtt time.Duration) int {
+	for i, v := range rttBuckets {
+		if v.upper == 0 || rtt < v.upper {
+			return i
+		}
+	}
+	return len(rttBuckets) - 1
+}
+
+// add 记录一次往返延迟, 平均值与 tcp 的 SRTT 一样使用 1/8 的权重
+func (s *rttStats) add(now time.Time, rtt time.Duration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.last = RTTSample{Time: now, RTT: rtt}
+	if s.count == 0 {
+		s.avg, s.min, s.max = rtt, rtt, rtt
+	} else {
+		s.avg += (rtt - s.avg) / 8
+		if rtt < s.min {
+			s.min = rtt
+		}
+		if rtt > s.max {
+			s.max = rtt
+		}
+	}
+	s.count++
+	s.histogram[rttBucket(rtt)]++
+	s.history = append(s.history, s.last)
+	index := sort.Search(len(s.history), func(i int) bool {
+		return now.Sub(s.history[i].Time) <= rttHistory
+	})
+	s.history = append(s.history[:0], s.history[index:]...)
+}
+
+// RTTStatus 隧道连接的往返延迟
+type RTTStatus struct {
+	Last    string `json:"last"`
+	Average string `json:"average"`
+	Min     string `json:"min"`
+	Max     string `json:"max"`
+	Count   int64  `json:"count"`
+	// Histogram 延迟区间 -> 次数
+	Histogram map[string]int64 `json:"histogram"`
+	// History 最近一小时的往返延迟
+	History  []RTTSample `json:"history"`
+	LastTime time.Time   `json:"last_time"`
+}
+
+func (s *rttStats) status() RTTStatus {
+	s.m.Lock()
+	defer s.m.Unlock()
+	result := RTTStatus{
+		Count:     s.count,
+		Histogram: make(map[string]int64, len(rttBuckets)),
+		History:   append([]RTTSample(nil), s.history...),
+		LastTime:  s.last.Time,
+	}
+	for i, v := range rttBuckets {
+		result.Histogram[v.name] = s.histogram[i]
+	}
+	if s.count != 0 {
+		result.Last, result.Average = s.last.RTT.String(), s.avg.String()
+		result.Min, result.Max = s.min.String(), s.max.String()
+	}
+	return result
+}
+
+// recent 返回平均往返延迟, 超过 rttStale 没有测量时返回 false
+func (s *rttStats) recent(now time.Time) (time.Duration, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.count == 0 || now.Sub(s.last.Time) > rttStale {
+		return 0, false
+	}
+	return s.avg, true
+}
+
+// TunnelStatus 客户端的一个隧道连接
+type TunnelStatus struct {
+	ClientId   string `json:"client_id"`
+	ConnId     string `json:"conn_id"`
+	RemoteAddr string `json:"remote_addr"`
+	// Healthy 心跳超时的连接不再用于发送数据
+	Healthy bool `json:"healthy"`
+	// Missed 连续没有响应的心跳次数
+	Missed int64 `json:"missed"`
+	// Inflight 等待 ACK 的数据帧, Frames 发送的数据帧总数
+	Inflight int64 `json:"inflight"`
+	Frames   int64 `json:"frames"`
+	RTTStatus
+}
+
+// TunnelStatuses 所有隧道连接的往返延迟
+func TunnelStatuses() []TunnelStatus {
+	result := make([]TunnelStatus, 0)
+	conns.Range(func(key, value interface{}) bool {
+		cd := value.(*ClientDispatch)
+		cd.conns.Range(func(key, value interface{}) bool {
+			c := value.(*Conn)
+			if c.rtt == nil {
+				return true
+			}
+			status := TunnelStatus{ClientId: cd.ClientId, ConnId: c.Id, Healthy: c.Healthy(), RTTStatus: c.rtt.status()}
+			if c.missed != nil {
+				status.Missed = c.missed.Load()
+			}
+			if c.frames != nil {
+				status.Inflight, status.Frames = c.inflight.Load(), c.frames.Load()
+			}
+			if c.Conn != nil {
+				status.RemoteAddr = c.RemoteAddr().String()
+			}
+			result = append(result, status)
+			return true
+		})
+		return true
+	})
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].ClientId != result[j].ClientId {
+			return result[i].ClientId < result[j].ClientId
+		}
+		return result[i].ConnId < result[j].ConnId
+	})
+	return result
+}
+
+// clientRTT 客户端所有隧道连接的平均往返延迟, 没有最近的测量结果时返回 false
+func (c *ClientDispatch) clientRTT(now time.Time) (time.Duration, bool) {
+	var total time.Duration
+	var count int
+	c.conns.Range(func(key, value interface{}) bool {
+		conn := value.(*Conn)
+		if conn.rtt == nil {
+			return true
+		}
+		if d, ok := conn.rtt.recent(now); ok {
+			total += d
+			count++
+		}
+		return true
+	})
+	if count == 0 {
+		return 0, false
+	}
+	return total / time.Duration(count), true
+}
+
+// clientDelay 客户端到服务端的往返延迟, 优先使用隧道连接的持续测量结果
+// 旧版本的客户端不会返回 PING 的时间戳, 此时使用第一次 PING 测量的延迟
+func clientDelay(clientId string, now time.Time) (time.Duration, bool) {
+	if v, ok := conns.Load(clientId); ok {
+		if d, ok := v.(*ClientDispatch).clientRTT(now); ok {
+			return d, true
+		}
+	}
+	v, ok := connDelay.Load(clientId)
+	if !ok {
+		return 0, false
+	}
+	d := v.(Delay).delay
+	return d, d > 0 && d.Seconds() <= 120
+}
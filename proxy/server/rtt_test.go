@@ -0,0 +1,36 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTStats(t *testing.T) {
+	s := newRTTStats()
+	start := time.Now()
+	samples := []time.Duration{80 * time.Millisecond, 5 * time.Millisecond, 2 * time.Second, 40 * time.Millisecond}
+	for i, v := range samples {
+		s.add(start.Add(time.Duration(i)*30*time.Minute), v)
+	}
+	status := s.status()
+	if status.Count != 4 || status.Min != "5ms" || status.Max != "2s" || status.Last != "40ms" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	for name, want := range map[string]int64{"<10ms": 1, "<50ms": 1, "<100ms": 1, ">=1s": 1, "<1s": 0} {
+		if status.Histogram[name] != want {
+			t.Errorf("histogram[%s] = %d, want %d", name, status.Histogram[name], want)
+		}
+	}
+	// 只保留最近一小时的记录
+	if len(status.History) != 3 || status.History[0].RTT != 5*time.Millisecond {
+		t.Errorf("unexpected history %+v", status.History)
+	}
+
+	last := start.Add(90 * time.Minute)
+	if _, ok := s.recent(last.Add(rttStale + time.Second)); ok {
+		t.Errorf("recent() should be stale")
+	}
+	if d, ok := s.recent(last); !ok || d <= 0 {
+		t.Errorf("recent() = %s, %v", d, ok)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/backend"
+	"time"
+)
+
+// ScheduleRule 时间表规则, 当前时间在 Cron 描述的窗口中时, 匹配 From 的矿池替换为 To
+type ScheduleRule struct {
+	// Cron 5个字段的 cron 表达式, 例如 "* 22-23,0-7 * * *" 表示每天22点到8点
+	Cron string `json:"cron"`
+	// Clients 规则生效的客户端id, 为空时对所有客户端生效
+	Clients []string `json:"clients"`
+	// From 客户端请求的矿池, 格式与白名单一致, 为空时匹配任意矿池
+	From string `json:"from"`
+	// To 窗口中使用的矿池, 支持矿池组
+	To string `json:"to"`
+
+	cron *pkg.Cron
+}
+
+// compileSchedule 解析时间表中的 cron 表达式
+func (p *PoolPolicy) compileSchedule() error {
+	for i, v := range p.Schedule {
+		cron, err := pkg.ParseCron(v.Cron)
+		if err != nil {
+			return err
+		}
+		if v.To == "" {
+			return fmt.Errorf("schedule %s has no target pool", v.Cron)
+		}
+		if !backend.IsGroupAddress(v.To) {
+			if _, err := backend.ParsePoolAddress(v.To); err != nil {
+				return err
+			}
+		}
+		p.Schedule[i].cron = cron
+	}
+	return nil
+}
+
+func (r ScheduleRule) match(clientId, address string, now time.Time) bool {
+	if r.cron == nil || !r.cron.Match(now) {
+		return false
+	}
+	if !clientMatches(r.Clients, clientId) {
+		return false
+	}
+	return r.From == "" || matchPool(r.From, address)
+}
+
+// scheduled 返回时间表中第一个匹配的规则的矿池
+func (p *PoolPolicy) scheduled(clientId, address string, now time.Time) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	for _, v := range p.Schedule {
+		if v.match(clientId, address, now) {
+			return v.To, true
+		}
+	}
+	return "", false
+}
+
+// applySchedule 时间窗口切换之后, 将矿机迁移到新的矿池, 支持切换的矿池连接直接重连, 否则断开矿机让矿机重新登录
+func (ps *Server) applySchedule(now time.Time) {
+	if ps.Policy == nil || len(ps.Policy.Schedule) == 0 {
+		return
+	}
+	clients.Range(func(key, value interface{}) bool {
+		c := value.(*Client)
+		if c.closed.Load() || c.pool == nil {
+			return true
+		}
+		target, backups, err := ps.resolveTarget(c.clientId, c.requested, now)
+		if err != nil || target == c.target {
+			return true
+		}
+		address, backups, err := ps.selectGroup(target, backups)
+		if err != nil {
+			pkg.Warn("schedule miner %s to %s error: %s", c.id, target, err)
+			return true
+		}
+		pkg.Info("时间表切换矿机 %s 的矿池 %s -> %s", c.id, c.target, address)
+		c.target = target
+		if s, ok := c.pool.(backend.Switcher); ok {
+			s.Switch(address, backups)
+			return true
+		}
+		c.Close()
+		return true
+	})
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"miner-proxy/pkg"
+	"miner-proxy/proxy/stratum"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+type switchPool struct {
+	addr    string
+	backups []string
+}
+
+func (p *switchPool) Start()          {}
+func (p *switchPool) Close()          {}
+func (p *switchPool) IsClosed() bool  { return false }
+func (p *switchPool) Address() string { return p.addr }
+func (p *switchPool) Dialects() (stratum.Dialect, stratum.Dialect) {
+	return stratum.DialectUnknown, stratum.DialectUnknown
+}
+func (p *switchPool) Difficulty() float64 { return 0 }
+func (p *switchPool) Switch(addr string, backups []string) {
+	p.addr, p.backups = addr, backups
+}
+
+func TestServer_applySchedule(t *testing.T) {
+	night, _ := pkg.ParseCron("* 22-23,0-7 * * *")
+	config := Config{
+		PoolAddress: "day.pool.com:3333",
+		BackupPools: []string{"backup.pool.com:3333"},
+		Policy: &PoolPolicy{Schedule: []ScheduleRule{
+			{Clients: []string{"farm"}, To: "night.pool.com:3333", cron: night},
+		}},
+	}
+	at := func(hour int) time.Time {
+		return time.Date(2022, 3, 7, hour, 0, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name     string
+		clientId string
+		now      time.Time
+		want     string
+	}{
+		{name: "day", clientId: "farm", now: at(12), want: "day.pool.com:3333"},
+		{name: "night", clientId: "farm", now: at(23), want: "night.pool.com:3333"},
+		{name: "other client", clientId: "other", now: at(23), want: "day.pool.com:3333"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := config.resolveTarget(tt.clientId, "", tt.now)
+			if err != nil || got != tt.want {
+				t.Errorf("resolveTarget() = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	pool := &switchPool{addr: "day.pool.com:3333"}
+	c := &Client{id: "schedule-miner", clientId: "farm", target: "day.pool.com:3333",
+		pool: pool, closed: atomic.NewBool(false)}
+	clients.Store(c.id, c)
+	defer clients.Delete(c.id)
+	ps := &Server{Config: config}
+
+	ps.applySchedule(at(12))
+	if pool.addr != "day.pool.com:3333" {
+		t.Fatalf("pool switched during day: %s", pool.addr)
+	}
+	ps.applySchedule(at(22))
+	if pool.addr != "night.pool.com:3333" || len(pool.backups) != 0 {
+		t.Fatalf("pool not switched at night: %s %v", pool.addr, pool.backups)
+	}
+	ps.applySchedule(at(8))
+	if pool.addr != "day.pool.com:3333" || len(pool.backups) != 1 {
+		t.Fatalf("pool not switched back: %s %v", pool.addr, pool.backups)
+	}
+}
+
+func TestLoadPoolPolicy_schedule(t *testing.T) {
+	policy := &PoolPolicy{Schedule: []ScheduleRule{{Cron: "* 25 * * *", To: "a.com:1"}}}
+	if err := policy.compileSchedule(); err == nil {
+		t.Fatal("invalid cron should fail")
+	}
+	policy = &PoolPolicy{Schedule: []ScheduleRule{{Cron: "* * * * *"}}}
+	if err := policy.compileSchedule(); err == nil {
+		t.Fatal("schedule without target should fail")
+	}
+}
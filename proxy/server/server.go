@@ -1,18 +1,21 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"miner-proxy/pkg"
 	"miner-proxy/pkg/cache"
 	"miner-proxy/proxy/backend"
 	"miner-proxy/proxy/protocol"
+	"miner-proxy/proxy/state"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/panjf2000/gnet"
 	"github.com/panjf2000/gnet/pkg/pool/goroutine"
+	"github.com/segmentio/ksuid"
 	"github.com/spf13/cast"
 	"go.uber.org/atomic"
 )
@@ -23,6 +26,12 @@ var (
 	connId2Id sync.Map
 	connDelay sync.Map
 	p         = goroutine.Default()
+	// heartbeatMisses 隧道连接连续多少次没有响应 PING 时不再使用并且断开
+	heartbeatMisses = 3
+	// tunnelSelector 发送数据给客户端时选择隧道连接的策略
+	tunnelSelector, _ = pkg.NewTunnelSelector(pkg.TunnelRoundRobin)
+	// inflight 矿机id -> 等待 ACK 的数据帧所在的隧道连接
+	inflight sync.Map
 )
 
 type Delay struct {
@@ -30,26 +39,73 @@ type Delay struct {
 	delay     time.Duration
 }
 
+// Config 服务端配置
+type Config struct {
+	// PoolAddress 客户端没有指定矿池时使用的默认矿池
+	PoolAddress string
+	// BackupPools 默认矿池断开并且重连失败之后依次尝试的备用矿池
+	BackupPools []string
+	// Aggregate 聚合模式下每一个上游矿池连接最多承载的矿机数量, 0 表示不开启聚合
+	Aggregate int
+	// EthTranslate EthProxy 矿机连接只支持 EthereumStratum/1.0.0 的矿池时转换协议
+	EthTranslate bool
+	// PoolGroups 组名 -> 矿池组, 矿池地址为 group://组名 时使用组中延迟最低的端点
+	PoolGroups map[string]*backend.PoolGroup
+	// Policy 客户端指定矿池时的访问策略
+	Policy *PoolPolicy
+	// StratumAddresses 矿机不通过客户端直接连接服务端时监听的 stratum 地址
+	StratumAddresses []string
+	// StratumTLSAddresses 同 StratumAddresses, 使用 tls 监听
+	StratumTLSAddresses []string
+	// TLSConfig StratumTLSAddresses 使用的证书
+	TLSConfig *tls.Config
+	// HeartbeatMisses 隧道连接连续多少次没有响应心跳时认为连接失效, 0 使用默认值 3
+	HeartbeatMisses int
+	// TunnelStrategy 发送数据给客户端时选择隧道连接的策略, 为空时轮询
+	TunnelStrategy string
+	// State 多个服务端节点共享的会话状态, 为空时只在内存中保存
+	State state.Backend
+	// Relay 不为空时使用中继模式, 客户端的数据帧转发给上游服务端
+	Relay *RelayConfig
+	// ResumeWindow 客户端的隧道连接全部断开之后矿机的会话保留的时间, 0 表示不保留
+	ResumeWindow time.Duration
+}
+
 type Server struct {
 	*gnet.EventServer
-	pool        *goroutine.Pool
-	PoolAddress string
+	pool *goroutine.Pool
+	Config
+	// state 会话状态, node 当前节点的id, 每次启动时生成
+	state state.Backend
+	node  string
+	// secretKey 隧道的密钥, 同时用于加密与签名节点之间转发的数据帧
+	secretKey string
+	// owners 矿机id -> 缓存的 ownerEntry, forwards 按矿机分组按顺序处理需要转发的数据帧
+	owners   sync.Map
+	forwards []chan forwardJob
 }
 
 type Client struct {
 	id, address, ip, clientId string
-	pool                      *backend.PoolConn
-	input                     chan []byte
-	output                    chan []byte
-	closed                    *atomic.Bool
-	stop                      sync.Once
-	startTime                 time.Time
-	dataSize                  *atomic.Int64
-	seq                       *atomic.Int64
-	stopTime                  time.Time
-	ready                     *atomic.Bool
-	readyChan                 chan struct{}
-	lastSendReq               protocol.Request
+	// requested 矿机请求的矿池, target 经过替换与时间表之后的目标矿池, 用于时间窗口切换时重新计算
+	requested, target string
+	pool              backend.Pool
+	input             chan []byte
+	output            chan []byte
+	closed            *atomic.Bool
+	stop              sync.Once
+	startTime         time.Time
+	dataSize          *atomic.Int64
+	seq               *atomic.Int64
+	stopTime          time.Time
+	ready             *atomic.Bool
+	readyChan         chan struct{}
+	lastSendReq       protocol.Request
+	// latency 最近的任务传播延迟
+	latency *latencyWindow
+	// token 恢复会话使用的令牌, received 最后收到的矿机数据帧序号
+	token    string
+	received *atomic.Int64
 }
 
 func (c *Client) IsSend(req protocol.Request) bool {
@@ -95,7 +151,7 @@ func (c *Client) Wait(timeout time.Duration) bool {
 	}
 }
 
-func (c *Client) Init(req protocol.Request, defaultPoolAddress, clientId string) error {
+func (c *Client) Init(req protocol.Request, config Config, clientId string) error {
 	c.id = req.MinerId
 	c.ready = atomic.NewBool(true)
 	c.readyChan = make(chan struct{})
@@ -105,22 +161,72 @@ func (c *Client) Init(req protocol.Request, defaultPoolAddress, clientId string)
 	}
 	c.ip = lr.MinerIp
 	c.clientId = clientId
-	c.address = lr.PoolAddress
-	if c.address == "" {
-		c.address = defaultPoolAddress
+	target, backups, err := config.resolveTarget(clientId, lr.PoolAddress, time.Now())
+	if err != nil {
+		pkg.Warn("client %s miner %s request pool %s refused", clientId, lr.MinerIp, lr.PoolAddress)
+		return err
+	}
+	address, backups, err := config.selectGroup(target, backups)
+	if err != nil {
+		return err
+	}
+	c.requested, c.target = lr.PoolAddress, target
+	if address != lr.PoolAddress && lr.PoolAddress != "" {
+		pkg.Debug("rewrite pool %s -> %s", lr.PoolAddress, address)
 	}
-	c.input = make(chan []byte)
+	c.address = address
+	// 矿池重连期间矿机的数据会暂存在 input 中, 避免阻塞 gnet 的事件循环
+	c.input = make(chan []byte, 32)
 	c.output = make(chan []byte)
 	c.startTime = time.Now()
 	c.stopTime = time.Time{}
 	c.dataSize = atomic.NewInt64(0)
 	c.seq = atomic.NewInt64(0)
 	c.closed = atomic.NewBool(false)
-	p, err := backend.NewPoolConn(c.address, c.input, c.output)
+	c.latency = newLatencyWindow()
+	c.token = ksuid.New().String()
+	c.received = atomic.NewInt64(0)
+	if lr.Resume != nil && (backend.IsSV2Address(c.address) || config.Aggregate > 0) {
+		return errors.New("pool connection does not support session resume")
+	}
+	if backend.IsSV2Address(c.address) { // 矿池使用 stratum v2 协议
+		c.pool, err = backend.NewSV2Conn(c.address, clientId, c.input, c.output)
+		return err
+	}
+	if config.Aggregate > 0 { // 同一个账户的矿机共享上游矿池连接
+		c.pool, err = backend.NewAggregatedConn(c.address, clientId, c.ip, config.Aggregate, c.input, c.output)
+		return err
+	}
+	if config.EthTranslate {
+		c.pool, err = backend.NewEthTranslateConn(c.address, clientId, backups, c.input, c.output)
+	} else {
+		c.pool, err = backend.NewPoolConn(c.address, clientId, backups, c.input, c.output)
+	}
 	if err != nil {
 		return err
 	}
-	c.pool = p
+	if o, ok := c.pool.(backend.DifficultyOverrider); ok && config.Policy.difficultyFunc(clientId) != nil {
+		o.OverrideDifficulty(config.Policy.difficultyFunc(clientId))
+	}
+	if w, ok := c.pool.(backend.WorkerRewriter); ok && config.Policy.workerFunc(clientId, c.ip) != nil {
+		w.RewriteWorker(config.Policy.workerFunc(clientId, c.ip))
+	}
+	if r, ok := c.pool.(backend.PoolErrorReporter); ok {
+		r.OnAlert(func(a backend.Alert) {
+			raiseAlert(c, a)
+		})
+	}
+	if lr.Resume != nil { // 矿机从其他服务端切换过来, 在新的矿池连接上恢复会话
+		r, ok := c.pool.(backend.Resumer)
+		if !ok {
+			c.pool.Close()
+			return errors.New("pool connection does not support session resume")
+		}
+		if err := r.Resume(*lr.Resume); err != nil {
+			c.pool.Close()
+			return err
+		}
+	}
 	return nil
 }
 
@@ -134,12 +240,38 @@ func (c *Client) Close() {
 		if c.pool != nil {
 			c.pool.Close()
 		}
+		releaseInflight(c.id)
 		c.stopTime = time.Now()
 	})
 }
 
-func NewServer(address, secretKey, PoolAddress string) error {
-	s := &Server{pool: p, PoolAddress: PoolAddress}
+func NewServer(address, secretKey string, config Config) error {
+	s := &Server{pool: p, Config: config, state: config.State, node: ksuid.New().String(), secretKey: secretKey}
+	if err := s.joinCluster(); err != nil {
+		return err
+	}
+	go s.keepState()
+	if config.Relay != nil {
+		s.startRelay()
+	}
+	if config.HeartbeatMisses > 0 {
+		heartbeatMisses = config.HeartbeatMisses
+	}
+	selector, err := pkg.NewTunnelSelector(config.TunnelStrategy)
+	if err != nil {
+		return err
+	}
+	tunnelSelector = selector
+	for _, v := range config.StratumAddresses {
+		if _, err := s.listenStratum(v, nil); err != nil {
+			return err
+		}
+	}
+	for _, v := range config.StratumTLSAddresses {
+		if _, err := s.listenStratum(v, config.TLSConfig); err != nil {
+			return err
+		}
+	}
 	return gnet.Serve(s, "tcp://"+address,
 		gnet.WithReusePort(true),
 		gnet.WithReuseAddr(true),
@@ -164,13 +296,15 @@ func (ps *Server) OnClosed(c gnet.Conn, _ error) (action gnet.Action) {
 	cd.DelConn(ps.getConnId(cast.ToString(clientId), c))
 	if cd.ConnCount() == 0 {
 		conns.Delete(clientId)
+		if ps.state != nil {
+			_ = ps.pool.Submit(func() { _ = ps.state.DelTunnel(cd.ClientId, ps.node) })
+		}
 	}
 	connId2Id.Delete(c.RemoteAddr().String())
 	return gnet.None
 }
 
 func (ps *Server) Tick() (delay time.Duration, action gnet.Action) {
-	var exist = make(map[string]struct{})
 	var clientMap = make(map[string][]string)
 	clients.Range(func(key, value interface{}) bool {
 		c := value.(*Client)
@@ -180,59 +314,86 @@ func (ps *Server) Tick() (delay time.Duration, action gnet.Action) {
 		clientMap[c.clientId] = append(clientMap[c.clientId], cast.ToString(key))
 		return true
 	})
+	if ps.Relay != nil {
+		for clientId, miners := range relayMiners() {
+			clientMap[clientId] = append(clientMap[clientId], miners...)
+		}
+	}
 
-	connId2Id.Range(func(key, value interface{}) bool {
-		v, ok := conns.Load(cast.ToString(value))
-		if !ok {
+	// 每一个客户端的每一个隧道连接每次只发送一个 PING, 矿机列表只通过第一个隧道发送
+	conns.Range(func(clientId, value interface{}) bool {
+		cd := value.(*ClientDispatch)
+		if strings.HasPrefix(cd.ClientId, directClientPrefix) { // 矿机直接连接的监听端口没有隧道连接
 			return true
 		}
-		cd := v.(*ClientDispatch)
 		if cd.ConnCount() == 0 {
-			conns.Delete(value)
-			connId2Id.Delete(key)
+			conns.Delete(clientId)
 			return true
 		}
+		first := true
 		cd.conns.Range(func(key, value1 interface{}) bool {
-			req := new(protocol.Request).SetType(protocol.PING).
-				SetClientId(strings.Split(cast.ToString(key), "-")[0])
-			if _, ok := exist[cast.ToString(value)]; !ok {
-				v, _ := connDelay.Load(value)
+			conn := value1.(*Conn)
+			if conn.missed.Inc() > int64(heartbeatMisses) {
+				pkg.Warn("隧道连接 %s 连续 %d 次没有响应心跳, 断开连接", conn.Id, conn.missed.Load()-1)
+				cd.DelConn(cast.ToString(key))
+				_ = conn.Close()
+				return true
+			}
+			req := new(protocol.Request).SetType(protocol.PING).SetClientId(cd.ClientId)
+			req.Time = time.Now().UnixNano()
+			if first {
+				v, _ := connDelay.Load(clientId)
 				if v == nil {
 					v = Delay{}
 				}
-				connDelay.Store(value, Delay{
+				connDelay.Store(clientId, Delay{
 					startTime: time.Now(),
 					delay:     v.(Delay).delay,
 				})
-				if _, ok = clientMap[cast.ToString(value)]; ok {
-					req.SetData([]byte(strings.Join(clientMap[cast.ToString(value)], ",")))
+				if miners, ok := clientMap[cd.ClientId]; ok {
+					req.SetData([]byte(strings.Join(miners, ",")))
 				}
 			}
 
 			data, _ := protocol.Decode2Byte(req.End())
-			if err := value1.(*Conn).Conn.AsyncWrite(data); err != nil {
+			if err := conn.AsyncWrite(data); err != nil {
 				cd.DelConn(cast.ToString(key))
 				return true
 			}
-			exist[cast.ToString(value)] = struct{}{}
-			return false
+			first = false
+			return true
 		})
 		return true
 	})
+	connId2Id.Range(func(key, value interface{}) bool {
+		if _, ok := conns.Load(cast.ToString(value)); !ok {
+			connId2Id.Delete(key)
+		}
+		return true
+	})
+	ps.applySchedule(time.Now())
 	delay = time.Second * 20
 	return
 }
 
-func (ps *Server) SendToClient(req protocol.Request, maxTry int, clientId, _ string) error {
+func (ps *Server) SendToClient(req protocol.Request, maxTry int, clientId, minerId string) error {
+	return ps.sendToClient(req, maxTry, clientId, minerId, true)
+}
+
+// sendToClient forward 为 true 时, 当前节点没有客户端的隧道连接则通过其他节点发送
+func (ps *Server) sendToClient(req protocol.Request, maxTry int, clientId, minerId string, forward bool) error {
 	return pkg.Try(func() bool {
 		v, ok := conns.Load(clientId)
 		if !ok {
+			if forward && ps.forwardToClient(req, clientId) {
+				return true
+			}
 			time.Sleep(time.Second)
 			return false
 		}
 		cd := v.(*ClientDispatch)
 
-		conn := cd.GetConn()
+		conn := cd.GetConn(minerId)
 		if conn == nil {
 			pkg.Warn("%s 没有可用的连接", clientId)
 			time.Sleep(time.Second)
@@ -244,35 +405,68 @@ func (ps *Server) SendToClient(req protocol.Request, maxTry int, clientId, _ str
 			pkg.Warn("server data to client error: %v", err)
 			return false
 		}
+		if req.Type == protocol.DATA {
+			trackInflight(minerId, conn)
+		}
 		return true
 	}, maxTry)
 }
 
-func (ps *Server) getOrCreateClient(req protocol.Request) (*Client, error) {
+// getOrCreateClient 返回的 bool 表示矿机使用令牌恢复了已有的会话
+func (ps *Server) getOrCreateClient(req protocol.Request) (*Client, bool, error) {
 	client, ok := clients.Load(req.MinerId)
 	if ok {
-		if !client.(*Client).closed.Load() {
-			return client.(*Client), nil
+		if c := client.(*Client); !c.closed.Load() {
+			lr, err := protocol.Encode2LoginRequest(req.Data)
+			if req.Type != protocol.LOGIN || err != nil || lr.ResumeToken == "" {
+				return c, false, nil
+			}
+			if err := c.resume(lr.ResumeToken); err != nil {
+				return nil, false, err
+			}
+			return c, true, nil
 		}
 	}
 	if req.Type != protocol.LOGIN {
-		return nil, errors.New("need login")
+		return nil, false, errors.New("need login")
 	}
 	c := new(Client)
-	if err := c.Init(req, ps.PoolAddress, req.ClientId); err != nil {
-		return nil, err
+	if err := c.Init(req, ps.Config, req.ClientId); err != nil {
+		return nil, false, err
 	}
 	clients.Store(req.MinerId, c)
+	if ps.state != nil {
+		if err := ps.state.SetMiner(req.MinerId, ps.node); err != nil {
+			pkg.Warn("save miner %s to state error: %s", req.MinerId, err)
+		}
+	}
 	_ = ps.pool.Submit(c.pool.Start)
 	_ = ps.pool.Submit(func() {
 		defer c.Close()
+		defer func() {
+			if ps.state != nil {
+				_ = ps.state.DelMiner(c.id)
+			}
+		}()
 		t := time.NewTicker(time.Second * 5)
 		defer t.Stop()
 		var count int
 		for !c.closed.Load() {
+			if ps.detached(c) {
+				if !ps.waitAttach(c) {
+					return
+				}
+				continue
+			}
 			if !c.Wait(time.Second * 3) {
+				if ps.detached(c) {
+					continue
+				}
 				if count < 3 && len(c.lastSendReq.Data) != 0 {
 					if err := ps.SendToClient(c.lastSendReq, 1, c.clientId, c.id); err != nil {
+						if ps.detached(c) {
+							continue
+						}
 						pkg.Warn("try 10 times write to client failed")
 						return
 					}
@@ -293,11 +487,20 @@ func (ps *Server) getOrCreateClient(req protocol.Request) (*Client, error) {
 				}
 				req := protocol.Request{Type: protocol.DATA, MinerId: c.id, Data: data,
 					ClientId: c.clientId, Seq: c.seq.Inc()}
+				if isJobNotify(data) {
+					req.Time = time.Now().UnixNano()
+				}
 				data, _ = protocol.Decode2Byte(req)
 				if err := ps.SendToClient(req, 10, c.clientId, c.id); err != nil {
+					if ps.detached(c) { // 客户端断开期间矿机的数据已经没有意义
+						continue
+					}
 					pkg.Warn("try 10 times write to client failed")
 					return
 				}
+				if req.Time != 0 {
+					c.latency.sent(time.Since(time.Unix(0, req.Time)))
+				}
 				c.SetWait(req)
 				c.dataSize.Add(int64(len(data)))
 			case <-t.C:
@@ -305,7 +508,7 @@ func (ps *Server) getOrCreateClient(req protocol.Request) (*Client, error) {
 		}
 	})
 
-	return c, nil
+	return c, false, nil
 }
 
 func (ps *Server) getClient(MinerId string) (*Client, bool) {
@@ -320,7 +523,8 @@ func (ps *Server) getClient(MinerId string) (*Client, bool) {
 	return c, true
 }
 
-func (ps *Server) ping(req protocol.Request, _ gnet.Conn) (out []byte, action gnet.Action) {
+func (ps *Server) ping(req protocol.Request, c gnet.Conn) (out []byte, action gnet.Action) {
+	ps.pong(req, c, time.Now())
 	v, ok := connDelay.Load(req.ClientId)
 	if !ok {
 		return nil, gnet.None
@@ -335,6 +539,10 @@ func (ps *Server) ping(req protocol.Request, _ gnet.Conn) (out []byte, action gn
 			continue
 		}
 		pkg.Debug("删除过时的矿机id: %s", v)
+		if ps.Relay != nil && isRelayMiner(v) {
+			ps.relayClose(req.ClientId, v, c)
+			continue
+		}
 		client, ok := ps.getClient(v)
 		if !ok {
 			return nil, gnet.None
@@ -344,13 +552,45 @@ func (ps *Server) ping(req protocol.Request, _ gnet.Conn) (out []byte, action gn
 	return nil, gnet.None
 }
 
+// pong 重置 PONG 所在隧道连接的心跳计数, 客户端原样返回了 PING 的时间戳时记录往返延迟
+func (ps *Server) pong(req protocol.Request, c gnet.Conn, now time.Time) {
+	if c == nil {
+		return
+	}
+	v, ok := conns.Load(req.ClientId)
+	if !ok {
+		return
+	}
+	value, ok := v.(*ClientDispatch).conns.Load(ps.getConnId(req.ClientId, c))
+	if !ok {
+		return
+	}
+	conn := value.(*Conn)
+	if conn.missed != nil {
+		conn.missed.Store(0)
+	}
+	if req.Time != 0 && conn.rtt != nil {
+		conn.rtt.add(now, now.Sub(time.Unix(0, req.Time)))
+	}
+}
+
 func (ps *Server) login(req protocol.Request, _ gnet.Conn) (out []byte, action gnet.Action) {
-	_, err := ps.getOrCreateClient(req)
+	c, resumed, err := ps.getOrCreateClient(req)
 	if err != nil {
-		data, _ := protocol.Decode2Byte(protocol.Request{Type: protocol.ERROR, MinerId: req.MinerId, Data: []byte(err.Error())})
+		code := protocol.ErrPoolUnavailable
+		if errors.Is(err, ErrPoolRefused) {
+			code = protocol.ErrPoolRefused
+		}
+		if errors.Is(err, ErrInvalidToken) {
+			code = protocol.ErrNeedLogin
+		}
+		data, _ := protocol.Decode2Byte(protocol.NewErrorRequest(req.MinerId, code, err.Error()))
 		return data, gnet.None
 	}
 	req = protocol.CopyRequest(req)
+	req.Data = protocol.DecodeLoginResponse2Byte(protocol.LoginResponse{
+		Token: c.token, Resumed: resumed, Seq: c.received.Load(),
+	})
 	pkg.Debug("server -> client %s", req)
 	data, _ := protocol.Decode2Byte(req)
 	return data, gnet.None
@@ -368,13 +608,19 @@ func (ps *Server) proxy(req protocol.Request, _ gnet.Conn) (out []byte, action g
 	}()
 	client, ok := ps.getClient(req.MinerId)
 	if !ok {
-		data, _ := protocol.Decode2Byte(protocol.Request{Type: protocol.ERROR,
-			MinerId: req.MinerId, Data: []byte("need login")})
+		data, _ := protocol.Decode2Byte(protocol.NewErrorRequest(req.MinerId, protocol.ErrNeedLogin, "need login"))
 		return data, gnet.None
 	}
 	if !client.IsSend(req) {
-		client.input <- req.Data
+		// 不能在事件循环中等待, 矿池重连期间缓冲区已满时不回复 ACK, 客户端等待超时之后会重发这一帧
+		select {
+		case client.input <- req.Data:
+		default:
+			pkg.Debug("miner %s input is full, wait for client to resend seq %d", req.MinerId, req.Seq)
+			return nil, gnet.None
+		}
 		client.SetSend(req)
+		client.received.Store(req.Seq)
 	}
 
 	client.dataSize.Add(int64(len(req.Data)))
@@ -394,36 +640,51 @@ func (ps *Server) init(req protocol.Request, c gnet.Conn) (out []byte, action gn
 	if len(info) < 3 {
 		return nil, gnet.Close
 	}
+	if ps.Relay != nil {
+		ps.relayInit(req.ClientId, info[0], info[2], c)
+	}
 	v, _ := conns.LoadOrStore(req.ClientId, NewClientDispatch(req.ClientId, info[0], info[2]))
 	cd := v.(*ClientDispatch)
 
 	cd.SetConn(ps.getConnId(req.ClientId, c), c)
 	connId2Id.Store(c.RemoteAddr().String(), req.ClientId)
-	var closeMiner []string
-	for _, miner := range pkg.String2Array(info[1], ",") {
-		if _, ok := clients.Load(miner); !ok {
-			closeMiner = append(closeMiner, miner)
+	// 读写共享状态不在事件循环中进行
+	_ = ps.pool.Submit(func() {
+		if ps.state != nil {
+			_ = ps.state.AddTunnel(cd.ClientId, ps.node)
 		}
-	}
-	if len(closeMiner) != 0 {
-		data, _ := protocol.Decode2Byte(protocol.Request{
-			ClientId: cd.ClientId,
-			Type:     protocol.CLOSE,
-			Data:     []byte(strings.Join(closeMiner, ",")),
-		})
-		return data, gnet.None
-	}
+		ps.closeOrphans(cd.ClientId, pkg.String2Array(info[1], ","), c)
+	})
 	data, _ := protocol.Decode2Byte(protocol.Request{
 		ClientId: cd.ClientId,
 		Type:     req.Type,
 	})
 	pkg.Debug("server -> client %s", req)
-	cd.conns.Range(func(key, value interface{}) bool {
-		return true
-	})
 	return data, gnet.None
 }
 
+// closeOrphans 通知客户端关闭矿池连接已经不在任何节点上的矿机
+func (ps *Server) closeOrphans(clientId string, miners []string, c gnet.Conn) {
+	var closeMiner []string
+	for _, miner := range miners {
+		if _, ok := clients.Load(miner); ok || isRelayMiner(miner) {
+			continue
+		}
+		if _, ok := ps.owner(miner); !ok { // 矿池连接也不在其他节点上
+			closeMiner = append(closeMiner, miner)
+		}
+	}
+	if len(closeMiner) == 0 {
+		return
+	}
+	data, _ := protocol.Decode2Byte(protocol.Request{
+		ClientId: clientId,
+		Type:     protocol.CLOSE,
+		Data:     []byte(strings.Join(closeMiner, ",")),
+	})
+	_ = c.AsyncWrite(data)
+}
+
 func (ps *Server) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
 	defer pkg.Recover(true)
 	req, err := protocol.Encode2Request(frame)
@@ -432,6 +693,22 @@ func (ps *Server) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Acti
 		return nil, gnet.Close
 	}
 	pkg.Debug("server <- client %s", req.String())
+	if ps.Relay != nil && req.Type != protocol.INIT && req.Type != protocol.PING && req.Type != protocol.PONG {
+		if ps.forwards == nil {
+			return ps.relay(req)
+		}
+		// 写入上游服务端不在事件循环中进行
+		ps.dispatch(forwardJob{frame: forwardFrame{Request: req}, c: c})
+		return nil, gnet.None
+	}
+	if ps.forwardToOwner(req, c) { // 当前节点没有矿机的矿池连接
+		return nil, gnet.None
+	}
+	return ps.handle(req, c)
+}
+
+// handle 处理客户端发送的数据帧, 其他节点转发的数据帧 c 为 nil
+func (ps *Server) handle(req protocol.Request, c gnet.Conn) (out []byte, action gnet.Action) {
 	switch req.Type {
 	case protocol.INIT:
 		return ps.init(req, c)
@@ -453,6 +730,11 @@ func (ps *Server) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Acti
 		if !ok {
 			return nil, gnet.None
 		}
+		if req.Time != 0 {
+			rtt, _ := clientDelay(req.ClientId, time.Now())
+			client.latency.add(jobLatency(req.Time, time.Now(), rtt, client.latency.lastSend(), time.Duration(req.Delay)))
+		}
+		ackInflight(req.MinerId)
 		client.SetReady()
 		return nil, gnet.None
 	}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"miner-proxy/pkg"
+	"miner-proxy/proxy/backend"
 	"sort"
 	"strings"
 	"sync"
@@ -46,7 +47,7 @@ func init() {
 
 func Show(offlineTime time.Duration) {
 	var offlineClient = hashset.New()
-	table, _ := gotable.Create("客户端id", "矿工id", "Ip", "传输数据大小", "连接时长", "是否在线", "客户端-服务端延迟", "矿池连接", "预估算力(仅通过流量大小判断)")
+	table, _ := gotable.Create("客户端id", "矿工id", "Ip", "传输数据大小", "连接时长", "是否在线", "客户端-服务端延迟", "任务传播延迟", "矿池连接", "预估算力(仅通过流量大小判断)")
 	for _, v := range ClientInfo() {
 		for _, v1 := range v.Miners {
 			if !v1.IsOnline && !v1.stopTime.IsZero() && time.Since(v1.stopTime).Seconds() >= offlineTime.Seconds() {
@@ -63,6 +64,7 @@ func Show(offlineTime time.Duration) {
 				"矿池连接":      v1.Pool,
 				"是否在线":      cast.ToString(v1.IsOnline),
 				"客户端-服务端延迟": v.Delay,
+				"任务传播延迟":    v1.JobLatency,
 			})
 		}
 	}
@@ -179,6 +181,10 @@ type ClientRemoteAddr struct {
 	SendDataCount int     `json:"send_data_count"`
 	Miners        []Miner `json:"miners"`
 	OnlineTime    string  `json:"online_time"`
+	// PoolError 客户端使用的矿池最近一次连接失败的原因, 例如 tls 证书错误
+	PoolError string `json:"pool_error"`
+	// JobLatency 客户端所有矿机的任务传播延迟分位数
+	JobLatency string `json:"job_latency"`
 }
 
 type Miner struct {
@@ -191,6 +197,19 @@ type Miner struct {
 	StopTime string `json:"stop_time"`
 	stopTime time.Time
 	IsOnline bool `json:"is_online"`
+	// Dialect 矿机与矿池使用的 stratum 方言
+	Dialect string `json:"dialect"`
+	// Tls 是否使用 tls 连接矿池
+	Tls bool `json:"tls"`
+	// Difficulty 矿池最后一次下发给矿机的难度
+	Difficulty float64 `json:"difficulty"`
+	// Workers 矿机使用的矿工名 -> 发送给矿池的矿工名
+	Workers map[string]string `json:"workers"`
+	// Errors 矿池错误分类 -> 次数
+	Errors map[string]int64 `json:"errors"`
+	// JobLatency 任务从矿池到达服务端到写入矿机的延迟分位数
+	JobLatency string `json:"job_latency"`
+	latency    []time.Duration
 }
 
 type ClientRemoteAddrs []*ClientRemoteAddr
@@ -239,12 +258,26 @@ func ClientInfo() []*ClientRemoteAddr {
 
 		clientPools[c.clientId].Add(c.address)
 		m := &Miner{
-			Id:       c.id,
-			Ip:       c.ip,
-			Pool:     c.pool.Address(),
-			ConnTime: time.Since(c.startTime).String(),
-			Size:     humanize.Bytes(uint64(c.dataSize.Load())),
-			IsOnline: !c.closed.Load(),
+			Id:         c.id,
+			Ip:         c.ip,
+			Pool:       c.pool.Address(),
+			ConnTime:   time.Since(c.startTime).String(),
+			Size:       humanize.Bytes(uint64(c.dataSize.Load())),
+			IsOnline:   !c.closed.Load(),
+			Difficulty: c.pool.Difficulty(),
+			latency:    c.latency.values(),
+		}
+		m.JobLatency = percentiles(m.latency).String()
+		if w, ok := c.pool.(backend.WorkerRewriter); ok {
+			m.Workers = w.Workers()
+		}
+		if r, ok := c.pool.(backend.PoolErrorReporter); ok {
+			m.Errors = r.PoolErrors()
+		}
+		minerDialect, poolDialect := c.pool.Dialects()
+		m.Dialect = fmt.Sprintf("%s -> %s", minerDialect, poolDialect)
+		if address, err := backend.ParsePoolAddress(m.Pool); err == nil {
+			m.Tls = address.IsTLS()
 		}
 		if !m.IsOnline && !c.stopTime.IsZero() {
 			m.StopTime = time.Since(c.stopTime).String()
@@ -270,19 +303,30 @@ func ClientInfo() []*ClientRemoteAddr {
 		}
 		if _, ok := clientMap[cast.ToString(key)]; ok {
 			c.Miners = clientMap[cast.ToString(key)]
+			var latency []time.Duration
+			for _, miner := range c.Miners {
+				latency = append(latency, miner.latency...)
+			}
+			c.JobLatency = percentiles(latency).String()
 			c.dataSize = clientSizeMap[cast.ToString(key)]
 			c.DataSize = humanize.Bytes(uint64(clientSizeMap[cast.ToString(key)]))
 			c.Pool = strings.Join(pkg.Interface2Strings(clientPools[cast.ToString(key)].Values()), ",")
 		}
-		v, _ := connDelay.Load(c.ClientId)
-		if v == nil {
-			v = Delay{}
+		var poolErrors []string
+		pools := hashset.New()
+		for _, pool := range append(pkg.String2Array(c.Pool, ","), cd.pool) {
+			if pools.Contains(pool) {
+				continue
+			}
+			pools.Add(pool)
+			if e, ok := backend.LastPoolError(pool); ok {
+				poolErrors = append(poolErrors, fmt.Sprintf("%s: %s (%s)", pool, e.Error, e.Time.Format("2006-01-02 15:04:05")))
+			}
 		}
-
-		d := v.(Delay)
+		c.PoolError = strings.Join(poolErrors, "; ")
 		c.Delay = "等待检测"
-		if d.delay.Seconds() <= 120 {
-			c.Delay = d.delay.String()
+		if d, ok := clientDelay(c.ClientId, time.Now()); ok {
+			c.Delay = d.String()
 		}
 
 		result = append(result, c)
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"miner-proxy/proxy/backend"
+	"regexp"
+	"strings"
+)
+
+// defaultWorkerFallback 改写之后的矿工名不符合 Pattern 时默认使用 账户.矿机ip
+const defaultWorkerFallback = "{account}.{ip}"
+
+// WorkerRule 改写矿机授权时的用户名(账户.矿工名), 只对非聚合的 stratum v1 矿池连接生效
+// 模板支持 {user} 完整用户名, {account} 账户, {worker} 矿工名, {client} 客户端id, {ip} 矿机ip(.与:替换为-), {alias} 别名
+type WorkerRule struct {
+	// Clients 规则生效的客户端id, 为空时对所有客户端生效
+	Clients []string `json:"clients"`
+	// Match 只改写匹配该正则的用户名, 为空时匹配所有
+	Match string `json:"match"`
+	// Rewrite 改写使用的模板, 例如 "{account}.{client}_{worker}", 为空时不改写只检查 Pattern
+	Rewrite string `json:"rewrite"`
+	// Pattern 改写之后的用户名必须匹配的正则, 不匹配时使用 Fallback
+	Pattern string `json:"pattern"`
+	// Fallback 默认为 {account}.{ip}
+	Fallback string `json:"fallback"`
+	// Aliases 矿机ip或者矿工名 -> 别名, 没有别名时 {alias} 为矿工名
+	Aliases map[string]string `json:"aliases"`
+
+	match, pattern *regexp.Regexp
+}
+
+// compileWorkers 解析矿工名规则中的正则
+func (p *PoolPolicy) compileWorkers() error {
+	for i, v := range p.Workers {
+		var err error
+		if v.Match != "" {
+			if p.Workers[i].match, err = regexp.Compile(v.Match); err != nil {
+				return fmt.Errorf("worker rule %d: %w", i, err)
+			}
+		}
+		if v.Pattern != "" {
+			if p.Workers[i].pattern, err = regexp.Compile(v.Pattern); err != nil {
+				return fmt.Errorf("worker rule %d: %w", i, err)
+			}
+		}
+		if v.Rewrite == "" && v.Pattern == "" {
+			return fmt.Errorf("worker rule %d: rewrite or pattern is required", i)
+		}
+	}
+	return nil
+}
+
+func (r WorkerRule) applicable(clientId, user string) bool {
+	if !clientMatches(r.Clients, clientId) {
+		return false
+	}
+	return r.match == nil || r.match.MatchString(user)
+}
+
+// expand 使用模板生成用户名
+func (r WorkerRule) expand(template, clientId, ip, user string) string {
+	account, worker := user, ""
+	if index := strings.Index(user, "."); index >= 0 {
+		account, worker = user[:index], user[index+1:]
+	}
+	alias, ok := r.Aliases[ip]
+	if !ok {
+		if alias, ok = r.Aliases[worker]; !ok {
+			alias = worker
+		}
+	}
+	return strings.NewReplacer(
+		"{user}", user,
+		"{account}", account,
+		"{worker}", worker,
+		"{client}", clientId,
+		"{ip}", strings.NewReplacer(".", "-", ":", "-").Replace(ip),
+		"{alias}", alias,
+	).Replace(template)
+}
+
+func (r WorkerRule) rewrite(clientId, ip, user string) string {
+	result := user
+	if r.Rewrite != "" {
+		result = r.expand(r.Rewrite, clientId, ip, user)
+	}
+	if r.pattern != nil && !r.pattern.MatchString(result) {
+		fallback := r.Fallback
+		if fallback == "" {
+			fallback = defaultWorkerFallback
+		}
+		result = r.expand(fallback, clientId, ip, user)
+	}
+	return result
+}
+
+// workerFunc 返回客户端的矿工名改写规则, 没有规则时返回 nil
+func (p *PoolPolicy) workerFunc(clientId, ip string) backend.WorkerFunc {
+	if p == nil || len(p.Workers) == 0 {
+		return nil
+	}
+	return func(user string) (string, bool) {
+		for _, v := range p.Workers {
+			if v.applicable(clientId, user) {
+				return v.rewrite(clientId, ip, user), true
+			}
+		}
+		return "", false
+	}
+}
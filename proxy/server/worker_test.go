@@ -0,0 +1,37 @@
+package server
+
+import "testing"
+
+func TestPoolPolicy_workerFunc(t *testing.T) {
+	policy := &PoolPolicy{Workers: []WorkerRule{
+		{Clients: []string{"farm1"}, Rewrite: "{account}.farm1_{alias}", Aliases: map[string]string{"10.0.0.5": "rack5"}},
+		{Match: `^acc\.`, Pattern: `^acc\.[a-z0-9]{1,16}$`},
+		{Rewrite: "{account}.{client}_{worker}"},
+	}}
+	if err := policy.compileWorkers(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, clientId, ip, user, want string
+	}{
+		{name: "alias by ip", clientId: "farm1", ip: "10.0.0.5", user: "acc.rig1", want: "acc.farm1_rack5"},
+		{name: "alias fallback to worker", clientId: "farm1", ip: "10.0.0.6", user: "acc.rig1", want: "acc.farm1_rig1"},
+		{name: "pattern ok", clientId: "farm2", ip: "10.0.0.6", user: "acc.rig1", want: "acc.rig1"},
+		{name: "pattern fallback", clientId: "farm2", ip: "10.0.0.6", user: "acc.RIG 1", want: "acc.10-0-0-6"},
+		{name: "pattern fallback ipv6", clientId: "farm2", ip: "2001:db8::6", user: "acc.RIG 1", want: "acc.2001-db8--6"},
+		{name: "prefix", clientId: "farm2", ip: "10.0.0.6", user: "other.rig1", want: "other.farm2_rig1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := policy.workerFunc(tt.clientId, tt.ip)(tt.user)
+			if !ok || got != tt.want {
+				t.Errorf("workerFunc() = %s, %v, want %s", got, ok, tt.want)
+			}
+		})
+	}
+
+	invalid := &PoolPolicy{Workers: []WorkerRule{{Match: "("}}}
+	if err := invalid.compileWorkers(); err == nil {
+		t.Error("invalid regexp should fail")
+	}
+}
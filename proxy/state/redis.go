@@ -0,0 +1,182 @@
+package state
+
+import (
+	"context"
+	"miner-proxy/pkg"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	// redisKeyPrefix 所有 redis key 的前缀
+	redisKeyPrefix = "miner-proxy:"
+	redisTimeout   = time.Second * 3
+	// streamMaxLen 每个节点的数据流最多保留的数据帧, 近似裁剪
+	streamMaxLen = 100000
+	// streamBlock 读取数据流时等待新数据的时间, streamBatch 每次最多读取的数据帧
+	streamBlock = time.Second
+	streamBatch = 256
+	// streamField 数据帧在数据流中的字段名
+	streamField = "d"
+)
+
+// Redis 保存在 redis 中的会话状态, 多个服务端节点使用同一个 redis
+// 使用带连接池的客户端, 节点之间的数据帧通过 stream 转发, 订阅的连接断开之后从上一次读取的位置继续读取
+type Redis struct {
+	client *redis.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewRedis address 格式为 redis://:密码@host:port/db 或者 host:port
+func NewRedis(address string) (*Redis, error) {
+	if !strings.HasPrefix(address, "redis://") {
+		address = "redis://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid redis address %s", address)
+	}
+	options := &redis.Options{
+		Addr:         u.Host,
+		DialTimeout:  redisTimeout,
+		ReadTimeout:  redisTimeout,
+		WriteTimeout: redisTimeout,
+	}
+	if _, _, err := net.SplitHostPort(options.Addr); err != nil {
+		options.Addr = net.JoinHostPort(u.Host, "6379")
+	}
+	if u.User != nil {
+		options.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if options.DB, err = strconv.Atoi(db); err != nil {
+			return nil, errors.Errorf("invalid redis db %s", db)
+		}
+	}
+	s := &Redis{client: redis.NewClient(options)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if err := s.client.Ping(s.ctx).Err(); err != nil {
+		_ = s.client.Close()
+		return nil, errors.Wrapf(err, "ping redis %s", options.Addr)
+	}
+	return s, nil
+}
+
+func minerKey(minerId string) string {
+	return redisKeyPrefix + "miner:" + minerId
+}
+
+func tunnelKey(clientId string) string {
+	return redisKeyPrefix + "tunnels:" + clientId
+}
+
+func nodeStream(node string) string {
+	return redisKeyPrefix + "node:" + node
+}
+
+func (s *Redis) SetMiner(minerId, node string) error {
+	return s.client.Set(s.ctx, minerKey(minerId), node, TTL).Err()
+}
+
+func (s *Redis) Miner(minerId string) (string, bool, error) {
+	node, err := s.client.Get(s.ctx, minerKey(minerId)).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return node, true, nil
+}
+
+func (s *Redis) DelMiner(minerId string) error {
+	return s.client.Del(s.ctx, minerKey(minerId)).Err()
+}
+
+// AddTunnel 使用 sorted set 保存节点, score 为过期时间
+func (s *Redis) AddTunnel(clientId, node string) error {
+	_, err := s.client.Pipelined(s.ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(s.ctx, tunnelKey(clientId), &redis.Z{Score: float64(time.Now().Add(TTL).Unix()), Member: node})
+		pipe.Expire(s.ctx, tunnelKey(clientId), TTL)
+		return nil
+	})
+	return err
+}
+
+func (s *Redis) DelTunnel(clientId, node string) error {
+	return s.client.ZRem(s.ctx, tunnelKey(clientId), node).Err()
+}
+
+func (s *Redis) Tunnels(clientId string) ([]string, error) {
+	return s.client.ZRangeByScore(s.ctx, tunnelKey(clientId), &redis.ZRangeBy{
+		Min: strconv.FormatInt(time.Now().Unix(), 10), Max: "+inf",
+	}).Result()
+}
+
+// Publish 将数据帧追加到节点的数据流, 数据流在节点下线 TTL 之后过期
+// 客户端在连接错误时会重试, 同一个数据帧可能被写入多次
+func (s *Redis) Publish(node string, data []byte) error {
+	_, err := s.client.Pipelined(s.ctx, func(pipe redis.Pipeliner) error {
+		pipe.XAdd(s.ctx, &redis.XAddArgs{
+			Stream: nodeStream(node),
+			MaxLen: streamMaxLen,
+			Approx: true,
+			Values: []string{streamField, string(data)},
+		})
+		pipe.Expire(s.ctx, nodeStream(node), TTL)
+		return nil
+	})
+	return err
+}
+
+// Subscribe 从订阅时数据流的末尾开始读取, 读取失败之后从上一次读取的位置继续, redis 断开期间写入的数据帧不会丢失
+func (s *Redis) Subscribe(node string, handler func(data []byte)) error {
+	last := "0-0"
+	messages, err := s.client.XRevRangeN(s.ctx, nodeStream(node), "+", "-", 1).Result()
+	if err != nil {
+		return errors.Wrap(err, "redis subscribe")
+	}
+	if len(messages) != 0 {
+		last = messages[0].ID
+	}
+	go func() {
+		for s.ctx.Err() == nil {
+			streams, err := s.client.XRead(s.ctx, &redis.XReadArgs{
+				Streams: []string{nodeStream(node), last},
+				Count:   streamBatch,
+				Block:   streamBlock,
+			}).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				if s.ctx.Err() == nil {
+					pkg.Warn("read redis stream %s error: %s", nodeStream(node), err)
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+			for _, stream := range streams {
+				for _, msg := range stream.Messages { // 按照写入的顺序处理
+					last = msg.ID
+					if data, ok := msg.Values[streamField].(string); ok {
+						handler([]byte(data))
+					}
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *Redis) Close() error {
+	s.cancel()
+	return s.client.Close()
+}
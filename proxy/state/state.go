@@ -0,0 +1,157 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// TTL 节点需要在该时间之内刷新矿机与隧道的记录, 否则认为节点已经下线
+	TTL = time.Minute
+)
+
+// Backend 多个服务端节点共享的会话状态, 用于把多个服务端放在同一个负载均衡之后
+// 矿机的矿池连接只在一个节点上, 客户端的隧道连接可以分布在多个节点上, 节点之间通过 Publish 转发数据帧
+type Backend interface {
+	// SetMiner 记录矿机的矿池连接所在的节点, 需要在 TTL 之内刷新
+	SetMiner(minerId, node string) error
+	// Miner 返回矿机的矿池连接所在的节点
+	Miner(minerId string) (string, bool, error)
+	DelMiner(minerId string) error
+	// AddTunnel 记录节点持有客户端的隧道连接, 需要在 TTL 之内刷新
+	AddTunnel(clientId, node string) error
+	DelTunnel(clientId, node string) error
+	// Tunnels 返回持有客户端隧道连接的节点
+	Tunnels(clientId string) ([]string, error)
+	// Publish 发送数据给节点, Subscribe 接收发送给 node 的数据, 至少送达一次, 同一个数据可能收到多次
+	// handler 在单独的 goroutine 中按照 Publish 的顺序依次调用, 不能长时间阻塞
+	Publish(node string, data []byte) error
+	Subscribe(node string, handler func(data []byte)) error
+	Close() error
+}
+
+// Open address 为空时使用内存, 否则使用 redis, 格式为 redis://:密码@host:port/db 或者 host:port
+func Open(address string) (Backend, error) {
+	if address == "" {
+		return NewMemory(), nil
+	}
+	return NewRedis(address)
+}
+
+type expiring struct {
+	value    string
+	expireAt time.Time
+}
+
+// Memory 只在当前进程中保存的会话状态, 单个服务端时使用
+type Memory struct {
+	m        sync.Mutex
+	miners   map[string]expiring
+	tunnels  map[string]map[string]time.Time
+	handlers map[string]chan []byte
+	done     chan struct{}
+	stop     sync.Once
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		miners:   make(map[string]expiring),
+		tunnels:  make(map[string]map[string]time.Time),
+		handlers: make(map[string]chan []byte),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *Memory) SetMiner(minerId, node string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.miners[minerId] = expiring{value: node, expireAt: time.Now().Add(TTL)}
+	return nil
+}
+
+func (s *Memory) Miner(minerId string) (string, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	v, ok := s.miners[minerId]
+	if !ok || time.Now().After(v.expireAt) {
+		return "", false, nil
+	}
+	return v.value, true, nil
+}
+
+func (s *Memory) DelMiner(minerId string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.miners, minerId)
+	return nil
+}
+
+func (s *Memory) AddTunnel(clientId, node string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.tunnels[clientId] == nil {
+		s.tunnels[clientId] = make(map[string]time.Time)
+	}
+	s.tunnels[clientId][node] = time.Now().Add(TTL)
+	return nil
+}
+
+func (s *Memory) DelTunnel(clientId, node string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.tunnels[clientId], node)
+	if len(s.tunnels[clientId]) == 0 {
+		delete(s.tunnels, clientId)
+	}
+	return nil
+}
+
+func (s *Memory) Tunnels(clientId string) ([]string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var result []string
+	now := time.Now()
+	for node, expireAt := range s.tunnels[clientId] {
+		if now.Before(expireAt) {
+			result = append(result, node)
+		}
+	}
+	return result, nil
+}
+
+func (s *Memory) Publish(node string, data []byte) error {
+	s.m.Lock()
+	queue := s.handlers[node]
+	s.m.Unlock()
+	if queue == nil {
+		return nil
+	}
+	select {
+	case queue <- data:
+	case <-s.done:
+	}
+	return nil
+}
+
+func (s *Memory) Subscribe(node string, handler func(data []byte)) error {
+	queue := make(chan []byte, 1024)
+	s.m.Lock()
+	s.handlers[node] = queue
+	s.m.Unlock()
+	go func() {
+		for {
+			select {
+			case data := <-queue:
+				handler(data)
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *Memory) Close() error {
+	s.stop.Do(func() { close(s.done) })
+	return nil
+}
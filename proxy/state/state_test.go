@@ -0,0 +1,144 @@
+package state
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestBackend(t *testing.T) {
+	m := miniredis.RunT(t)
+	r, err := NewRedis("redis://" + m.Addr() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for name, s := range map[string]Backend{"memory": NewMemory(), "redis": r} {
+		t.Run(name, func(t *testing.T) {
+			if _, ok, err := s.Miner("m1"); ok || err != nil {
+				t.Fatalf("Miner() = %v, %v, want not found", ok, err)
+			}
+			_ = s.SetMiner("m1", "node1")
+			if node, ok, err := s.Miner("m1"); node != "node1" || !ok || err != nil {
+				t.Fatalf("Miner() = %s, %v, %v, want node1", node, ok, err)
+			}
+			_ = s.DelMiner("m1")
+			if _, ok, _ := s.Miner("m1"); ok {
+				t.Fatal("Miner() found after DelMiner")
+			}
+
+			_ = s.AddTunnel("c1", "node1")
+			_ = s.AddTunnel("c1", "node2")
+			_ = s.DelTunnel("c1", "node1")
+			if nodes, err := s.Tunnels("c1"); len(nodes) != 1 || nodes[0] != "node2" || err != nil {
+				t.Fatalf("Tunnels() = %v, %v, want [node2]", nodes, err)
+			}
+
+			received := make(chan []byte, 100)
+			if err := s.Subscribe("node2", func(data []byte) { received <- data }); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				if err := s.Publish("node2", []byte(fmt.Sprintf("a\r\n%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < 100; i++ {
+				select {
+				case data := <-received:
+					if want := fmt.Sprintf("a\r\n%d", i); string(data) != want {
+						t.Fatalf("received %q, want %q", data, want)
+					}
+				case <-time.After(time.Second * 3):
+					t.Fatal("publish timeout")
+				}
+			}
+		})
+	}
+}
+
+// cutProxy 转发到 redis 的 tcp 代理, cut 断开所有已经建立的连接
+type cutProxy struct {
+	m     sync.Mutex
+	conns []net.Conn
+}
+
+func newCutProxy(t *testing.T, target string) (*cutProxy, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	p := new(cutProxy)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			p.m.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.m.Unlock()
+			go func() { _, _ = io.Copy(upstream, conn) }()
+			go func() { _, _ = io.Copy(conn, upstream) }()
+		}
+	}()
+	return p, l.Addr().String()
+}
+
+func (p *cutProxy) cut() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for _, conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.conns = nil
+}
+
+func TestRedis_SubscribeReconnect(t *testing.T) {
+	m := miniredis.RunT(t)
+	proxy, addr := newCutProxy(t, m.Addr())
+	subscriber, err := NewRedis(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	publisher, err := NewRedis(m.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	received := make(chan []byte, 100)
+	if err := subscriber.Subscribe("node", func(data []byte) { received <- data }); err != nil {
+		t.Fatal(err)
+	}
+	// 订阅的连接断开期间写入的数据帧在重新连接之后从上一次读取的位置继续读取
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			proxy.cut()
+		}
+		if err := publisher.Publish("node", []byte(fmt.Sprintf("%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case data := <-received:
+			if want := fmt.Sprintf("%d", i); string(data) != want {
+				t.Fatalf("received %q, want %q", data, want)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("frame %d lost", i)
+		}
+	}
+}
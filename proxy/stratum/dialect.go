@@ -0,0 +1,85 @@
+package stratum
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Dialect 矿机或者矿池使用的 stratum 方言
+type Dialect int
+
+const (
+	DialectUnknown Dialect = iota
+	// DialectStratum 普通的 stratum v1 协议
+	DialectStratum
+	// DialectEthProxy eth_submitLogin/eth_getWork/eth_submitWork
+	DialectEthProxy
+	// DialectEthereumStratum NiceHash EthereumStratum/1.0.0
+	DialectEthereumStratum
+	// DialectStratumV2 二进制的 stratum v2 协议, 只会出现在矿池一侧
+	DialectStratumV2
+)
+
+const (
+	EthereumStratumVersion = "EthereumStratum/1.0.0"
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case DialectStratum:
+		return "stratum"
+	case DialectEthProxy:
+		return "ethproxy"
+	case DialectEthereumStratum:
+		return "ethereumstratum"
+	case DialectStratumV2:
+		return "stratum2"
+	}
+	return "unknown"
+}
+
+func isEthereumStratum(data json.RawMessage) bool {
+	return strings.Contains(string(data), EthereumStratumVersion)
+}
+
+// DetectMinerDialect 根据矿机发送的消息判断方言
+func DetectMinerDialect(msg Message) Dialect {
+	switch msg.Method {
+	case "eth_submitLogin", "eth_login", "eth_getWork", "eth_submitWork":
+		return DialectEthProxy
+	case "mining.subscribe":
+		if isEthereumStratum(msg.Params) {
+			return DialectEthereumStratum
+		}
+		return DialectStratum
+	case "mining.authorize", "mining.configure", "mining.submit":
+		return DialectStratum
+	}
+	return DialectUnknown
+}
+
+// DetectPoolDialect 根据矿池发送的消息判断方言
+func DetectPoolDialect(msg Message) Dialect {
+	if msg.IsResponse() {
+		if isEthereumStratum(msg.Result) {
+			return DialectEthereumStratum
+		}
+		var work []string
+		if err := json.Unmarshal(msg.Result, &work); err == nil && len(work) >= 3 && strings.HasPrefix(work[0], "0x") {
+			return DialectEthProxy
+		}
+		return DialectUnknown
+	}
+	if msg.Method != "mining.notify" {
+		return DialectUnknown
+	}
+	var params []json.RawMessage
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return DialectUnknown
+	}
+	// EthereumStratum/1.0.0 的任务只有 jobId, seedHash, headerHash, cleanJobs 4个参数
+	if len(params) == 4 {
+		return DialectEthereumStratum
+	}
+	return DialectStratum
+}
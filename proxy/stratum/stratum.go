@@ -0,0 +1,110 @@
+package stratum
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+const (
+	// maxLineSize 单行消息的最大长度, 超过之后认为不是 stratum 协议, 丢弃缓存
+	maxLineSize = 64 * 1024
+)
+
+// Message stratum json-rpc 消息, 请求/响应/通知共用一个结构
+type Message struct {
+	Id      json.RawMessage `json:"id"`
+	Jsonrpc string          `json:"jsonrpc,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	// Worker EthProxy 协议的矿工名称
+	Worker string          `json:"worker,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+// IsResponse 没有 method 的消息是对请求的响应
+func (m Message) IsResponse() bool {
+	return m.Method == ""
+}
+
+// IdKey 返回 id 的字符串形式, 用于匹配请求与响应
+func (m Message) IdKey() string {
+	return string(bytes.TrimSpace(m.Id))
+}
+
+// HasError error 字段不为空且不为 null
+func (m Message) HasError() bool {
+	e := bytes.TrimSpace(m.Error)
+	return len(e) != 0 && !bytes.Equal(e, []byte("null"))
+}
+
+// Encode 编码为一行以 \n 结尾的数据
+func (m Message) Encode() []byte {
+	if len(m.Id) == 0 {
+		m.Id = json.RawMessage("null")
+	}
+	data, _ := json.Marshal(m)
+	return append(data, '\n')
+}
+
+// Decode 解析一行 stratum 消息
+func Decode(line []byte) (Message, error) {
+	var result Message
+	err := json.Unmarshal(bytes.TrimSpace(line), &result)
+	return result, err
+}
+
+// NewNotify 构建一个 id 为 null 的通知消息
+func NewNotify(method string, params ...interface{}) Message {
+	if params == nil {
+		params = []interface{}{}
+	}
+	data, _ := json.Marshal(params)
+	return Message{Method: method, Params: data}
+}
+
+// Splitter 将 tcp 数据流切分为以 \n 结尾的行
+type Splitter struct {
+	buf []byte
+}
+
+// Feed 写入数据, 返回已经完整的行(包含 \n)
+func (s *Splitter) Feed(data []byte) [][]byte {
+	s.buf = append(s.buf, data...)
+	var lines [][]byte
+	for {
+		index := bytes.IndexByte(s.buf, '\n')
+		if index < 0 {
+			break
+		}
+		line := make([]byte, index+1)
+		copy(line, s.buf[:index+1])
+		lines = append(lines, line)
+		s.buf = s.buf[index+1:]
+	}
+	if len(s.buf) > maxLineSize {
+		s.buf = nil
+	}
+	return lines
+}
+
+// Pending 返回还没有组成完整行的数据
+func (s *Splitter) Pending() []byte {
+	return s.buf
+}
+
+// Reset 清空缓存
+func (s *Splitter) Reset() {
+	s.buf = nil
+}
+
+// SessionState 矿机的 stratum 会话, 用于在新的矿池连接上恢复矿机的会话
+type SessionState struct {
+	// Requests 矿机按顺序发送的握手请求, 每一个都是完整的一行
+	Requests [][]byte `msgpack:"requests"`
+	// Extranonce1, Extranonce2Size 矿机当前使用的 extranonce
+	Extranonce1     string `msgpack:"extranonce1"`
+	Extranonce2Size int    `msgpack:"extranonce2_size"`
+	// ExtranonceSubscribed 矿机支持 mining.set_extranonce
+	ExtranonceSubscribed bool `msgpack:"extranonce_subscribed"`
+}
@@ -0,0 +1,80 @@
+package stratum
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitter_Feed(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []string
+		want    []string
+		pending string
+	}{
+		{"one line", []string{"{\"id\":1}\n"}, []string{"{\"id\":1}\n"}, ""},
+		{"split line", []string{"{\"id\"", ":1}\n{\"id\":2"}, []string{"{\"id\":1}\n"}, "{\"id\":2"},
+		{"many lines", []string{"a\nb\nc"}, []string{"a\n", "b\n"}, "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s Splitter
+			var got []string
+			for _, v := range tt.data {
+				for _, line := range s.Feed([]byte(v)) {
+					got = append(got, string(line))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Feed() = %q, want %q", got, tt.want)
+			}
+			if string(s.Pending()) != tt.pending {
+				t.Errorf("Pending() = %q, want %q", s.Pending(), tt.pending)
+			}
+		})
+	}
+}
+
+func TestMessage(t *testing.T) {
+	msg, err := Decode([]byte(`{"id":3,"result":null,"error":[21,"Job not found",null]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.IsResponse() || !msg.HasError() || msg.IdKey() != "3" {
+		t.Errorf("Decode() = %+v", msg)
+	}
+	if got := string(NewNotify("client.reconnect").Encode()); got != "{\"id\":null,\"method\":\"client.reconnect\",\"params\":[]}\n" {
+		t.Errorf("Encode() = %s", got)
+	}
+}
+
+func TestDetectDialect(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		miner bool
+		want  Dialect
+	}{
+		{"ethproxy login", `{"id":1,"method":"eth_submitLogin","params":["0x1","x"],"worker":"w"}`, true, DialectEthProxy},
+		{"nicehash subscribe", `{"id":1,"method":"mining.subscribe","params":["m","EthereumStratum/1.0.0"]}`, true, DialectEthereumStratum},
+		{"stratum subscribe", `{"id":1,"method":"mining.subscribe","params":["cgminer"]}`, true, DialectStratum},
+		{"nicehash subscribe result", `{"id":1,"result":[["mining.notify","ae","EthereumStratum/1.0.0"],"080c"],"error":null}`, false, DialectEthereumStratum},
+		{"ethproxy work", `{"id":0,"jsonrpc":"2.0","result":["0xab","0xcd","0xef"]}`, false, DialectEthProxy},
+		{"nicehash notify", `{"id":null,"method":"mining.notify","params":["1","ab","cd",true]}`, false, DialectEthereumStratum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := Decode([]byte(tt.line))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := DetectPoolDialect(msg)
+			if tt.miner {
+				got = DetectMinerDialect(msg)
+			}
+			if got != tt.want {
+				t.Errorf("detect dialect = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
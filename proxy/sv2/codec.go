@@ -0,0 +1,222 @@
+package sv2
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// headerSize extension_type(2) + msg_type(1) + msg_length(3)
+	headerSize = 6
+	// channelBit extension_type 的最高位表示该消息属于某个通道
+	channelBit = 0x8000
+)
+
+var (
+	ErrShortPayload = errors.New("sv2 payload too short")
+)
+
+// Frame 一个 sv2 消息
+type Frame struct {
+	ExtType uint16
+	MsgType uint8
+	Payload []byte
+}
+
+// IsChannel 消息是否属于某个通道
+func (f Frame) IsChannel() bool {
+	return f.ExtType&channelBit != 0
+}
+
+func (f Frame) header() []byte {
+	h := make([]byte, headerSize)
+	binary.LittleEndian.PutUint16(h, f.ExtType)
+	h[2] = f.MsgType
+	putU24(h[3:], uint32(len(f.Payload)))
+	return h
+}
+
+func decodeHeader(h []byte) (Frame, int) {
+	return Frame{
+		ExtType: binary.LittleEndian.Uint16(h),
+		MsgType: h[2],
+	}, int(uint32(h[3]) | uint32(h[4])<<8 | uint32(h[5])<<16)
+}
+
+func putU24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// Writer 按照 sv2 的数据类型编码, 所有整数都是小端序
+type Writer struct {
+	buf []byte
+}
+
+func (w *Writer) Bytes() []byte {
+	return w.buf
+}
+
+func (w *Writer) U8(v uint8) *Writer {
+	w.buf = append(w.buf, v)
+	return w
+}
+
+func (w *Writer) Bool(v bool) *Writer {
+	if v {
+		return w.U8(1)
+	}
+	return w.U8(0)
+}
+
+func (w *Writer) U16(v uint16) *Writer {
+	w.buf = append(w.buf, byte(v), byte(v>>8))
+	return w
+}
+
+func (w *Writer) U32(v uint32) *Writer {
+	w.buf = append(w.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+	return w
+}
+
+func (w *Writer) U64(v uint64) *Writer {
+	w.U32(uint32(v))
+	return w.U32(uint32(v >> 32))
+}
+
+func (w *Writer) F32(v float32) *Writer {
+	return w.U32(math.Float32bits(v))
+}
+
+// U256 固定32字节
+func (w *Writer) U256(v []byte) *Writer {
+	b := make([]byte, 32)
+	copy(b, v)
+	w.buf = append(w.buf, b...)
+	return w
+}
+
+// Str0_255 1字节长度前缀的字符串
+func (w *Writer) Str0_255(v string) *Writer {
+	return w.B0_255([]byte(v))
+}
+
+// B0_255 1字节长度前缀的字节数组, B0_32 同样使用该编码
+func (w *Writer) B0_255(v []byte) *Writer {
+	if len(v) > math.MaxUint8 {
+		v = v[:math.MaxUint8]
+	}
+	w.buf = append(w.U8(uint8(len(v))).buf, v...)
+	return w
+}
+
+// B0_64K 2字节长度前缀的字节数组
+func (w *Writer) B0_64K(v []byte) *Writer {
+	if len(v) > math.MaxUint16 {
+		v = v[:math.MaxUint16]
+	}
+	w.buf = append(w.U16(uint16(len(v))).buf, v...)
+	return w
+}
+
+// Seq0_255U256 1字节长度前缀的 U256 列表
+func (w *Writer) Seq0_255U256(v [][]byte) *Writer {
+	w.U8(uint8(len(v)))
+	for _, item := range v {
+		w.U256(item)
+	}
+	return w
+}
+
+// OptionU32 OPTION[U32], nil 表示没有值
+func (w *Writer) OptionU32(v *uint32) *Writer {
+	if v == nil {
+		return w.U8(0)
+	}
+	return w.U8(1).U32(*v)
+}
+
+// Reader 按照 sv2 的数据类型解码, 出错之后的读取都会返回零值, 通过 Err 获取第一个错误
+type Reader struct {
+	buf []byte
+	err error
+}
+
+func NewReader(data []byte) *Reader {
+	return &Reader{buf: data}
+}
+
+func (r *Reader) Err() error {
+	return r.err
+}
+
+func (r *Reader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.buf) < n {
+		r.err = ErrShortPayload
+		return make([]byte, n)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *Reader) U8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *Reader) Bool() bool {
+	return r.U8()&1 == 1
+}
+
+func (r *Reader) U16() uint16 {
+	return binary.LittleEndian.Uint16(r.next(2))
+}
+
+func (r *Reader) U32() uint32 {
+	return binary.LittleEndian.Uint32(r.next(4))
+}
+
+func (r *Reader) U64() uint64 {
+	return binary.LittleEndian.Uint64(r.next(8))
+}
+
+func (r *Reader) F32() float32 {
+	return math.Float32frombits(r.U32())
+}
+
+func (r *Reader) U256() []byte {
+	return append([]byte{}, r.next(32)...)
+}
+
+func (r *Reader) Str0_255() string {
+	return string(r.B0_255())
+}
+
+func (r *Reader) B0_255() []byte {
+	return append([]byte{}, r.next(int(r.U8()))...)
+}
+
+func (r *Reader) B0_64K() []byte {
+	return append([]byte{}, r.next(int(r.U16()))...)
+}
+
+func (r *Reader) Seq0_255U256() [][]byte {
+	n := int(r.U8())
+	result := make([][]byte, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		result = append(result, r.U256())
+	}
+	return result
+}
+
+func (r *Reader) OptionU32() *uint32 {
+	if r.U8() == 0 {
+		return nil
+	}
+	v := r.U32()
+	return &v
+}
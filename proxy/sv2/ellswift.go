@@ -0,0 +1,150 @@
+package sv2
+
+import (
+	"crypto/rand"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/pkg/errors"
+)
+
+// BIP324 的 ElligatorSwift 编码, 已经发布的 btcec 版本中还没有 ellswift 包, 这里只实现编码的映射,
+// 域元素的运算都使用 btcec 的 FieldVal; 编码的内容是公钥, 映射中的分支不涉及私钥
+
+var (
+	// minus3Sqrt sqrt(-3), 与 BIP324 参考实现相同
+	minus3Sqrt, _ = feSqrt(feNeg(feInt(3)))
+	half          = feInv(feInt(2))
+)
+
+// 以下运算的参数与结果都是规范化的 FieldVal, 不修改参数
+
+func feInt(v uint16) *btcec.FieldVal { return new(btcec.FieldVal).SetInt(v) }
+
+func feAdd(a, b *btcec.FieldVal) *btcec.FieldVal { return new(btcec.FieldVal).Add2(a, b).Normalize() }
+
+func feSub(a, b *btcec.FieldVal) *btcec.FieldVal { return feAdd(a, feNeg(b)) }
+
+func feMul(a, b *btcec.FieldVal) *btcec.FieldVal { return new(btcec.FieldVal).Mul2(a, b).Normalize() }
+
+func feNeg(a *btcec.FieldVal) *btcec.FieldVal { return new(btcec.FieldVal).NegateVal(a, 1).Normalize() }
+
+func feInv(a *btcec.FieldVal) *btcec.FieldVal { return new(btcec.FieldVal).Set(a).Inverse().Normalize() }
+
+func feDiv(a, b *btcec.FieldVal) *btcec.FieldVal { return feMul(a, feInv(b)) }
+
+// feSqrt 返回 a 的平方根, 不存在时返回 false
+func feSqrt(a *btcec.FieldVal) (*btcec.FieldVal, bool) {
+	r := new(btcec.FieldVal)
+	ok := r.SquareRootVal(a)
+	return r.Normalize(), ok
+}
+
+// curveY2 返回 x^3 + 7
+func curveY2(x *btcec.FieldVal) *btcec.FieldVal {
+	return feAdd(feMul(feMul(x, x), x), feInt(7))
+}
+
+// isValidX x 是否是曲线上的点的横坐标
+func isValidX(x *btcec.FieldVal) bool {
+	_, ok := feSqrt(curveY2(x))
+	return ok
+}
+
+// xswiftec ElligatorSwift 解码, 返回 (u, t) 对应的横坐标
+func xswiftec(u, t *btcec.FieldVal) *btcec.FieldVal {
+	if u.IsZero() {
+		u = feInt(1)
+	}
+	if t.IsZero() {
+		t = feInt(1)
+	}
+	if feAdd(curveY2(u), feMul(t, t)).IsZero() {
+		t = feMul(feInt(2), t)
+	}
+	x := feDiv(feSub(curveY2(u), feMul(t, t)), feMul(feInt(2), t))
+	y := feDiv(feAdd(x, t), feMul(minus3Sqrt, u))
+	for _, candidate := range []*btcec.FieldVal{
+		feAdd(u, feMul(feInt(4), feMul(y, y))),
+		feMul(feSub(feNeg(feDiv(x, y)), u), half),
+		feMul(feSub(feDiv(x, y), u), half),
+	} {
+		if isValidX(candidate) {
+			return candidate
+		}
+	}
+	return nil // 不会出现
+}
+
+// xswiftecInv 返回 t 使 xswiftec(u, t) = x, c 选择最多8个结果中的一个, 不存在时返回 nil
+func xswiftecInv(x, u *btcec.FieldVal, c int) *btcec.FieldVal {
+	var s, v *btcec.FieldVal
+	if c&2 == 0 {
+		if isValidX(feSub(feNeg(x), u)) {
+			return nil
+		}
+		v = x
+		s = feNeg(feDiv(curveY2(u), feAdd(feAdd(feMul(u, u), feMul(u, v)), feMul(v, v))))
+	} else {
+		s = feSub(x, u)
+		if s.IsZero() {
+			return nil
+		}
+		r, ok := feSqrt(feNeg(feMul(s, feAdd(feMul(feInt(4), curveY2(u)), feMul(feMul(feInt(3), s), feMul(u, u))))))
+		if !ok || (c&1 == 1 && r.IsZero()) {
+			return nil
+		}
+		if c&1 == 1 {
+			r = feNeg(r)
+		}
+		v = feMul(feAdd(feNeg(u), feDiv(r, s)), half)
+	}
+	w, ok := feSqrt(s)
+	if !ok {
+		return nil
+	}
+	minus := feMul(feMul(u, feSub(feInt(1), minus3Sqrt)), half)
+	plus := feMul(feMul(u, feAdd(feInt(1), minus3Sqrt)), half)
+	switch c & 5 {
+	case 0:
+		return feNeg(feMul(w, feAdd(minus, v)))
+	case 1:
+		return feMul(w, feAdd(plus, v))
+	case 4:
+		return feMul(w, feAdd(minus, v))
+	default:
+		return feNeg(feMul(w, feAdd(plus, v)))
+	}
+}
+
+// ellswiftEncode 使用随机的 u 将横坐标编码为 64 字节的 ElligatorSwift
+func ellswiftEncode(x *btcec.FieldVal) ([]byte, error) {
+	data := make([]byte, 33)
+	for {
+		if _, err := rand.Read(data); err != nil {
+			return nil, err
+		}
+		u := new(btcec.FieldVal)
+		u.SetByteSlice(data[:32])
+		if u.Normalize().IsZero() {
+			continue
+		}
+		t := xswiftecInv(x, u, int(data[32]&7))
+		if t == nil || !xswiftec(u, t).Equals(x) {
+			continue
+		}
+		result := make([]byte, 0, ellswiftSize)
+		result = append(result, u.Bytes()[:]...)
+		return append(result, t.Bytes()[:]...), nil
+	}
+}
+
+// ellswiftDecode 返回 64 字节 ElligatorSwift 编码对应的横坐标
+func ellswiftDecode(data []byte) (*btcec.FieldVal, error) {
+	if len(data) != ellswiftSize {
+		return nil, errors.Errorf("invalid ElligatorSwift encoding size %d", len(data))
+	}
+	var u, t btcec.FieldVal
+	u.SetByteSlice(data[:32])
+	t.SetByteSlice(data[32:])
+	return xswiftec(u.Normalize(), t.Normalize()), nil
+}
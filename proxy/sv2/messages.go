@@ -0,0 +1,294 @@
+package sv2
+
+import (
+	"github.com/pkg/errors"
+)
+
+// 挖矿协议(extension_type = 0)的消息类型
+const (
+	MsgSetupConnection                  uint8 = 0x00
+	MsgSetupConnectionSuccess           uint8 = 0x01
+	MsgSetupConnectionError             uint8 = 0x02
+	MsgOpenMiningChannelError           uint8 = 0x12
+	MsgOpenExtendedMiningChannel        uint8 = 0x13
+	MsgOpenExtendedMiningChannelSuccess uint8 = 0x14
+	MsgSubmitSharesExtended             uint8 = 0x1b
+	MsgSubmitSharesSuccess              uint8 = 0x1c
+	MsgSubmitSharesError                uint8 = 0x1d
+	MsgNewExtendedMiningJob             uint8 = 0x1f
+	MsgSetNewPrevHash                   uint8 = 0x20
+	MsgSetTarget                        uint8 = 0x21
+)
+
+const (
+	// ProtocolMining SetupConnection 中的挖矿协议
+	ProtocolMining uint8 = 0
+	// FlagRequiresVersionRolling SetupConnection 挖矿协议的 flags, 下游会修改区块头的 version
+	FlagRequiresVersionRolling uint32 = 1 << 2
+)
+
+// Message sv2 消息
+type Message interface {
+	MsgType() uint8
+	encode(w *Writer)
+	decode(r *Reader)
+}
+
+// channelMessage 属于某个通道的消息, 编码时需要设置 channelBit
+type channelMessage interface {
+	channel()
+}
+
+// Encode 将消息编码为 Frame
+func Encode(m Message) Frame {
+	w := &Writer{}
+	m.encode(w)
+	f := Frame{MsgType: m.MsgType(), Payload: w.Bytes()}
+	if _, ok := m.(channelMessage); ok {
+		f.ExtType |= channelBit
+	}
+	return f
+}
+
+// Decode 将 Frame 解码到 m 中
+func Decode(f Frame, m Message) error {
+	if f.MsgType != m.MsgType() {
+		return errors.Errorf("sv2 message type %#x not match %#x", f.MsgType, m.MsgType())
+	}
+	r := NewReader(f.Payload)
+	m.decode(r)
+	return errors.Wrapf(r.Err(), "decode sv2 message %#x error", f.MsgType)
+}
+
+type SetupConnection struct {
+	Protocol        uint8
+	MinVersion      uint16
+	MaxVersion      uint16
+	Flags           uint32
+	EndpointHost    string
+	EndpointPort    uint16
+	Vendor          string
+	HardwareVersion string
+	Firmware        string
+	DeviceId        string
+}
+
+func (m *SetupConnection) MsgType() uint8 { return MsgSetupConnection }
+
+func (m *SetupConnection) encode(w *Writer) {
+	w.U8(m.Protocol).U16(m.MinVersion).U16(m.MaxVersion).U32(m.Flags).
+		Str0_255(m.EndpointHost).U16(m.EndpointPort).
+		Str0_255(m.Vendor).Str0_255(m.HardwareVersion).Str0_255(m.Firmware).Str0_255(m.DeviceId)
+}
+
+func (m *SetupConnection) decode(r *Reader) {
+	m.Protocol, m.MinVersion, m.MaxVersion, m.Flags = r.U8(), r.U16(), r.U16(), r.U32()
+	m.EndpointHost, m.EndpointPort = r.Str0_255(), r.U16()
+	m.Vendor, m.HardwareVersion, m.Firmware, m.DeviceId = r.Str0_255(), r.Str0_255(), r.Str0_255(), r.Str0_255()
+}
+
+type SetupConnectionSuccess struct {
+	UsedVersion uint16
+	Flags       uint32
+}
+
+func (m *SetupConnectionSuccess) MsgType() uint8 { return MsgSetupConnectionSuccess }
+
+func (m *SetupConnectionSuccess) encode(w *Writer) {
+	w.U16(m.UsedVersion).U32(m.Flags)
+}
+
+func (m *SetupConnectionSuccess) decode(r *Reader) {
+	m.UsedVersion, m.Flags = r.U16(), r.U32()
+}
+
+type SetupConnectionError struct {
+	Flags     uint32
+	ErrorCode string
+}
+
+func (m *SetupConnectionError) MsgType() uint8 { return MsgSetupConnectionError }
+
+func (m *SetupConnectionError) encode(w *Writer) {
+	w.U32(m.Flags).Str0_255(m.ErrorCode)
+}
+
+func (m *SetupConnectionError) decode(r *Reader) {
+	m.Flags, m.ErrorCode = r.U32(), r.Str0_255()
+}
+
+type OpenExtendedMiningChannel struct {
+	RequestId         uint32
+	UserIdentity      string
+	NominalHashRate   float32
+	MaxTarget         []byte
+	MinExtranonceSize uint16
+}
+
+func (m *OpenExtendedMiningChannel) MsgType() uint8 { return MsgOpenExtendedMiningChannel }
+
+func (m *OpenExtendedMiningChannel) encode(w *Writer) {
+	w.U32(m.RequestId).Str0_255(m.UserIdentity).F32(m.NominalHashRate).U256(m.MaxTarget).U16(m.MinExtranonceSize)
+}
+
+func (m *OpenExtendedMiningChannel) decode(r *Reader) {
+	m.RequestId, m.UserIdentity, m.NominalHashRate = r.U32(), r.Str0_255(), r.F32()
+	m.MaxTarget, m.MinExtranonceSize = r.U256(), r.U16()
+}
+
+type OpenExtendedMiningChannelSuccess struct {
+	RequestId        uint32
+	ChannelId        uint32
+	Target           []byte
+	ExtranonceSize   uint16
+	ExtranoncePrefix []byte
+}
+
+func (m *OpenExtendedMiningChannelSuccess) MsgType() uint8 {
+	return MsgOpenExtendedMiningChannelSuccess
+}
+
+func (m *OpenExtendedMiningChannelSuccess) encode(w *Writer) {
+	w.U32(m.RequestId).U32(m.ChannelId).U256(m.Target).U16(m.ExtranonceSize).B0_255(m.ExtranoncePrefix)
+}
+
+func (m *OpenExtendedMiningChannelSuccess) decode(r *Reader) {
+	m.RequestId, m.ChannelId, m.Target = r.U32(), r.U32(), r.U256()
+	m.ExtranonceSize, m.ExtranoncePrefix = r.U16(), r.B0_255()
+}
+
+type OpenMiningChannelError struct {
+	RequestId uint32
+	ErrorCode string
+}
+
+func (m *OpenMiningChannelError) MsgType() uint8 { return MsgOpenMiningChannelError }
+
+func (m *OpenMiningChannelError) encode(w *Writer) {
+	w.U32(m.RequestId).Str0_255(m.ErrorCode)
+}
+
+func (m *OpenMiningChannelError) decode(r *Reader) {
+	m.RequestId, m.ErrorCode = r.U32(), r.Str0_255()
+}
+
+// NewExtendedMiningJob MinNtime 为空时表示未来的任务, 需要等待 SetNewPrevHash 激活
+type NewExtendedMiningJob struct {
+	ChannelId             uint32
+	JobId                 uint32
+	MinNtime              *uint32
+	Version               uint32
+	VersionRollingAllowed bool
+	MerklePath            [][]byte
+	CoinbasePrefix        []byte
+	CoinbaseSuffix        []byte
+}
+
+func (m *NewExtendedMiningJob) MsgType() uint8 { return MsgNewExtendedMiningJob }
+func (m *NewExtendedMiningJob) channel()       {}
+
+func (m *NewExtendedMiningJob) encode(w *Writer) {
+	w.U32(m.ChannelId).U32(m.JobId).OptionU32(m.MinNtime).U32(m.Version).Bool(m.VersionRollingAllowed).
+		Seq0_255U256(m.MerklePath).B0_64K(m.CoinbasePrefix).B0_64K(m.CoinbaseSuffix)
+}
+
+func (m *NewExtendedMiningJob) decode(r *Reader) {
+	m.ChannelId, m.JobId, m.MinNtime = r.U32(), r.U32(), r.OptionU32()
+	m.Version, m.VersionRollingAllowed = r.U32(), r.Bool()
+	m.MerklePath, m.CoinbasePrefix, m.CoinbaseSuffix = r.Seq0_255U256(), r.B0_64K(), r.B0_64K()
+}
+
+// SetNewPrevHash PrevHash 与区块头中的字节序相同
+type SetNewPrevHash struct {
+	ChannelId uint32
+	JobId     uint32
+	PrevHash  []byte
+	MinNtime  uint32
+	Nbits     uint32
+}
+
+func (m *SetNewPrevHash) MsgType() uint8 { return MsgSetNewPrevHash }
+func (m *SetNewPrevHash) channel()       {}
+
+func (m *SetNewPrevHash) encode(w *Writer) {
+	w.U32(m.ChannelId).U32(m.JobId).U256(m.PrevHash).U32(m.MinNtime).U32(m.Nbits)
+}
+
+func (m *SetNewPrevHash) decode(r *Reader) {
+	m.ChannelId, m.JobId, m.PrevHash, m.MinNtime, m.Nbits = r.U32(), r.U32(), r.U256(), r.U32(), r.U32()
+}
+
+// SetTarget MaximumTarget 为小端序的 U256
+type SetTarget struct {
+	ChannelId     uint32
+	MaximumTarget []byte
+}
+
+func (m *SetTarget) MsgType() uint8 { return MsgSetTarget }
+func (m *SetTarget) channel()       {}
+
+func (m *SetTarget) encode(w *Writer) {
+	w.U32(m.ChannelId).U256(m.MaximumTarget)
+}
+
+func (m *SetTarget) decode(r *Reader) {
+	m.ChannelId, m.MaximumTarget = r.U32(), r.U256()
+}
+
+type SubmitSharesExtended struct {
+	ChannelId      uint32
+	SequenceNumber uint32
+	JobId          uint32
+	Nonce          uint32
+	Ntime          uint32
+	Version        uint32
+	Extranonce     []byte
+}
+
+func (m *SubmitSharesExtended) MsgType() uint8 { return MsgSubmitSharesExtended }
+func (m *SubmitSharesExtended) channel()       {}
+
+func (m *SubmitSharesExtended) encode(w *Writer) {
+	w.U32(m.ChannelId).U32(m.SequenceNumber).U32(m.JobId).U32(m.Nonce).U32(m.Ntime).U32(m.Version).B0_255(m.Extranonce)
+}
+
+func (m *SubmitSharesExtended) decode(r *Reader) {
+	m.ChannelId, m.SequenceNumber, m.JobId = r.U32(), r.U32(), r.U32()
+	m.Nonce, m.Ntime, m.Version, m.Extranonce = r.U32(), r.U32(), r.U32(), r.B0_255()
+}
+
+// SubmitSharesSuccess 确认 LastSequenceNumber 以及之前所有未被拒绝的份额
+type SubmitSharesSuccess struct {
+	ChannelId               uint32
+	LastSequenceNumber      uint32
+	NewSubmitsAcceptedCount uint32
+	NewSharesSum            uint64
+}
+
+func (m *SubmitSharesSuccess) MsgType() uint8 { return MsgSubmitSharesSuccess }
+func (m *SubmitSharesSuccess) channel()       {}
+
+func (m *SubmitSharesSuccess) encode(w *Writer) {
+	w.U32(m.ChannelId).U32(m.LastSequenceNumber).U32(m.NewSubmitsAcceptedCount).U64(m.NewSharesSum)
+}
+
+func (m *SubmitSharesSuccess) decode(r *Reader) {
+	m.ChannelId, m.LastSequenceNumber, m.NewSubmitsAcceptedCount, m.NewSharesSum = r.U32(), r.U32(), r.U32(), r.U64()
+}
+
+type SubmitSharesError struct {
+	ChannelId      uint32
+	SequenceNumber uint32
+	ErrorCode      string
+}
+
+func (m *SubmitSharesError) MsgType() uint8 { return MsgSubmitSharesError }
+func (m *SubmitSharesError) channel()       {}
+
+func (m *SubmitSharesError) encode(w *Writer) {
+	w.U32(m.ChannelId).U32(m.SequenceNumber).Str0_255(m.ErrorCode)
+}
+
+func (m *SubmitSharesError) decode(r *Reader) {
+	m.ChannelId, m.SequenceNumber, m.ErrorCode = r.U32(), r.U32(), r.Str0_255()
+}
@@ -0,0 +1,453 @@
+package sv2
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// 使用 stratum v2 规范的 Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256 握手
+// 公钥使用 BIP324 的 ElligatorSwift 编码, ECDH 使用 BIP324 的 x-only ECDH
+// 矿池的静态公钥由证书(SignatureNoiseMessage)签名, 签名使用 BIP340 schnorr,
+// 签名内容为 sha256(version|valid_from|not_valid_after|静态公钥的横坐标)
+const (
+	protocolName = "Noise_NX_Secp256k1+EllSwift_ChaChaPoly_SHA256"
+	keySize      = 32
+	// ellswiftSize ElligatorSwift 编码的公钥长度
+	ellswiftSize = 64
+	macSize      = 16
+	// certSize version(2) + valid_from(4) + not_valid_after(4) + signature(64)
+	certSize = 2 + 4 + 4 + 64
+	// maxChunkSize 每一个加密块最大的明文长度
+	maxChunkSize = 65535 - macSize
+)
+
+// Keypair secp256k1 密钥对, Public 为 ElligatorSwift 编码的公钥
+type Keypair struct {
+	Private, Public []byte
+}
+
+func GenerateKeypair() (Keypair, error) {
+	k, err := btcec.NewPrivateKey()
+	if err != nil {
+		return Keypair{}, errors.Wrap(err, "generate keypair")
+	}
+	public, err := ellswiftEncode(publicX(k))
+	if err != nil {
+		return Keypair{}, err
+	}
+	return Keypair{Private: k.Serialize(), Public: public}, nil
+}
+
+// XOnly 返回证书中签名的公钥
+func (k Keypair) XOnly() []byte {
+	return XOnlyPublicKey(k.Private)
+}
+
+// ParseAuthorityKey 解析矿池公布的 authority 公钥, 支持 64 位 hex 的 x-only 公钥与 base58check 编码
+func ParseAuthorityKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	data, err := base58CheckDecode(s)
+	if err != nil {
+		return nil, err
+	}
+	// 2 字节小端序的版本号 + 32 字节的 x-only 公钥
+	if len(data) != 34 || binary.LittleEndian.Uint16(data) != 1 {
+		return nil, errors.Errorf("invalid authority public key %s", s)
+	}
+	return data[2:], nil
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+func base58CheckDecode(s string) ([]byte, error) {
+	result := new(big.Int)
+	for _, v := range s {
+		index := strings.IndexRune(base58Alphabet, v)
+		if index < 0 {
+			return nil, errors.Errorf("invalid base58 string %s", s)
+		}
+		result.Mul(result, big.NewInt(58))
+		result.Add(result, big.NewInt(int64(index)))
+	}
+	data := result.Bytes()
+	for _, v := range s {
+		if v != '1' {
+			break
+		}
+		data = append([]byte{0}, data...)
+	}
+	if len(data) < 4 {
+		return nil, errors.Errorf("invalid base58check string %s", s)
+	}
+	payload, checksum := data[:len(data)-4], data[len(data)-4:]
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	if !bytes.Equal(second[:4], checksum) {
+		return nil, errors.Errorf("invalid base58check checksum %s", s)
+	}
+	return payload, nil
+}
+
+// Certificate 矿池静态公钥的证书
+type Certificate struct {
+	Version       uint16
+	ValidFrom     uint32
+	NotValidAfter uint32
+	Signature     []byte
+}
+
+// signedHash 返回签名的消息, static 为静态公钥的横坐标
+func (c Certificate) signedHash(static []byte) []byte {
+	data := make([]byte, 10, 10+len(static))
+	binary.LittleEndian.PutUint16(data, c.Version)
+	binary.LittleEndian.PutUint32(data[2:], c.ValidFrom)
+	binary.LittleEndian.PutUint32(data[6:], c.NotValidAfter)
+	sum := sha256.Sum256(append(data, static...))
+	return sum[:]
+}
+
+func (c Certificate) encode() []byte {
+	data := make([]byte, 10, certSize)
+	binary.LittleEndian.PutUint16(data, c.Version)
+	binary.LittleEndian.PutUint32(data[2:], c.ValidFrom)
+	binary.LittleEndian.PutUint32(data[6:], c.NotValidAfter)
+	return append(data, c.Signature...)
+}
+
+func decodeCertificate(data []byte) (Certificate, error) {
+	if len(data) != certSize {
+		return Certificate{}, errors.Errorf("invalid certificate size %d", len(data))
+	}
+	return Certificate{
+		Version:       binary.LittleEndian.Uint16(data),
+		ValidFrom:     binary.LittleEndian.Uint32(data[2:]),
+		NotValidAfter: binary.LittleEndian.Uint32(data[6:]),
+		Signature:     data[10:],
+	}, nil
+}
+
+// NewCertificate 使用 authority 私钥为矿池静态公钥签发证书, static 为静态公钥的横坐标
+func NewCertificate(authority, static []byte, validity time.Duration) (Certificate, error) {
+	now := time.Now()
+	c := Certificate{
+		ValidFrom:     uint32(now.Add(-time.Minute).Unix()),
+		NotValidAfter: uint32(now.Add(validity).Unix()),
+	}
+	aux := make([]byte, 32)
+	if _, err := rand.Read(aux); err != nil {
+		return Certificate{}, err
+	}
+	sig, err := SchnorrSign(authority, c.signedHash(static), aux)
+	if err != nil {
+		return Certificate{}, err
+	}
+	c.Signature = sig
+	return c, nil
+}
+
+// Verify 校验证书的有效期, authority 不为空时校验签名, static 为静态公钥的横坐标
+func (c Certificate) Verify(authority, static []byte) error {
+	now := uint32(time.Now().Unix())
+	if now < c.ValidFrom || now > c.NotValidAfter {
+		return errors.New("pool certificate expired")
+	}
+	if len(authority) == 0 {
+		return nil
+	}
+	if !SchnorrVerify(authority, c.signedHash(static), c.Signature) {
+		return errors.New("pool certificate signature invalid")
+	}
+	return nil
+}
+
+type cipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newCipherState(key []byte) (*cipherState, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &cipherState{aead: aead}, nil
+}
+
+func (c *cipherState) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.n)
+	c.n++
+	return nonce
+}
+
+func (c *cipherState) encrypt(ad, plaintext []byte) []byte {
+	return c.aead.Seal(nil, c.nonce(), plaintext, ad)
+}
+
+func (c *cipherState) decrypt(ad, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nonce(), ciphertext, ad)
+}
+
+func hmacSha256(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, v := range data {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+// hkdf noise 规范中的 HKDF, 返回两个输出
+func hkdf(ck, ikm []byte) ([]byte, []byte) {
+	temp := hmacSha256(ck, ikm)
+	out1 := hmacSha256(temp, []byte{0x01})
+	out2 := hmacSha256(temp, out1, []byte{0x02})
+	return out1, out2
+}
+
+type symmetricState struct {
+	ck, h []byte
+	cs    *cipherState
+}
+
+func newSymmetricState() *symmetricState {
+	// 协议名称超过 32 字节, 使用协议名称的 hash
+	h := sha256.Sum256([]byte(protocolName))
+	s := &symmetricState{ck: append([]byte{}, h[:]...), h: h[:]}
+	s.mixHash(nil) // prologue 为空
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	sum := sha256.Sum256(append(append([]byte{}, s.h...), data...))
+	s.h = sum[:]
+}
+
+func (s *symmetricState) mixKey(ikm []byte) error {
+	var key []byte
+	s.ck, key = hkdf(s.ck, ikm)
+	cs, err := newCipherState(key)
+	if err != nil {
+		return err
+	}
+	s.cs = cs
+	return nil
+}
+
+func (s *symmetricState) encryptAndHash(plaintext []byte) []byte {
+	if s.cs == nil {
+		s.mixHash(plaintext)
+		return plaintext
+	}
+	ciphertext := s.cs.encrypt(s.h, plaintext)
+	s.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if s.cs == nil {
+		s.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+	plaintext, err := s.cs.decrypt(s.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split 握手完成之后生成发送与接收的密钥, 第一个为发起方发送使用
+func (s *symmetricState) split() (*cipherState, *cipherState, error) {
+	k1, k2 := hkdf(s.ck, nil)
+	c1, err := newCipherState(k1)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := newCipherState(k2)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c1, c2, nil
+}
+
+// Conn Noise 加密之后的 sv2 连接
+type Conn struct {
+	net.Conn
+	rm, wm     sync.Mutex
+	send, recv *cipherState
+}
+
+// Client 作为发起方完成 Noise NX 握手, authority 为 x-only 公钥
+// authority 为空时只校验证书的有效期, 不能确认矿池的身份, 只能在使用者明确选择不校验时使用
+func Client(conn net.Conn, authority []byte) (*Conn, error) {
+	s := newSymmetricState()
+	e, err := GenerateKeypair()
+	if err != nil {
+		return nil, err
+	}
+	// -> e
+	s.mixHash(e.Public)
+	msg := append(append([]byte{}, e.Public...), s.encryptAndHash(nil)...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, errors.Wrap(err, "write noise handshake error")
+	}
+
+	// <- e, ee, s, es, payload
+	msg = make([]byte, ellswiftSize+ellswiftSize+macSize+certSize+macSize)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, errors.Wrap(err, "read noise handshake error")
+	}
+	re := msg[:ellswiftSize]
+	s.mixHash(re)
+	shared, err := ellswiftXDH(e.Public, re, e.Private, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mixKey(shared); err != nil {
+		return nil, err
+	}
+	rs, err := s.decryptAndHash(msg[ellswiftSize : ellswiftSize*2+macSize])
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt pool static key error")
+	}
+	if shared, err = ellswiftXDH(e.Public, rs, e.Private, true); err != nil {
+		return nil, err
+	}
+	if err := s.mixKey(shared); err != nil {
+		return nil, err
+	}
+	payload, err := s.decryptAndHash(msg[ellswiftSize*2+macSize:])
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt pool certificate error")
+	}
+	cert, err := decodeCertificate(payload)
+	if err != nil {
+		return nil, err
+	}
+	static, err := ellswiftDecode(rs)
+	if err != nil {
+		return nil, err
+	}
+	x := static.Bytes()
+	if err := cert.Verify(authority, x[:]); err != nil {
+		return nil, err
+	}
+	send, recv, err := s.split()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, send: send, recv: recv}, nil
+}
+
+// Server 作为响应方完成 Noise NX 握手
+func Server(conn net.Conn, static Keypair, cert Certificate) (*Conn, error) {
+	s := newSymmetricState()
+	// -> e
+	msg := make([]byte, ellswiftSize)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, errors.Wrap(err, "read noise handshake error")
+	}
+	re := msg
+	s.mixHash(re)
+	if _, err := s.decryptAndHash(nil); err != nil {
+		return nil, err
+	}
+
+	// <- e, ee, s, es, payload
+	e, err := GenerateKeypair()
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(e.Public)
+	out := append([]byte{}, e.Public...)
+	shared, err := ellswiftXDH(re, e.Public, e.Private, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.mixKey(shared); err != nil {
+		return nil, err
+	}
+	out = append(out, s.encryptAndHash(static.Public)...)
+	if shared, err = ellswiftXDH(re, static.Public, static.Private, false); err != nil {
+		return nil, err
+	}
+	if err := s.mixKey(shared); err != nil {
+		return nil, err
+	}
+	out = append(out, s.encryptAndHash(cert.encode())...)
+	if _, err := conn.Write(out); err != nil {
+		return nil, errors.Wrap(err, "write noise handshake error")
+	}
+	recv, send, err := s.split()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, send: send, recv: recv}, nil
+}
+
+// ReadFrame 读取并且解密一个 sv2 消息
+func (c *Conn) ReadFrame() (Frame, error) {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	data := make([]byte, headerSize+macSize)
+	if _, err := io.ReadFull(c.Conn, data); err != nil {
+		return Frame{}, err
+	}
+	header, err := c.recv.decrypt(nil, data)
+	if err != nil {
+		return Frame{}, errors.Wrap(err, "decrypt frame header error")
+	}
+	f, length := decodeHeader(header)
+	for length > 0 {
+		size := length
+		if size > maxChunkSize {
+			size = maxChunkSize
+		}
+		chunk := make([]byte, size+macSize)
+		if _, err := io.ReadFull(c.Conn, chunk); err != nil {
+			return Frame{}, err
+		}
+		plaintext, err := c.recv.decrypt(nil, chunk)
+		if err != nil {
+			return Frame{}, errors.Wrap(err, "decrypt frame payload error")
+		}
+		f.Payload = append(f.Payload, plaintext...)
+		length -= size
+	}
+	return f, nil
+}
+
+// WriteFrame 加密并且发送一个 sv2 消息
+func (c *Conn) WriteFrame(f Frame) error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+	out := c.send.encrypt(nil, f.header())
+	payload := f.Payload
+	for len(payload) > 0 {
+		size := len(payload)
+		if size > maxChunkSize {
+			size = maxChunkSize
+		}
+		out = append(out, c.send.encrypt(nil, payload[:size])...)
+		payload = payload[size:]
+	}
+	_, err := c.Conn.Write(out)
+	return err
+}
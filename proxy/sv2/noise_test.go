@@ -0,0 +1,101 @@
+package sv2
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSchnorr(t *testing.T) {
+	// BIP340 test vector 0
+	private, _ := hex.DecodeString("0000000000000000000000000000000000000000000000000000000000000003")
+	msg, aux := make([]byte, 32), make([]byte, 32)
+	public := XOnlyPublicKey(private)
+	if hex.EncodeToString(public) != "f9308a019258c31049344f85f89d5229b531c845836f99b08601f113bce036f9" {
+		t.Fatalf("XOnlyPublicKey() = %x", public)
+	}
+	sig, err := SchnorrSign(private, msg, aux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "e907831f80848d1069a5371b402410364bdf1c5f8307b0084c55f1ce2dca8215" +
+		"25f66a4a85ea8b71e482a74f382d2ce5ebeee8fdb2172f477df4900d310536c0"
+	if hex.EncodeToString(sig) != want {
+		t.Fatalf("SchnorrSign() = %x", sig)
+	}
+	if !SchnorrVerify(public, msg, sig) {
+		t.Fatal("SchnorrVerify() = false")
+	}
+	msg[0] = 1
+	if SchnorrVerify(public, msg, sig) {
+		t.Fatal("SchnorrVerify() should fail for another message")
+	}
+}
+
+func TestEllswift(t *testing.T) {
+	// libsecp256k1 中的常量 c1 = (sqrt(-3)-1)/2
+	c1 := feMul(feSub(minus3Sqrt, feInt(1)), half).Bytes()
+	if hex.EncodeToString(c1[:]) != "851695d49a83f8ef919bb86153cbcb16630fb68aed0a766a3ec693d68e6afa40" {
+		t.Fatalf("c1 = %x", c1)
+	}
+	for i := 0; i < 8; i++ {
+		a, _ := GenerateKeypair()
+		b, _ := GenerateKeypair()
+		x, err := ellswiftDecode(a.Public)
+		if err != nil || !bytes.Equal(x.Bytes()[:], a.XOnly()) {
+			t.Fatalf("ellswiftDecode() = %x, want %x", x, a.XOnly())
+		}
+		s1, err1 := ellswiftXDH(a.Public, b.Public, a.Private, true)
+		s2, err2 := ellswiftXDH(a.Public, b.Public, b.Private, false)
+		if err1 != nil || err2 != nil || !bytes.Equal(s1, s2) {
+			t.Fatalf("ellswiftXDH() = %x %x, %v %v", s1, s2, err1, err2)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	authority, _ := GenerateKeypair()
+	other, _ := GenerateKeypair()
+	static, _ := GenerateKeypair()
+	cert, err := NewCertificate(authority.Private, static.XOnly(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		authority []byte
+		wantErr   bool
+	}{
+		{name: "authority", authority: authority.XOnly()},
+		{name: "other authority", authority: other.XOnly(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			servers := make(chan *Conn, 1)
+			go func() {
+				conn, _ := Server(b, static, cert)
+				servers <- conn
+			}()
+			client, err := Client(a, tt.authority)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Client() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			server := <-servers
+			if tt.wantErr {
+				return
+			}
+			go func() {
+				_ = client.WriteFrame(Frame{MsgType: MsgSetupConnection, Payload: []byte("hello")})
+			}()
+			f, err := server.ReadFrame()
+			if err != nil || f.MsgType != MsgSetupConnection || string(f.Payload) != "hello" {
+				t.Fatalf("ReadFrame() = %+v, %v", f, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package sv2
+
+import (
+	"crypto/sha256"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/pkg/errors"
+)
+
+// secp256k1 的点运算与 BIP340 签名都使用 btcec
+
+// privateKey 解析 32 字节的私钥, 私钥必须在 [1, n) 之间
+func privateKey(private []byte) (*btcec.PrivateKey, error) {
+	var k btcec.ModNScalar
+	if len(private) != 32 || k.SetByteSlice(private) || k.IsZero() {
+		return nil, errors.New("invalid private key")
+	}
+	return btcec.PrivKeyFromScalar(&k), nil
+}
+
+// publicX 返回私钥对应的公钥的横坐标
+func publicX(k *btcec.PrivateKey) *btcec.FieldVal {
+	var p btcec.JacobianPoint
+	k.PubKey().AsJacobian(&p)
+	return p.X.Normalize()
+}
+
+// taggedHash BIP340 的 tagged hash
+func taggedHash(tag string, data ...[]byte) []byte {
+	t := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(t[:])
+	h.Write(t[:])
+	for _, v := range data {
+		h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+// ellswiftXDH BIP324 的 x-only ECDH, ellA 为发起方的公钥编码, ellB 为响应方的公钥编码
+func ellswiftXDH(ellA, ellB, private []byte, initiator bool) ([]byte, error) {
+	theirs := ellB
+	if !initiator {
+		theirs = ellA
+	}
+	x, err := ellswiftDecode(theirs)
+	if err != nil {
+		return nil, err
+	}
+	var y btcec.FieldVal
+	if !btcec.DecompressY(x, false, &y) {
+		return nil, errors.New("invalid ElligatorSwift public key")
+	}
+	k, err := privateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	shared := btcec.GenerateSharedSecret(k, btcec.NewPublicKey(x, &y))
+	return taggedHash("bip324_ellswift_xonly_ecdh", ellA, ellB, shared), nil
+}
+
+// XOnlyPublicKey 返回私钥对应的 BIP340 公钥
+func XOnlyPublicKey(private []byte) []byte {
+	k, err := privateKey(private)
+	if err != nil {
+		return nil
+	}
+	return schnorr.SerializePubKey(k.PubKey())
+}
+
+// SchnorrSign 使用 BIP340 签名 32 字节的消息, aux 为 32 字节的随机数
+func SchnorrSign(private, msg, aux []byte) ([]byte, error) {
+	k, err := privateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [32]byte
+	copy(nonce[:], aux)
+	sig, err := schnorr.Sign(k, msg, schnorr.CustomNonce(nonce))
+	if err != nil {
+		return nil, errors.Wrap(err, "schnorr sign")
+	}
+	return sig.Serialize(), nil
+}
+
+// SchnorrVerify 使用 BIP340 校验签名, public 为 32 字节的公钥
+func SchnorrVerify(public, msg, sig []byte) bool {
+	key, err := schnorr.ParsePubKey(public)
+	if err != nil {
+		return false
+	}
+	signature, err := schnorr.ParseSignature(sig)
+	if err != nil {
+		return false
+	}
+	return signature.Verify(msg, key)
+}